@@ -0,0 +1,75 @@
+/*
+ * The purpose of this package is to remember the old names of renamed
+ * sites so that requests using them can be redirected.
+ */
+
+package aliases
+
+import (
+	"encoding/json"
+	"os"
+	"../fileStore"
+)
+
+// Aliases are kept in one hidden file in the store, mapping old site
+// names to current ones.
+const fileName = ".aliases"
+
+type loader interface {
+	Load(file_name string) ([]byte, error)
+	Exists(file_name string) bool
+}
+
+func load(store loader) (map[string]string, error) {
+	aliases := make(map[string]string)
+	if !store.Exists(fileName) {
+		return aliases, nil
+	}
+	data, err := store.Load(fileName)
+	if os.IsNotExist(err) {
+		return aliases, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &aliases)
+	return aliases, err
+}
+
+// The current name of a site that used to be called name.
+func Lookup(fs *fileStore.FileStore, name string) (string, bool) {
+	aliases, err := load(fs)
+	if err != nil {
+		return "", false
+	}
+	current, ok := aliases[name]
+	return current, ok
+}
+
+// Record in tx that old_name is now new_name. Aliases to old_name are
+// moved along, and new_name stops being an alias since it is now in use.
+// With keep false, no alias is left for old_name itself.
+func Rename(tx *fileStore.Transaction, old_name string, new_name string, keep bool) error {
+	aliases, err := load(tx)
+	if err != nil {
+		return err
+	}
+
+	for alias, current := range aliases {
+		if current == old_name {
+			aliases[alias] = new_name
+		}
+	}
+	delete(aliases, new_name)
+	if keep {
+		aliases[old_name] = new_name
+	} else {
+		delete(aliases, old_name)
+	}
+
+	data, err := json.Marshal(aliases)
+	if err != nil {
+		return err
+	}
+	tx.Write(fileName, data)
+	return nil
+}
@@ -0,0 +1,357 @@
+/*
+ * The purpose of this package is to apply a list of site and access point
+ * changes as a single transaction: either all of them are made or none.
+ */
+
+package batch
+
+import (
+	"errors"
+	"strconv"
+	"time"
+	"../entities"
+	"../fileStore"
+	"../hierarchy"
+	"../schema"
+)
+
+// Operation names.
+const (
+	CreateSite = "create_site"
+	UpdateSite = "update_site"
+	DeleteSite = "delete_site"
+	CreateAP = "create_ap"
+	UpdateAP = "update_ap"
+	DeleteAP = "delete_ap"
+)
+
+// One change. Site operations other than delete take a Site body; access
+// point operations name their site with Name, and take an AccessPoint
+// body or, for deletes, a Label.
+type Operation struct {
+	Op string
+	Name string `json:",omitempty"`
+	Label string `json:",omitempty"`
+	Site *entities.Site `json:",omitempty"`
+	AccessPoint *entities.AccessPoint `json:",omitempty"`
+}
+
+type Result struct {
+	Index int
+	Op string
+	Status string
+	Error string `json:",omitempty"`
+	Violations []entities.Violation `json:",omitempty"`
+}
+
+type Response struct {
+	Committed bool
+	Results []Result
+}
+
+// Result statuses.
+const (
+	Applied = "applied"
+	Failed = "failed"
+	// Not applied because another operation failed.
+	RolledBack = "rolled_back"
+)
+
+// Called with the sites being deleted in tx before it is committed, so
+// that what refers to them is changed in the same commit. Set at startup.
+var Deleting func(tx *fileStore.Transaction, site_names ...string) error
+
+// Delete sites in tx, along with what refers to them. Every deletion of a
+// site, in a batch or not, goes through here.
+func DeleteSites(tx *fileStore.Transaction, site_names ...string) error {
+	for _, site_name := range site_names {
+		tx.Delete(site_name)
+	}
+	if Deleting == nil || len(site_names) == 0 {
+		return nil
+	}
+	return Deleting(tx, site_names...)
+}
+
+// Names of the stored children of a site, set at startup so that deleting a
+// site does not read every site. If nil every site is read instead.
+var Children func(site_name string) ([]string, error)
+
+// Whether a site still has children once tx is committed. Children known
+// to the store may have been moved or deleted by tx, so each is read again.
+func hasChildren(tx *fileStore.Transaction, site_name string) (bool, error) {
+	if Children == nil {
+		tree, err := hierarchy.Load(tx)
+		if err != nil {
+			return false, err
+		}
+		return len(tree.Children(site_name)) > 0, nil
+	}
+	children, err := Children(site_name)
+	if err != nil {
+		return false, err
+	}
+	for _, child_name := range children {
+		if !tx.Exists(child_name) {
+			continue
+		}
+		child, err := loadSite(tx, child_name)
+		if err != nil {
+			return false, err
+		}
+		if child.Parent == site_name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Apply operations in order against fs. Sites are validated once all
+// operations have run, and nothing is written unless every operation and
+// every changed site is valid. Changes are recorded as made by actor.
+func Apply(fs *fileStore.FileStore, operations []Operation, actor string) ([]Result, error) {
+	return ApplyWith(fs, operations, actor, nil)
+}
+
+// Apply operations as Apply does, and if they succeed call also with the
+// transaction, so that other files can be changed in the same commit.
+func ApplyWith(fs *fileStore.FileStore, operations []Operation, actor string, also func(tx *fileStore.Transaction)) ([]Result, error) {
+	var site_names []string
+	for _, op := range operations {
+		site_names = append(site_names, op.Name)
+		if op.Site != nil {
+			site_names = append(site_names, op.Site.Name)
+		}
+	}
+	defer fileStore.Lock(site_names...)()
+
+	tx := fs.Begin()
+	now := time.Now().UTC()
+	results := make([]Result, len(operations))
+	// Index of the last operation to change each site that still exists.
+	touched := make(map[string]int)
+	var order []string
+	// Index of the last operation to delete each site.
+	deleted := make(map[string]int)
+	sites_changed := false
+
+	for i, op := range operations {
+		results[i] = Result{Index: i, Op: op.Op, Status: Applied}
+		site_name, err := apply(tx, op, actor, now)
+		if err != nil {
+			return fail(results, i, err), err
+		}
+		if _, ok := touched[site_name]; !ok {
+			order = append(order, site_name)
+		}
+		if op.Op == DeleteSite {
+			delete(touched, site_name)
+			deleted[site_name] = i
+		} else {
+			touched[site_name] = i
+		}
+		if op.Op == CreateSite || op.Op == UpdateSite || op.Op == DeleteSite {
+			sites_changed = true
+		}
+	}
+
+	// The sites as the batch leaves them, by name.
+	sites := make(map[string]entities.Site)
+	for _, site_name := range order {
+		i, ok := touched[site_name]
+		if !ok {
+			continue
+		}
+		site, err := loadSite(tx, site_name)
+		if err == nil {
+			err = site.Validate()
+		}
+		if err != nil {
+			return fail(results, i, err), err
+		}
+		sites[site_name] = site
+	}
+
+	// Parents may be created in the same batch as their children, and Urls
+	// moved between sites, so they are checked once every operation has run.
+	if sites_changed || entities.SitesRules != nil {
+		var changed []entities.Site
+		for _, site := range sites {
+			changed = append(changed, site)
+		}
+		tree, err := hierarchy.LoadAncestors(tx, changed...)
+		if err != nil {
+			return fail(results, -1, err), err
+		}
+		check_urls := entities.AgainstSites(nil)
+		// Only global uniqueness needs every site.
+		if entities.SitesRules != nil {
+			all, err := hierarchy.Load(tx)
+			if err != nil {
+				return fail(results, -1, err), err
+			}
+			check_urls = entities.AgainstSites(all.Sites())
+		}
+		for _, site_name := range order {
+			i, ok := touched[site_name]
+			if !ok {
+				continue
+			}
+			site := sites[site_name]
+			violations := append(tree.Check(site_name), check_urls(&site)...)
+			if len(violations) > 0 {
+				err = &entities.ValidationError{Violations: violations}
+				return fail(results, i, err), err
+			}
+		}
+		for site_name, i := range deleted {
+			if tx.Exists(site_name) {
+				continue
+			}
+			has_children, err := hasChildren(tx, site_name)
+			if err == nil && has_children {
+				err = errors.New("Site " + site_name + " has children")
+			}
+			if err != nil {
+				return fail(results, i, err), err
+			}
+		}
+	}
+
+	if also != nil {
+		also(tx)
+	}
+	err := tx.Commit()
+	if err != nil {
+		return fail(results, -1, err), err
+	}
+	return results, nil
+}
+
+// Mark operation index as failed and every other one as rolled back.
+func fail(results []Result, index int, err error) []Result {
+	for i := range results {
+		if i == index {
+			results[i].Status = Failed
+			results[i].Error = err.Error()
+			if invalid, ok := err.(*entities.ValidationError); ok {
+				results[i].Violations = invalid.Violations
+			}
+		} else {
+			results[i].Status = RolledBack
+		}
+	}
+	return results
+}
+
+// Apply one operation, returning the name of the site it changed.
+func apply(tx *fileStore.Transaction, op Operation, actor string, now time.Time) (string, error) {
+	site_name := op.Name
+	switch op.Op {
+	case CreateSite, UpdateSite:
+		if op.Site == nil {
+			return "", errors.New(op.Op + " needs a Site")
+		}
+		site_name = op.Site.Name
+	case DeleteSite, CreateAP, UpdateAP, DeleteAP:
+	default:
+		return "", errors.New("Unknown operation: " + strconv.Quote(op.Op))
+	}
+	// Names are file names, check them before touching the store.
+	if !entities.ValidSiteName(site_name) {
+		return site_name, errors.New("Site name can only contain lowercase letters")
+	}
+
+	switch op.Op {
+	case CreateSite, UpdateSite:
+		site := *op.Site
+		exists := tx.Exists(site.Name)
+		if op.Op == CreateSite && exists {
+			return site.Name, errors.New("A site already exists with this name")
+		}
+		if op.Op == UpdateSite {
+			if !exists {
+				return site.Name, errors.New("Site does not exist")
+			}
+			// As with EditSite, access points and maintenance are not
+			// updated here.
+			old_site, err := loadSite(tx, site.Name)
+			if err != nil {
+				return site.Name, err
+			}
+			site.Access_points = old_site.Access_points
+			site.Maintenance = old_site.Maintenance
+		} else {
+			// New sites start out of maintenance, as with CreateSite.
+			site.Maintenance = nil
+		}
+		return site.Name, writeSite(tx, site, actor, now)
+
+	case DeleteSite:
+		if !tx.Exists(op.Name) {
+			return op.Name, errors.New("Site does not exist")
+		}
+		return op.Name, DeleteSites(tx, op.Name)
+
+	case CreateAP, UpdateAP, DeleteAP:
+		site, err := loadSite(tx, op.Name)
+		if err != nil {
+			return op.Name, err
+		}
+		label := op.Label
+		if op.Op != DeleteAP {
+			if op.AccessPoint == nil {
+				return op.Name, errors.New(op.Op + " needs an AccessPoint")
+			}
+			label = op.AccessPoint.Label
+		}
+
+		index := -1
+		for i, ap := range site.Access_points {
+			if ap.Label == label {
+				index = i
+				break
+			}
+		}
+		switch {
+		case op.Op == CreateAP && index >= 0:
+			return op.Name, errors.New("Access Point already exists")
+		case op.Op == CreateAP:
+			site.Access_points = append(site.Access_points, *op.AccessPoint)
+		case index < 0:
+			return op.Name, errors.New("Access Point does not exist")
+		case op.Op == UpdateAP:
+			site.Access_points[index] = *op.AccessPoint
+		default:
+			site.Access_points = append(site.Access_points[:index], site.Access_points[index + 1:]...)
+		}
+		return op.Name, writeSite(tx, site, actor, now)
+	}
+	return site_name, nil
+}
+
+func loadSite(tx *fileStore.Transaction, site_name string) (entities.Site, error) {
+	if !tx.Exists(site_name) {
+		return entities.Site{}, errors.New("Site does not exist")
+	}
+	file_data, err := tx.Load(site_name)
+	if err != nil {
+		return entities.Site{}, err
+	}
+	return schema.DecodeSite(file_data)
+}
+
+// Write site, stamped against its current version in tx.
+func writeSite(tx *fileStore.Transaction, site entities.Site, actor string, now time.Time) error {
+	var old *entities.Site
+	if old_site, err := loadSite(tx, site.Name); err == nil {
+		old = &old_site
+	}
+	site.Stamp(old, actor, now)
+	site_json, err := schema.EncodeSite(&site)
+	if err != nil {
+		return err
+	}
+	tx.Write(site.Name, site_json)
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+ * The purpose of this package is to count how often each access point is
+ * opened through its short link.
+ */
+
+package clicks
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"../fileStore"
+)
+
+// Counts are kept in one hidden file in the store, keyed by site and
+// access point label.
+const fileName = ".clicks"
+
+// Click counts held in memory and written to the store by Flush.
+type Counter struct {
+	mutex sync.Mutex
+	// By site, then access point label.
+	counts map[string]map[string]int64
+	dirty bool
+}
+
+func NewCounter() *Counter {
+	return &Counter{counts: make(map[string]map[string]int64)}
+}
+
+func key(site string, label string) string {
+	return site + "/" + label
+}
+
+func (c *Counter) Add(site string, label string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.counts[site] == nil {
+		c.counts[site] = make(map[string]int64)
+	}
+	c.counts[site][label]++
+	c.dirty = true
+}
+
+func (c *Counter) Count(site string, label string) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[site][label]
+}
+
+// Drop the counts of the access points of site that are not in labels,
+// every one of them for a deleted site.
+func (c *Counter) Retain(site string, labels []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	keep := make(map[string]bool)
+	for _, label := range labels {
+		keep[label] = true
+	}
+	for label := range c.counts[site] {
+		if !keep[label] {
+			delete(c.counts[site], label)
+			c.dirty = true
+		}
+	}
+	if len(c.counts[site]) == 0 {
+		delete(c.counts, site)
+	}
+}
+
+// Keep the counts of a renamed site under its new name.
+func (c *Counter) Rename(site string, new_site string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if counts, ok := c.counts[site]; ok {
+		delete(c.counts, site)
+		c.counts[new_site] = counts
+		c.dirty = true
+	}
+}
+
+// Keep the count of a moved access point under its new site and label.
+func (c *Counter) Move(site string, label string, new_site string, new_label string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count, ok := c.counts[site][label]
+	if !ok {
+		return
+	}
+	delete(c.counts[site], label)
+	if len(c.counts[site]) == 0 {
+		delete(c.counts, site)
+	}
+	if c.counts[new_site] == nil {
+		c.counts[new_site] = make(map[string]int64)
+	}
+	c.counts[new_site][new_label] = count
+	c.dirty = true
+}
+
+// Read the counts saved in fs, replacing those in memory.
+func (c *Counter) Load(fs *fileStore.FileStore) error {
+	data, err := fs.Load(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	saved := make(map[string]int64)
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]map[string]int64)
+	for k, count := range saved {
+		parts := strings.SplitN(k, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if counts[parts[0]] == nil {
+			counts[parts[0]] = make(map[string]int64)
+		}
+		counts[parts[0]][parts[1]] = count
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts = counts
+	c.dirty = false
+	return nil
+}
+
+// Save the counts to fs if they changed since they were last saved.
+func (c *Counter) Flush(fs *fileStore.FileStore) error {
+	c.mutex.Lock()
+	if !c.dirty {
+		c.mutex.Unlock()
+		return nil
+	}
+	saved := make(map[string]int64)
+	for site, counts := range c.counts {
+		for label, count := range counts {
+			saved[key(site, label)] = count
+		}
+	}
+	data, err := json.Marshal(saved)
+	c.dirty = false
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tx := fs.Begin()
+	tx.Write(fileName, data)
+	err = tx.Commit()
+	if err != nil {
+		c.mutex.Lock()
+		c.dirty = true
+		c.mutex.Unlock()
+	}
+	return err
+}
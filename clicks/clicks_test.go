@@ -0,0 +1,62 @@
+package clicks
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"../fileStore"
+)
+
+// Test:
+//	that counts survive being flushed and loaded again
+func TestFlushAndLoad(t *testing.T) {
+	directory, err := ioutil.TempDir("", "clicks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(directory + "/")
+
+	counter := NewCounter()
+	if err = counter.Load(&fs); err != nil {
+		t.Fatal(err)
+	}
+	counter.Add("foo", "web")
+	counter.Add("foo", "web")
+	counter.Add("bar", "web")
+	if err = counter.Flush(&fs); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewCounter()
+	if err = loaded.Load(&fs); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Count("foo", "web") != 2 || loaded.Count("bar", "web") != 1 || loaded.Count("foo", "db") != 0 {
+		t.Error("Unexpected counts: ", loaded.counts)
+	}
+
+}
+
+// Test:
+//	that counts follow renamed sites and moved access points
+//	that only the counts of access points that are gone are dropped
+func TestRenameMoveAndRetain(t *testing.T) {
+	counter := NewCounter()
+	counter.Add("foo", "web")
+	counter.Add("foo", "db")
+	counter.Add("bar", "web")
+
+	counter.Rename("foo", "baz")
+	counter.Move("baz", "db", "bar", "sql")
+	if counter.Count("baz", "web") != 1 || counter.Count("bar", "sql") != 1 || counter.Count("foo", "web") != 0 || counter.Count("baz", "db") != 0 {
+		t.Error("Unexpected counts after rename and move: ", counter.counts)
+	}
+
+	counter.Retain("bar", []string{"sql"})
+	counter.Retain("baz", nil)
+	if counter.Count("bar", "sql") != 1 || counter.Count("bar", "web") != 0 || len(counter.counts) != 1 {
+		t.Error("Unexpected counts after retaining: ", counter.counts)
+	}
+}
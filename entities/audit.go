@@ -0,0 +1,104 @@
+package entities
+
+import (
+	"sort"
+	"time"
+	"../urls"
+)
+
+// When and by whom a site or access point was created and last changed.
+// These fields are kept by the server; values sent by clients are
+// replaced by Stamp.
+type Audit struct {
+	CreatedAt *time.Time `json:",omitempty"`
+	CreatedBy string `json:",omitempty"`
+	UpdatedAt *time.Time `json:",omitempty"`
+	UpdatedBy string `json:",omitempty"`
+}
+
+func newAudit(actor string, now time.Time) Audit {
+	return Audit{CreatedAt: &now, CreatedBy: actor, UpdatedAt: &now, UpdatedBy: actor}
+}
+
+// True if the item changed at or after since. Items stored before audit
+// fields were kept have no UpdatedAt and never match.
+func (a *Audit) UpdatedSince(since time.Time) (bool) {
+	return a.UpdatedAt != nil && !a.UpdatedAt.Before(since)
+}
+
+// Prepare a site replacing old, or a new site if old is nil, to be written.
+// Access points are matched to old ones by label and keep their priority
+// and state unless given; the others go last. Urls are made canonical and
+// audit fields are carried over from old, updated where content changed.
+func (s *Site) Stamp(old *Site, actor string, now time.Time) {
+	old_aps := make(map[string]AccessPoint)
+	if old != nil {
+		for _, ap := range old.Access_points {
+			old_aps[ap.Label] = ap
+		}
+	}
+
+	// Copy the access points so that old is never changed through them.
+	aps := make([]AccessPoint, len(s.Access_points))
+	last := 0
+	for _, ap := range s.Access_points {
+		if old_ap, ok := old_aps[ap.Label]; ok && ap.Priority == 0 {
+			ap.Priority = old_ap.Priority
+		}
+		if ap.Priority > last {
+			last = ap.Priority
+		}
+	}
+	for i, ap := range s.Access_points {
+		old_ap, ok := old_aps[ap.Label]
+		if ok && ap.Priority == 0 {
+			ap.Priority = old_ap.Priority
+		}
+		if ap.Priority == 0 {
+			last++
+			ap.Priority = last
+		}
+		if ok && ap.Enabled == nil {
+			ap.Enabled = old_ap.Enabled
+		}
+		ap.Clicks = 0
+		given := ap.Url
+		ap.Url = urls.Canonical(given)
+		switch {
+		case given != ap.Url:
+			ap.OriginalUrl = given
+		case ok && ap.Url == old_ap.Url:
+			// Unchanged, keep the Url it was first given as.
+			ap.OriginalUrl = old_ap.OriginalUrl
+		case ap.OriginalUrl != "" && urls.Canonical(ap.OriginalUrl) == ap.Url:
+			// Moved or copied along with the Url it was first given as.
+		default:
+			ap.OriginalUrl = ""
+		}
+
+		if !ok {
+			ap.Audit = newAudit(actor, now)
+		} else if ap.Audit = old_ap.Audit; !ap.EqualTo(&old_ap) {
+			ap.UpdatedAt = &now
+			ap.UpdatedBy = actor
+		}
+		aps[i] = ap
+	}
+	// Equal priorities keep their order, so ordering is stable.
+	sort.SliceStable(aps, func(i, j int) bool {
+		return aps[i].Priority < aps[j].Priority
+	})
+	if s.Access_points != nil {
+		s.Access_points = aps
+	}
+
+	if old == nil {
+		s.Audit = newAudit(actor, now)
+		return
+	}
+	s.Audit = old.Audit
+	if !s.EqualTo(old, false) {
+		s.UpdatedAt = &now
+		s.UpdatedBy = actor
+	}
+}
@@ -0,0 +1,33 @@
+package entities
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStampOrdersAccessPoints(t *testing.T) {
+	old := Site{Name: "site", Access_points: []AccessPoint{{Label: "a", Priority: 2}, {Label: "b", Priority: 1}}}
+	site := Site{Name: "site", Access_points: []AccessPoint{{Label: "new"}, {Label: "a"}, {Label: "b"}, {Label: "first", Priority: 1}}}
+	site.Stamp(&old, "tester", time.Now())
+
+	expected := []struct {
+		label string
+		priority int
+	}{{"b", 1}, {"first", 1}, {"a", 2}, {"new", 3}}
+	for i, e := range expected {
+		ap := site.Access_points[i]
+		if ap.Label != e.label || ap.Priority != e.priority {
+			t.Error("Position ", i, " is ", ap.Label, " with priority ", ap.Priority, ", expected ", e.label, " with ", e.priority)
+		}
+	}
+}
+
+func TestStampKeepsEnabled(t *testing.T) {
+	disabled := false
+	old := Site{Name: "site", Access_points: []AccessPoint{{Label: "a", Enabled: &disabled}, {Label: "b"}}}
+	site := Site{Name: "site", Access_points: []AccessPoint{{Label: "a"}, {Label: "b"}, {Label: "c"}}}
+	site.Stamp(&old, "tester", time.Now())
+	if site.Access_points[0].IsEnabled() || !site.Access_points[1].IsEnabled() || !site.Access_points[2].IsEnabled() {
+		t.Error("Enabled state was not kept: ", site.Access_points)
+	}
+}
@@ -3,7 +3,7 @@ package entities
 import (
 	"encoding/json"
 	"regexp"
-	"errors"
+	"time"
 )
 
 type Site struct {
@@ -11,33 +11,121 @@ type Site struct {
 	Role string
 	Uri string
 	Access_points []AccessPoint
+	Tags []string `json:",omitempty"`
+	Labels map[string]string `json:",omitempty"`
+	// Name of the site above this one. A site inherits the role and labels
+	// of its ancestors that it does not set itself.
+	Parent string `json:",omitempty"`
+	// When the site is removed, see Expired.
+	ExpiresAt *time.Time `json:",omitempty"`
+	// Set while the site is in maintenance, see InMaintenance. Only
+	// changed through the maintenance endpoints.
+	Maintenance *Maintenance `json:",omitempty"`
+	Audit
+}
+
+type Maintenance struct {
+	Reason string
+	// Maintenance ends by itself at Until, if set.
+	Until *time.Time `json:",omitempty"`
+	StartedAt *time.Time `json:",omitempty"`
+	StartedBy string `json:",omitempty"`
 }
 
 type AccessPoint struct {
 	Label string
+	// Kept in canonical form, see Stamp.
 	Url string
+	// The Url as given, if that was not canonical.
+	OriginalUrl string `json:",omitempty"`
+	// Times opened through its short link. Counted separately and filled
+	// in when access points are read, never stored with the site.
+	Clicks int64 `json:",omitempty"`
+	// Share of resolutions with the weighted strategy, 1 if not set. At
+	// most MaxWeight.
+	Weight int `json:",omitempty"`
+	// Access points are kept in ascending order of priority. New access
+	// points without one go last, see Stamp.
+	Priority int `json:",omitempty"`
+	// Disabled access points are left out of listings and resolution. Not
+	// set means enabled, or the state it had before, see Stamp.
+	Enabled *bool `json:",omitempty"`
+	Tags []string `json:",omitempty"`
+	Labels map[string]string `json:",omitempty"`
+	// When the access point is removed, see Expired.
+	ExpiresAt *time.Time `json:",omitempty"`
+	Audit
 }
 
 type ErrorResponse struct {
 	Error string
+	Violations []Violation `json:",omitempty"`
 }
 
 type SuccessResponse struct {
 	Success string
 }
 
+type RenameRequest struct {
+	NewName string
+	// Leave an alias so requests using the old name are redirected.
+	Redirect bool
+}
+
+// The labels of every access point of a site, in their new order.
+type ReorderRequest struct {
+	Labels []string
+}
+
+// Target of an access point move or copy.
+type TransferRequest struct {
+	Site string
+	// New label on the target site, defaults to the current label.
+	Label string
+}
+
+type HealthResponse struct {
+	Status string
+	Checks map[string]string `json:",omitempty"`
+}
+
+type DebugInfo struct {
+	Version string
+	Uptime string
+	Config map[string]string
+	Storage StorageStats
+}
+
+type StorageStats struct {
+	Files int
+	Bytes int64
+	Layout string
+	// Set once the store has been asked to move to the sharded layout.
+	Reshard *ReshardStatus `json:",omitempty"`
+}
+
+type ReshardStatus struct {
+	Moved int
+	Total int
+	Done bool
+	Error string `json:",omitempty"`
+}
+
 func (s *Site) EqualTo(s2 *Site, ignore_access_points bool) (bool) {
 	if ignore_access_points {
 		var emptyAP = []AccessPoint{}
 		s.Access_points = emptyAP
 		s2.Access_points = emptyAP
 	}
-	s_json, err := s.ToJson()
+	// Audit fields are not part of a site's content.
+	s_content := s.withoutAudit()
+	s_json, err := s_content.ToJson()
 	if err != nil {
 		return false
 	}
 
-	s2_json, err2 := s2.ToJson()
+	s2_content := s2.withoutAudit()
+	s2_json, err2 := s2_content.ToJson()
 	if err2 != nil {
 		return false
 	}
@@ -46,12 +134,14 @@ func (s *Site) EqualTo(s2 *Site, ignore_access_points bool) (bool) {
 }
 
 func (ap *AccessPoint) EqualTo(ap2 *AccessPoint) (bool) {
-	ap_json, err := ap.ToJson()
+	ap_content, ap2_content := *ap, *ap2
+	ap_content.Audit, ap2_content.Audit = Audit{}, Audit{}
+	ap_json, err := ap_content.ToJson()
 	if err != nil {
 		return false
 	}
 
-	ap2_json, err2 := ap2.ToJson()
+	ap2_json, err2 := ap2_content.ToJson()
 	if err2 != nil {
 		return false
 	}
@@ -59,21 +149,41 @@ func (ap *AccessPoint) EqualTo(ap2 *AccessPoint) (bool) {
 	return string(ap_json) == string(ap2_json)
 }
 
-func (s *Site) Validate() (error) {
-	isAlpha := regexp.MustCompile(`^[a-z]+$`).MatchString
-	if !isAlpha(s.Name) {
-		return errors.New("Site name can only contain lowercase letters")
-	}
-
-	apLabels := make(map[string]int)
-	for _, ap := range s.Access_points {
-		if apLabels[ap.Label] == 1 {
-			return errors.New("Access Point labels must be unique")
-		} else {
-			apLabels[ap.Label] = 1
+func (s *Site) withoutAudit() Site {
+	content := *s
+	content.Audit = Audit{}
+	if s.Access_points != nil {
+		content.Access_points = make([]AccessPoint, len(s.Access_points))
+		for i, ap := range s.Access_points {
+			ap.Audit = Audit{}
+			content.Access_points[i] = ap
 		}
 	}
-	return nil
+	return content
+}
+
+// Expired items are removed by the server in the background, so they can
+// still be read for a short while after ExpiresAt.
+func (s *Site) Expired(now time.Time) (bool) {
+	return s.ExpiresAt != nil && !s.ExpiresAt.After(now)
+}
+
+func (ap *AccessPoint) Expired(now time.Time) (bool) {
+	return ap.ExpiresAt != nil && !ap.ExpiresAt.After(now)
+}
+
+func (s *Site) InMaintenance(now time.Time) (bool) {
+	return s.Maintenance != nil && (s.Maintenance.Until == nil || s.Maintenance.Until.After(now))
+}
+
+func (ap *AccessPoint) IsEnabled() (bool) {
+	return ap.Enabled == nil || *ap.Enabled
+}
+
+var isAlpha = regexp.MustCompile(`^[a-z]+$`).MatchString
+
+func ValidSiteName(name string) (bool) {
+	return isAlpha(name)
 }
 
 func (s *Site) ToJson() ([]byte, error) {
@@ -0,0 +1,85 @@
+package entities
+
+import (
+	"errors"
+)
+
+// A named set of sites that need not be related: those listed in Sites,
+// and those matching Selector and Roles if either is given.
+type Group struct {
+	Name string
+	// Members by name, whether or not they match.
+	Sites []string `json:",omitempty"`
+	// Sites whose labels match, see ParseSelector.
+	Selector string `json:",omitempty"`
+	// Sites with one of these roles.
+	Roles []string `json:",omitempty"`
+}
+
+// An access point listed with the site it belongs to.
+type SiteAccessPoint struct {
+	Site string
+	AccessPoint
+}
+
+func (g *Group) Validate() (error) {
+	if !ValidSiteName(g.Name) {
+		return errors.New("Group name can only contain lowercase letters")
+	}
+	for _, site_name := range g.Sites {
+		if !ValidSiteName(site_name) {
+			return errors.New("Group member " + site_name + " is not a valid site name")
+		}
+	}
+	_, err := ParseSelector(g.Selector)
+	return err
+}
+
+// Whether site is in the group.
+func (g *Group) Contains(site *Site) (bool) {
+	for _, site_name := range g.Sites {
+		if site_name == site.Name {
+			return true
+		}
+	}
+	if g.Selector == "" && len(g.Roles) == 0 {
+		return false
+	}
+	if len(g.Roles) > 0 {
+		found := false
+		for _, role := range g.Roles {
+			found = found || role == site.Role
+		}
+		if !found {
+			return false
+		}
+	}
+	selector, err := ParseSelector(g.Selector)
+	return err == nil && selector.Matches(site.Labels)
+}
+
+// Replace the member old_name with new_name, returning whether it was
+// listed.
+func (g *Group) RenameMember(old_name string, new_name string) (bool) {
+	renamed := false
+	for i, site_name := range g.Sites {
+		if site_name == old_name {
+			g.Sites[i] = new_name
+			renamed = true
+		}
+	}
+	return renamed
+}
+
+// Remove the member name, returning whether it was listed.
+func (g *Group) RemoveMember(name string) (bool) {
+	var sites []string
+	for _, site_name := range g.Sites {
+		if site_name != name {
+			sites = append(sites, site_name)
+		}
+	}
+	removed := len(sites) != len(g.Sites)
+	g.Sites = sites
+	return removed
+}
@@ -0,0 +1,40 @@
+package entities
+
+import (
+	"testing"
+)
+
+func TestGroupContains(t *testing.T) {
+	group := Group{Name: "group", Sites: []string{"listed"}, Selector: "env=prod", Roles: []string{"web", "api"}}
+	cases := []struct {
+		site Site
+		contains bool
+	}{
+		{Site{Name: "listed", Role: "db"}, true},
+		{Site{Name: "web", Role: "web", Labels: map[string]string{"env": "prod"}}, true},
+		{Site{Name: "dev", Role: "web", Labels: map[string]string{"env": "dev"}}, false},
+		{Site{Name: "db", Role: "db", Labels: map[string]string{"env": "prod"}}, false},
+	}
+	for _, c := range cases {
+		if group.Contains(&c.site) != c.contains {
+			t.Error("Contains(", c.site.Name, ") is not ", c.contains)
+		}
+	}
+	static := Group{Name: "static", Sites: []string{"listed"}}
+	if static.Contains(&Site{Name: "other"}) {
+		t.Error("Group without selector or roles contains unlisted site")
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	group := Group{Name: "group", Sites: []string{"foo", "bar"}}
+	if !group.RenameMember("foo", "baz") || group.RenameMember("foo", "qux") {
+		t.Error("Unexpected result renaming members")
+	}
+	if !group.RemoveMember("baz") || group.RemoveMember("baz") {
+		t.Error("Unexpected result removing members")
+	}
+	if len(group.Sites) != 1 || group.Sites[0] != "bar" {
+		t.Error("Unexpected members: ", group.Sites)
+	}
+}
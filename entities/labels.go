@@ -0,0 +1,203 @@
+package entities
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Limits on the free-form metadata of sites and access points. Keys follow
+// the Kubernetes label format: an optional DNS subdomain prefix and a "/",
+// then a name of up to 63 characters.
+const MaxTags = 64
+const MaxLabels = 64
+const MaxNameLength = 63
+const MaxPrefixLength = 253
+
+var labelName = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+var labelPrefix = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+func ValidateMetadata(tags []string, labels map[string]string) (error) {
+	if len(tags) > MaxTags {
+		return errors.New("At most " + strconv.Itoa(MaxTags) + " tags are allowed")
+	}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if !validName(tag) {
+			return errors.New("Invalid tag: " + strconv.Quote(tag))
+		}
+		if seen[tag] {
+			return errors.New("Duplicate tag: " + strconv.Quote(tag))
+		}
+		seen[tag] = true
+	}
+
+	if len(labels) > MaxLabels {
+		return errors.New("At most " + strconv.Itoa(MaxLabels) + " labels are allowed")
+	}
+	for key, value := range labels {
+		err := validateLabelKey(key)
+		if err != nil {
+			return err
+		}
+		if value != "" && !validName(value) {
+			return errors.New("Invalid value for label " + key + ": " + strconv.Quote(value))
+		}
+	}
+	return nil
+}
+
+func validName(name string) (bool) {
+	return len(name) <= MaxNameLength && labelName.MatchString(name)
+}
+
+func validateLabelKey(key string) (error) {
+	name := key
+	if slash := strings.Index(key, "/"); slash >= 0 {
+		prefix := key[:slash]
+		name = key[slash + 1:]
+		if len(prefix) > MaxPrefixLength || !labelPrefix.MatchString(prefix) {
+			return errors.New("Invalid label key prefix: " + strconv.Quote(key))
+		}
+	}
+	if !validName(name) {
+		return errors.New("Invalid label key: " + strconv.Quote(key))
+	}
+	return nil
+}
+
+// One requirement of a label selector, such as env=prod or tier!=edge.
+type requirement struct {
+	key string
+	operator string
+	values []string
+}
+
+// A parsed label selector: a comma separated list of requirements that
+// must all hold. Supported forms are key=value, key==value, key!=value,
+// key in (a,b), key notin (a,b), key (exists) and !key (does not exist).
+type Selector []requirement
+
+func ParseSelector(selector string) (Selector, error) {
+	var parsed Selector
+	for _, part := range splitSelector(selector) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		req, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, req)
+	}
+	return parsed, nil
+}
+
+func (sel Selector) Matches(labels map[string]string) (bool) {
+	for _, req := range sel {
+		value, exists := labels[req.key]
+		switch req.operator {
+		case "exists":
+			if !exists {
+				return false
+			}
+		case "!exists":
+			if exists {
+				return false
+			}
+		case "in":
+			if !exists || !contains(req.values, value) {
+				return false
+			}
+		case "notin":
+			if exists && contains(req.values, value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Split on commas that are not inside parentheses.
+func splitSelector(selector string) []string {
+	var parts []string
+	depth := 0
+	start := 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, selector[start:])
+}
+
+func parseRequirement(part string) (requirement, error) {
+	invalid := errors.New("Invalid selector: " + strconv.Quote(part))
+	var req requirement
+
+	switch {
+	case strings.HasPrefix(part, "!"):
+		req = requirement{strings.TrimSpace(part[1:]), "!exists", nil}
+	case strings.Contains(part, "!="):
+		pieces := strings.SplitN(part, "!=", 2)
+		req = requirement{strings.TrimSpace(pieces[0]), "notin", []string{strings.TrimSpace(pieces[1])}}
+	case strings.Contains(part, "="):
+		pieces := strings.SplitN(strings.Replace(part, "==", "=", 1), "=", 2)
+		req = requirement{strings.TrimSpace(pieces[0]), "in", []string{strings.TrimSpace(pieces[1])}}
+	case strings.HasSuffix(part, ")"):
+		open := strings.Index(part, "(")
+		if open < 0 {
+			return req, invalid
+		}
+		fields := strings.Fields(part[:open])
+		if len(fields) != 2 || (fields[1] != "in" && fields[1] != "notin") {
+			return req, invalid
+		}
+		var values []string
+		for _, value := range strings.Split(part[open + 1:len(part) - 1], ",") {
+			values = append(values, strings.TrimSpace(value))
+		}
+		req = requirement{fields[0], fields[1], values}
+	default:
+		req = requirement{part, "exists", nil}
+	}
+
+	if validateLabelKey(req.key) != nil {
+		return req, invalid
+	}
+	for _, value := range req.values {
+		if value != "" && !validName(value) {
+			return req, invalid
+		}
+	}
+	return req, nil
+}
+
+func contains(values []string, value string) (bool) {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// True if tags holds every one of wanted.
+func HasTags(tags []string, wanted []string) (bool) {
+	for _, tag := range wanted {
+		if !contains(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package entities
+
+import (
+	"testing"
+)
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{"env": "prod", "tier": "web", "example.com/team": "core"}
+	cases := []struct {
+		selector string
+		matches bool
+	}{
+		{"", true},
+		{"env=prod", true},
+		{"env==prod,tier!=edge", true},
+		{"env=dev", false},
+		{"tier in (web, api)", true},
+		{"tier notin (web,api),env=prod", false},
+		{"example.com/team", true},
+		{"!owner", true},
+		{"!env", false},
+		{"owner!=bob", true},
+	}
+	for _, c := range cases {
+		selector, err := ParseSelector(c.selector)
+		if err != nil {
+			t.Error(c.selector, err)
+			continue
+		}
+		if selector.Matches(labels) != c.matches {
+			t.Error(c.selector, "should match:", c.matches)
+		}
+	}
+
+	for _, invalid := range []string{"tier in web", "bad key=x", "env=a b"} {
+		_, err := ParseSelector(invalid)
+		if err == nil {
+			t.Error("Expected invalid selector:", invalid)
+		}
+	}
+}
+
+func TestValidateMetadata(t *testing.T) {
+	if err := ValidateMetadata([]string{"a", "b"}, map[string]string{"example.com/name": "value", "plain": ""}); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateMetadata([]string{"a", "a"}, nil); err == nil {
+		t.Error("Expected duplicate tag error")
+	}
+	if err := ValidateMetadata(nil, map[string]string{"Bad_Prefix/x": "y"}); err == nil {
+		t.Error("Expected invalid prefix error")
+	}
+}
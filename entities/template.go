@@ -0,0 +1,101 @@
+package entities
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A Site with {{variable}} placeholders in Role, Uri and access point
+// Urls, filled in when the template is instantiated.
+type Template struct {
+	Name string
+	Role string
+	Uri string
+	Access_points []AccessPoint
+	Tags []string `json:",omitempty"`
+	Labels map[string]string `json:",omitempty"`
+}
+
+type InstantiateRequest struct {
+	Name string
+	Variables map[string]string
+}
+
+type CloneRequest struct {
+	Name string
+}
+
+var placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// Names of the variables used by the template, sorted.
+func (t *Template) Variables() []string {
+	found := make(map[string]bool)
+	fields := []string{t.Role, t.Uri}
+	for _, ap := range t.Access_points {
+		fields = append(fields, ap.Url)
+	}
+	for _, field := range fields {
+		for _, match := range placeholder.FindAllStringSubmatch(field, -1) {
+			found[match[1]] = true
+		}
+	}
+
+	var variables []string
+	for variable := range found {
+		variables = append(variables, variable)
+	}
+	sort.Strings(variables)
+	return variables
+}
+
+func (t *Template) Validate() (error) {
+	if !ValidSiteName(t.Name) {
+		return errors.New("Template name can only contain lowercase letters")
+	}
+	// Configured rules are checked on the sites made from a template, the
+	// template itself still holds placeholders.
+	site := Site{Name: t.Name, Role: t.Role, Uri: t.Uri, Access_points: t.Access_points, Tags: t.Tags, Labels: t.Labels}
+	if violations := site.violations(); len(violations) > 0 {
+		return &ValidationError{violations}
+	}
+	return nil
+}
+
+// Build a site called name, filling in every placeholder from variables.
+func (t *Template) Instantiate(name string, variables map[string]string) (Site, error) {
+	var missing []string
+	for _, variable := range t.Variables() {
+		if _, ok := variables[variable]; !ok {
+			missing = append(missing, variable)
+		}
+	}
+	if len(missing) > 0 {
+		return Site{}, errors.New("Missing template variables: " + strings.Join(missing, ", "))
+	}
+
+	fill := func(field string) string {
+		return placeholder.ReplaceAllStringFunc(field, func(match string) string {
+			return variables[placeholder.FindStringSubmatch(match)[1]]
+		})
+	}
+	site := Site{Name: name, Role: fill(t.Role), Uri: fill(t.Uri), Access_points: []AccessPoint{}, Tags: t.Tags, Labels: t.Labels}
+	for _, ap := range t.Access_points {
+		ap.Url = fill(ap.Url)
+		site.Access_points = append(site.Access_points, ap)
+	}
+	return site, nil
+}
+
+func (t *Template) ToJson() ([]byte, error) {
+	json, err := json.Marshal(t)
+	return json, err
+}
+
+func TemplateFromJson(json_data []byte) (Template, error) {
+	var template Template
+	err := json.Unmarshal(json_data, &template)
+	return template, err
+}
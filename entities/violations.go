@@ -0,0 +1,113 @@
+package entities
+
+import (
+	"strconv"
+	"strings"
+)
+
+// One way in which a site breaks a validation rule. Field names the site
+// field, or access point field as in Access_points[0].Url.
+type Violation struct {
+	Field string
+	Message string
+}
+
+// Every rule a site breaks, reported together.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	var messages []string
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Largest access point Weight, so that the weights of a site can be summed
+// without overflowing.
+const MaxWeight = 1000000
+
+// Checks made by Validate on top of the built in ones. Set from the
+// configured validation rules at startup.
+var Rules func(site *Site) []Violation
+
+// Checks of sites against every other site, made where every site is
+// loaded rather than by Validate. Given every site, returns the check, or
+// nil if there is none. Set from the configured validation rules at startup.
+var SitesRules func(sites []Site) func(site *Site) []Violation
+
+// The check of SitesRules against sites, which finds nothing if there is
+// none. sites should be every site as the store will be once the checked
+// sites are written.
+func AgainstSites(sites []Site) func(site *Site) []Violation {
+	if SitesRules != nil {
+		if check := SitesRules(sites); check != nil {
+			return check
+		}
+	}
+	return func(site *Site) []Violation {
+		return nil
+	}
+}
+
+func (s *Site) Validate() (error) {
+	violations := s.violations()
+	if Rules != nil {
+		violations = append(violations, Rules(s)...)
+	}
+	if len(violations) > 0 {
+		return &ValidationError{violations}
+	}
+	return nil
+}
+
+// Field name of access point i of a site.
+func APField(i int, field string) string {
+	return "Access_points[" + strconv.Itoa(i) + "]." + field
+}
+
+// The checks every site must pass, whatever rules are configured.
+func (s *Site) violations() []Violation {
+	var violations []Violation
+	if !ValidSiteName(s.Name) {
+		violations = append(violations, Violation{"Name", "Site name can only contain lowercase letters"})
+	}
+	if err := ValidateMetadata(s.Tags, nil); err != nil {
+		violations = append(violations, Violation{"Tags", err.Error()})
+	}
+	if err := ValidateMetadata(nil, s.Labels); err != nil {
+		violations = append(violations, Violation{"Labels", err.Error()})
+	}
+	if s.Parent != "" && !ValidSiteName(s.Parent) {
+		violations = append(violations, Violation{"Parent", "Parent site name can only contain lowercase letters"})
+	}
+	if s.Maintenance != nil && s.Maintenance.Reason == "" {
+		violations = append(violations, Violation{"Maintenance.Reason", "Maintenance needs a reason"})
+	}
+
+	apLabels := make(map[string]int)
+	for i, ap := range s.Access_points {
+		if apLabels[ap.Label] == 1 {
+			violations = append(violations, Violation{APField(i, "Label"), "Access Point labels must be unique"})
+		} else {
+			apLabels[ap.Label] = 1
+		}
+		if ap.Priority < 0 {
+			violations = append(violations, Violation{APField(i, "Priority"), "Access Point priority can not be negative"})
+		}
+		if ap.Weight < 0 {
+			violations = append(violations, Violation{APField(i, "Weight"), "Access Point weight can not be negative"})
+		} else if ap.Weight > MaxWeight {
+			violations = append(violations, Violation{APField(i, "Weight"), "Access Point weight can be at most " + strconv.Itoa(MaxWeight)})
+		}
+		if err := ValidateMetadata(ap.Tags, nil); err != nil {
+			violations = append(violations, Violation{APField(i, "Tags"), "Access Point " + ap.Label + ": " + err.Error()})
+		}
+		if err := ValidateMetadata(nil, ap.Labels); err != nil {
+			violations = append(violations, Violation{APField(i, "Labels"), "Access Point " + ap.Label + ": " + err.Error()})
+		}
+	}
+	return violations
+}
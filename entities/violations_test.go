@@ -0,0 +1,34 @@
+package entities
+
+import (
+	"testing"
+)
+
+// Test:
+//	that sites are checked against the sites they are given
+//	that nothing is found without SitesRules
+func TestAgainstSites(t *testing.T) {
+	sites := []Site{{Name: "foo", Uri: "a"}, {Name: "bar", Uri: "a"}}
+	if violations := AgainstSites(sites)(&sites[0]); violations != nil {
+		t.Error("Unexpected violations: ", violations)
+	}
+	SitesRules = func(sites []Site) func(site *Site) []Violation {
+		return func(site *Site) []Violation {
+			var violations []Violation
+			for _, other := range sites {
+				if other.Name != site.Name && other.Uri == site.Uri {
+					violations = append(violations, Violation{Field: "Uri", Message: "used by " + other.Name})
+				}
+			}
+			return violations
+		}
+	}
+	defer func() { SitesRules = nil }()
+
+	if violations := AgainstSites(sites)(&sites[0]); len(violations) != 1 {
+		t.Error("Unexpected violations: ", violations)
+	}
+	if violations := AgainstSites(sites[:1])(&sites[0]); len(violations) != 0 {
+		t.Error("Site was checked against sites it was not given: ", violations)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * The purpose of this package is to know when sites and access points
+ * expire, so that they are removed on time without reading every site to
+ * look for them.
+ */
+
+package expiry
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"../entities"
+	"../schema"
+)
+
+// Where sites are read from.
+type Store interface {
+	GetFiles() ([]string, error)
+	Load(file_name string) ([]byte, error)
+}
+
+// When each site in a store or one of its access points next expires. It
+// is read from the store when first used, and kept up to date with Update
+// as sites are written and deleted.
+type Index struct {
+	store Store
+	mutex sync.Mutex
+	loaded bool
+	deadlines map[string]time.Time
+}
+
+func NewIndex(store Store) *Index {
+	return &Index{store: store}
+}
+
+// The earliest time site or one of its access points expires, false if
+// none of them do.
+func Deadline(site *entities.Site) (time.Time, bool) {
+	var deadline time.Time
+	if site.ExpiresAt != nil {
+		deadline = *site.ExpiresAt
+	}
+	for _, ap := range site.Access_points {
+		if ap.ExpiresAt != nil && (deadline.IsZero() || ap.ExpiresAt.Before(deadline)) {
+			deadline = *ap.ExpiresAt
+		}
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// Read every site, unless they have been read already. The mutex is held,
+// so changes passed to Update meanwhile are made after.
+func (index *Index) load() error {
+	if index.loaded {
+		return nil
+	}
+	file_names, err := index.store.GetFiles()
+	if err != nil {
+		return err
+	}
+	index.deadlines = make(map[string]time.Time)
+	for _, file_name := range file_names {
+		file_data, err := index.store.Load(file_name)
+		if err != nil {
+			return err
+		}
+		index.set(file_name, file_data)
+	}
+	index.loaded = true
+	return nil
+}
+
+func (index *Index) set(name string, file_data []byte) {
+	delete(index.deadlines, name)
+	// A site that can not be read is left for the requests that read it
+	// to report.
+	site, err := schema.DecodeSite(file_data)
+	if err != nil {
+		return
+	}
+	if deadline, ok := Deadline(&site); ok {
+		index.deadlines[name] = deadline
+	}
+}
+
+// Record sites written and deleted in the store. Hidden files are not
+// sites, and are left out as in GetFiles.
+func (index *Index) Update(written map[string][]byte, deleted []string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if !index.loaded {
+		return
+	}
+	for name, file_data := range written {
+		if !strings.HasPrefix(name, ".") {
+			index.set(name, file_data)
+		}
+	}
+	for _, name := range deleted {
+		delete(index.deadlines, name)
+	}
+}
+
+// Names of the sites that are expired, or have an expired access point,
+// at now, sorted.
+func (index *Index) Due(now time.Time) ([]string, error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	err := index.load()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name, deadline := range index.deadlines {
+		if !deadline.After(now) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// The first time after now that something expires, false if nothing does
+// or the sites have not been read yet.
+func (index *Index) Next(now time.Time) (time.Time, bool) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	var next time.Time
+	for _, deadline := range index.deadlines {
+		if deadline.After(now) && (next.IsZero() || deadline.Before(next)) {
+			next = deadline
+		}
+	}
+	return next, !next.IsZero()
+}
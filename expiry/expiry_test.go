@@ -0,0 +1,66 @@
+package expiry
+
+import (
+	"sort"
+	"testing"
+	"time"
+	"../entities"
+	"../schema"
+)
+
+type memoryStore map[string][]byte
+
+func (store memoryStore) GetFiles() ([]string, error) {
+	var names []string
+	for name := range store {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (store memoryStore) Load(file_name string) ([]byte, error) {
+	return store[file_name], nil
+}
+
+// Test:
+//	that sites with an expired site or access point are due
+//	that the next deadline is the earliest one still to come
+//	that updates are followed without reading the store again
+func TestIndex(t *testing.T) {
+	now := time.Now().UTC()
+	past, soon, later := now.Add(-time.Minute), now.Add(time.Minute), now.Add(time.Hour)
+	encode := func(site entities.Site) []byte {
+		data, _ := schema.EncodeSite(&site)
+		return data
+	}
+	store := memoryStore{
+		"expired": encode(entities.Site{Name: "expired", ExpiresAt: &past}),
+		"pruned": encode(entities.Site{Name: "pruned", ExpiresAt: &later, Access_points: []entities.AccessPoint{{Label: "web", ExpiresAt: &past}}}),
+		"later": encode(entities.Site{Name: "later", ExpiresAt: &later}),
+		"kept": encode(entities.Site{Name: "kept"}),
+	}
+	index := NewIndex(store)
+	if _, ok := index.Next(now); ok {
+		t.Error("Next deadline before the sites were read")
+	}
+	due, err := index.Due(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 || due[0] != "expired" || due[1] != "pruned" {
+		t.Error("Unexpected sites due: ", due)
+	}
+	if next, ok := index.Next(now); !ok || !next.Equal(later) {
+		t.Error("Unexpected next deadline: ", next)
+	}
+
+	delete(store, "expired")
+	index.Update(map[string][]byte{"kept": encode(entities.Site{Name: "kept", Access_points: []entities.AccessPoint{{Label: "web", ExpiresAt: &soon}}}), ".schedule": []byte("{}")}, []string{"pruned"})
+	if next, ok := index.Next(now); !ok || !next.Equal(soon) {
+		t.Error("Unexpected next deadline after update: ", next)
+	}
+	if due, _ = index.Due(soon); len(due) != 2 || due[0] != "expired" || due[1] != "kept" {
+		t.Error("Unexpected sites due after update: ", due)
+	}
+}
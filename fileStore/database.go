@@ -0,0 +1,199 @@
+package fileStore
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"../kvStore"
+)
+
+// Every file in a single database file, see the kvStore package, so that
+// commits are one write and listings read no directory. The stores of the
+// hidden subdirectories of the store directory are kept in it too, their
+// file names prefixed by the subdirectory.
+const Database = "database"
+
+// The database file of a store in the database layout.
+const databaseName = ".database"
+
+// Files of the store directory that are never moved into its database.
+var notMoved = map[string]bool{layoutName: true, indexName: true, databaseName: true, ".probe": true}
+
+// Open databases by path, so each is only opened once. Guarded by
+// statesMutex.
+var databases = make(map[string]*kvStore.DB)
+
+func openDatabase(path string) (*kvStore.DB, error) {
+	path = filepath.Clean(path)
+	if db, ok := databases[path]; ok {
+		return db, nil
+	}
+	db, err := kvStore.Open(path)
+	if err == nil {
+		databases[path] = db
+	}
+	return db, err
+}
+
+// If prefix is a hidden subdirectory of a store in the database layout,
+// the prefix of the store and of the subdirectory's file names in it.
+func databaseRoot(prefix string) (string, string, bool) {
+	directory := strings.TrimSuffix(prefix, "/")
+	name := filepath.Base(directory)
+	if !strings.HasPrefix(name, ".") || name == "." || name == ".." {
+		return "", "", false
+	}
+	root := filepath.Dir(directory) + "/"
+	data, err := ioutil.ReadFile(root + layoutName)
+	if err != nil || strings.TrimSpace(string(data)) != Database {
+		return "", "", false
+	}
+	return root, name + "/", true
+}
+
+// The database of a store in the database layout and the prefix of its
+// file names in it, or nil for other layouts.
+func (fs *FileStore) database() (*kvStore.DB, string, error) {
+	state := fs.state()
+	return state.db, state.key, state.dbErr
+}
+
+// Names of the files in the database, hidden files left out.
+func databaseFiles(db *kvStore.DB, key string) ([]string, error) {
+	keys, err := db.Keys(key)
+	var file_names []string
+	for _, key_name := range keys {
+		file_name := key_name[len(key):]
+		if !strings.HasPrefix(file_name, ".") && !strings.Contains(file_name, "/") {
+			file_names = append(file_names, file_name)
+		}
+	}
+	return file_names, err
+}
+
+// Move every file of a flat or sharded store into a database in one
+// transaction, those of its hidden subdirectories included, then switch it
+// to the database layout and remove the files. Run it while nothing else
+// uses the store.
+func (fs *FileStore) MoveToDatabase() error {
+	if fs.Layout() == Database {
+		return errors.New("Store is already a database")
+	}
+	err := fs.Recover()
+	if err != nil {
+		return err
+	}
+	// A database left by an interrupted move is out of date.
+	path := fs.prefix + databaseName
+	os.Remove(path)
+	db, err := kvStore.Open(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx := db.Begin()
+	var moved []string
+	var shards []string
+	files, err := ioutil.ReadDir(fs.prefix)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if notMoved[name] || strings.HasPrefix(name, ".tmp-") {
+			continue
+		}
+		if !file.IsDir() {
+			data, err := ioutil.ReadFile(fs.prefix + name)
+			if err != nil {
+				return err
+			}
+			tx.Write(name, data)
+			moved = append(moved, fs.prefix + name)
+			continue
+		}
+		// Files in shards are kept by their name alone, those in hidden
+		// subdirectories by their path. Other directories are not files.
+		key := ""
+		if strings.HasPrefix(name, ".") {
+			key = name + "/"
+		} else if strings.HasPrefix(name, shardPrefix) {
+			shards = append(shards, fs.prefix + name)
+		} else {
+			continue
+		}
+		subdirectory, err := ioutil.ReadDir(fs.prefix + name)
+		if err != nil {
+			return err
+		}
+		for _, sub_file := range subdirectory {
+			if sub_file.IsDir() || strings.HasPrefix(sub_file.Name(), ".tmp-") {
+				continue
+			}
+			sub_path := fs.prefix + name + "/" + sub_file.Name()
+			data, err := ioutil.ReadFile(sub_path)
+			if err != nil {
+				return err
+			}
+			tx.Write(key + sub_file.Name(), data)
+			moved = append(moved, sub_path)
+		}
+	}
+	err = tx.Commit()
+	if err == nil {
+		err = writeSynced(fs.prefix + layoutName, []byte(Database))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Every store is looked up again, now in the database.
+	statesMutex.Lock()
+	states = make(map[string]*storeState)
+	statesMutex.Unlock()
+	for _, moved_path := range moved {
+		os.Remove(moved_path)
+	}
+	for _, shard := range shards {
+		os.Remove(shard)
+	}
+	os.Remove(fs.prefix + indexName)
+	return nil
+}
+
+// Compact the database of a store in the database layout if most of it is
+// taken by old values. Run it while no other process uses the store.
+func (fs *FileStore) Compact() error {
+	db, _, err := fs.database()
+	if err != nil || db == nil {
+		return err
+	}
+	size, live, err := db.Usage()
+	if err != nil || size < 2 * live {
+		return err
+	}
+	return db.Compact()
+}
+
+// Write a copy of the database of a store in the database layout, as it is
+// at one moment, to w. Replacing the database file with it restores it.
+func (fs *FileStore) Snapshot(w io.Writer) error {
+	db, _, err := fs.database()
+	if err != nil {
+		return err
+	}
+	if db == nil {
+		return errors.New("Only a store in the database layout can be snapshot")
+	}
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	_, err = snapshot.WriteTo(w)
+	return err
+}
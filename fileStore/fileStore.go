@@ -7,62 +7,259 @@ package fileStore
 
 import (
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 type FileStore struct {
 	prefix string
+	// Operations are not passed to Observer.
+	unobserved bool
+}
+
+// Observer, if set, is called after every file system operation so that
+// callers can record latencies and errors.
+var Observer func(op string, duration time.Duration, err error)
+
+func (fs *FileStore) observe(op string, start time.Time, err error) {
+	if Observer != nil && !fs.unobserved {
+		Observer(op, time.Since(start), err)
+	}
+}
+
+// Changed, if set, is called after files are written or deleted, with the
+// prefix of their store, so that callers can keep indexes of what is
+// stored up to date.
+var Changed func(prefix string, written map[string][]byte, deleted []string)
+
+func (fs *FileStore) changed(written map[string][]byte, deleted []string) {
+	if Changed != nil {
+		Changed(fs.prefix, written, deleted)
+	}
+}
+
+// Keep the operations of this store from Observer, for reads made to
+// report on the store rather than to serve a request.
+func (fs *FileStore) SetObserved(observed bool) {
+	fs.unobserved = !observed
 }
 
 func (fs *FileStore) SetPrefix(prefix string) {
 	fs.prefix = prefix
 }
 
+// Where file_name is kept on disk.
+func (fs *FileStore) Path(file_name string) string {
+	return fs.path(file_name)
+}
+
+// Create the store directory if it does not exist yet.
+func (fs *FileStore) CreateDirectory() error {
+	return os.MkdirAll(fs.prefix, 0777)
+}
+
 func (fs *FileStore) Load(file_name string) ([]byte, error) {
-	file_data, err := ioutil.ReadFile(fs.prefix + file_name)
+	start := time.Now()
+	var file_data []byte
+	if db, key, err := fs.database(); db != nil || err != nil {
+		if err == nil {
+			file_data, err = db.Load(key + file_name)
+		}
+		fs.observe("load", start, err)
+		return file_data, err
+	}
+	var err error
+	for _, path := range fs.paths(file_name) {
+		file_data, err = ioutil.ReadFile(path)
+		if !os.IsNotExist(err) {
+			break
+		}
+	}
+	fs.observe("load", start, err)
 	return file_data, err
 }
 
 func (fs *FileStore) Write(file_name string, data []byte) error {
-	err := ioutil.WriteFile(fs.prefix + file_name, data, 0666)
+	start := time.Now()
+	if db, key, err := fs.database(); db != nil || err != nil {
+		if err == nil {
+			err = db.Write(key + file_name, data)
+		}
+		fs.observe("write", start, err)
+		if err == nil {
+			fs.changed(map[string][]byte{file_name: data}, nil)
+		}
+		return err
+	}
+	path := fs.path(file_name)
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err == nil {
+		err = ioutil.WriteFile(path, data, 0666)
+	}
+	fs.observe("write", start, err)
+	if err == nil {
+		fs.changed(map[string][]byte{file_name: data}, nil)
+	}
 	return err
 }
 
 func (fs *FileStore) Delete(file_name string) error {
-	return os.Remove(fs.prefix + file_name)
+	start := time.Now()
+	err := fs.remove(file_name)
+	fs.observe("delete", start, err)
+	if err == nil {
+		fs.changed(nil, []string{file_name})
+	}
+	return err
+}
+
+// Remove file_name from wherever it is, failing with a not exist error if
+// it is nowhere.
+func (fs *FileStore) remove(file_name string) error {
+	if db, key, err := fs.database(); db != nil || err != nil {
+		if err == nil {
+			err = db.Delete(key + file_name)
+		}
+		return err
+	}
+	removed := false
+	for _, path := range fs.paths(file_name) {
+		err := os.Remove(path)
+		if err == nil {
+			removed = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !removed {
+		return &os.PathError{Op: "remove", Path: fs.path(file_name), Err: os.ErrNotExist}
+	}
+	return nil
 }
 
 func (fs *FileStore) Exists(file_name string) (bool) {
-	if _, err := os.Stat(fs.prefix + file_name); os.IsNotExist(err) {
+	start := time.Now()
+	if db, key, err := fs.database(); db != nil || err != nil {
+		exists := false
+		if err == nil {
+			exists, err = db.Exists(key + file_name)
+		}
+		fs.observe("exists", start, err)
+		// A file that can not be read is not taken to exist, so that it is
+		// reported missing rather than loaded.
+		if err != nil {
+			log.Println("Could not check whether", file_name, "exists:", err)
+		}
+		return exists && err == nil
+	}
+	var err error
+	for _, path := range fs.paths(file_name) {
+		_, err = os.Stat(path)
+		if !os.IsNotExist(err) {
+			break
+		}
+	}
+	if os.IsNotExist(err) {
+		fs.observe("exists", start, nil)
 		return false
 	} else {
+		fs.observe("exists", start, err)
 		return true
 	}
 }
 
 func (fs *FileStore) GetFiles() ([]string, error) {
+	start := time.Now()
+	if db, key, err := fs.database(); db != nil || err != nil {
+		var file_names []string
+		if err == nil {
+			file_names, err = databaseFiles(db, key)
+		}
+		fs.observe("list", start, err)
+		return file_names, err
+	}
+	if state := fs.state(); fs.Layout() == Sharded {
+		file_names, err := fs.indexedNames(state)
+		fs.observe("list", start, err)
+		return file_names, err
+	}
 	files, err := ioutil.ReadDir(fs.prefix)
+	fs.observe("list", start, err)
 	var file_names []string
 	if err != nil {
 		return  file_names, nil
 	} else {
 		for _, file := range files {
+			// Hidden files are used internally and are never sites.
+			if strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
 			file_names = append(file_names, file.Name())
 		}
 		return file_names, nil
 	}
 }
 
+// Check that the store directory, or the database of a store in the
+// database layout, can be both read and written to.
+func (fs *FileStore) CheckAccess() error {
+	if _, err := ioutil.ReadDir(fs.prefix); err != nil {
+		return err
+	}
+	if db, key, err := fs.database(); err != nil {
+		return err
+	} else if db != nil {
+		// Appends a record, as any change does.
+		tx := db.Begin()
+		tx.Delete(key + ".probe")
+		return tx.Commit()
+	}
+	probe := fs.prefix + ".probe"
+	if err := ioutil.WriteFile(probe, []byte("ok"), 0666); err != nil {
+		return err
+	}
+	return os.Remove(probe)
+}
+
+// Return the number of stored files and their total size in bytes.
+func (fs *FileStore) Stats() (int, int64, error) {
+	file_names, err := fs.GetFiles()
+	if err != nil {
+		return 0, 0, err
+	}
+	count := 0
+	var total_bytes int64
+	db, key, _ := fs.database()
+	for _, file_name := range file_names {
+		if db != nil {
+			if size, ok, err := db.Size(key + file_name); err == nil && ok {
+				count++
+				total_bytes += int64(size)
+			}
+			continue
+		}
+		for _, path := range fs.paths(file_name) {
+			if file, err := os.Stat(path); err == nil && !file.IsDir() {
+				count++
+				total_bytes += file.Size()
+				break
+			}
+		}
+	}
+	return count, total_bytes, nil
+}
+
 func (fs *FileStore) RemoveTestFiles() (error) {
-	files, err := ioutil.ReadDir(fs.prefix)
+	file_names, err := fs.GetFiles()
 	if err != nil {
 		return  err
 	} else {
-		for _, file := range files {
-			file_name := file.Name()
+		for _, file_name := range file_names {
 			if strings.HasPrefix(file_name, "test") {
-				err = os.Remove(fs.prefix + file_name)
+				err = fs.remove(file_name)
 				if err != nil {
 					return err
 				}
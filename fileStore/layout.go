@@ -0,0 +1,332 @@
+package fileStore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"../kvStore"
+)
+
+// How files are laid out in the store directory. Hidden files are always
+// kept in the store directory itself.
+const (
+	// Every file in the store directory.
+	Flat = "flat"
+	// Each file in a subdirectory named by the hash of its name, so that
+	// no directory holds too many files. Files are listed from an index
+	// rather than by reading every subdirectory.
+	Sharded = "sharded"
+)
+
+// Starts the names of shard directories, so that they can not be taken for
+// files, whose names never start with it.
+const shardPrefix = "_"
+
+// Names the layout of a store. Stores without one are flat.
+const layoutName = ".layout"
+
+// The index of a sharded store, written on Close so that it need not be
+// rebuilt on the next start.
+const indexName = ".index"
+
+// The names in a directory of a sharded store, as of when it was last
+// modified. A directory is only read again once it has been modified since,
+// whichever process modified it.
+type shard struct {
+	Modified int64
+	Names []string
+}
+
+// Directories modified more recently than this are read again even if their
+// time has not changed, as it may not change for a change made just after.
+const racyInterval = 2 * time.Second
+
+// Layout and index of a store directory, shared by every FileStore with
+// the same prefix.
+type storeState struct {
+	mutex sync.Mutex
+	layout string
+	// Shards by directory name, "" for files not yet moved to one. Nil
+	// until loaded.
+	shards map[string]*shard
+	// Whether files of a sharded store may still be in the store directory,
+	// while it is resharded or after resharding was interrupted.
+	resharding bool
+	// The database of a store in the database layout, the prefix of its
+	// file names in it, and why it could not be opened.
+	db *kvStore.DB
+	key string
+	dbErr error
+}
+
+var statesMutex sync.Mutex
+var states = make(map[string]*storeState)
+
+func (fs *FileStore) state() *storeState {
+	statesMutex.Lock()
+	defer statesMutex.Unlock()
+	state, ok := states[fs.prefix]
+	if !ok {
+		state = &storeState{layout: Flat}
+		if data, err := ioutil.ReadFile(fs.prefix + layoutName); err == nil {
+			state.layout = strings.TrimSpace(string(data))
+		}
+		if state.layout == Database {
+			state.db, state.dbErr = openDatabase(fs.prefix + databaseName)
+		} else if root, key, ok := databaseRoot(fs.prefix); ok {
+			state.layout, state.key = Database, key
+			state.db, state.dbErr = openDatabase(root + databaseName)
+		}
+		states[fs.prefix] = state
+	}
+	return state
+}
+
+func (fs *FileStore) Layout() string {
+	state := fs.state()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.layout
+}
+
+// Where file_name is kept in a sharded store.
+func (fs *FileStore) shardPath(file_name string) string {
+	sum := sha256.Sum256([]byte(file_name))
+	return fs.prefix + shardPrefix + hex.EncodeToString(sum[:1]) + "/" + file_name
+}
+
+// Where file_name is read from and written to, the store directory for "".
+func (fs *FileStore) path(file_name string) string {
+	if file_name == "" || strings.HasPrefix(file_name, ".") || fs.Layout() != Sharded {
+		return fs.prefix + file_name
+	}
+	return fs.shardPath(file_name)
+}
+
+// Where file_name may be found: in a sharded store it may still be in the
+// store directory if the store is being resharded.
+func (fs *FileStore) paths(file_name string) []string {
+	path := fs.path(file_name)
+	flat := fs.prefix + file_name
+	if path == flat {
+		return []string{path}
+	}
+	state := fs.state()
+	state.mutex.Lock()
+	resharding := state.resharding
+	state.mutex.Unlock()
+	if info, err := os.Stat(flat); !resharding || err != nil || !info.Mode().IsRegular() {
+		return []string{path}
+	}
+	return []string{path, flat}
+}
+
+// Bring the index of a sharded store up to date, reading only the
+// directories modified since it was. Called with the state locked.
+func (fs *FileStore) refreshIndex(state *storeState) error {
+	if state.shards == nil {
+		state.shards = make(map[string]*shard)
+		if data, err := ioutil.ReadFile(fs.prefix + indexName); err == nil {
+			json.Unmarshal(data, &state.shards)
+		}
+	}
+	top, err := fs.refreshShard(state, "")
+	if err != nil {
+		return err
+	}
+	for _, directory := range top {
+		if _, err = fs.refreshShard(state, directory); err != nil {
+			return err
+		}
+	}
+	for directory := range state.shards {
+		found := directory == ""
+		for _, name := range top {
+			found = found || name == directory
+		}
+		if !found {
+			delete(state.shards, directory)
+		}
+	}
+	state.resharding = len(state.shards[""].Names) > 0
+	return nil
+}
+
+// Read directory again if it was modified, returning the shard directories
+// in it. The store directory itself is always read as it is small once
+// sharded.
+func (fs *FileStore) refreshShard(state *storeState, directory string) ([]string, error) {
+	path := fs.prefix + directory
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	cached, ok := state.shards[directory]
+	if ok && directory != "" && cached.Modified == info.ModTime().UnixNano() {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	updated := &shard{Modified: info.ModTime().UnixNano()}
+	if time.Since(info.ModTime()) < racyInterval {
+		updated.Modified = 0
+	}
+	var directories []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		if file.IsDir() {
+			if directory == "" && strings.HasPrefix(file.Name(), shardPrefix) {
+				directories = append(directories, file.Name())
+			}
+		} else if file.Mode().IsRegular() {
+			updated.Names = append(updated.Names, file.Name())
+		}
+	}
+	state.shards[directory] = updated
+	return directories, nil
+}
+
+// Load the index of a sharded store, or check that the database of one in
+// the database layout is open, so that the store is ready to use.
+func (fs *FileStore) Open() error {
+	if db, _, err := fs.database(); db != nil || err != nil {
+		if err == nil {
+			_, _, err = db.Usage()
+		}
+		return err
+	}
+	state := fs.state()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.layout != Sharded {
+		return nil
+	}
+	return fs.refreshIndex(state)
+}
+
+// Whether files of a sharded store are still in the store directory, while
+// it is resharded or after resharding was interrupted.
+func (fs *FileStore) Resharding() bool {
+	state := fs.state()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.layout == Sharded && fs.refreshIndex(state) == nil && state.resharding
+}
+
+// Names of the files in a sharded store, sorted.
+func (fs *FileStore) indexedNames(state *storeState) ([]string, error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if err := fs.refreshIndex(state); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, shard := range state.shards {
+		for _, name := range shard.Names {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Write the index of a sharded store to its file, so that the next start
+// only reads the directories modified since. Call once the store is no
+// longer changed.
+func (fs *FileStore) Close() error {
+	state := fs.state()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.shards == nil {
+		return nil
+	}
+	data, err := json.Marshal(state.shards)
+	if err != nil {
+		return err
+	}
+	return writeSynced(fs.prefix + indexName, data)
+}
+
+// Move a flat store to the sharded layout while it is in use. The layout
+// is switched first, so files are written to their shards from then on and
+// read from either place, then each file is moved under its lock. moved is
+// called after each file with the number moved so far and the total. Files
+// left in the store directory by an interrupted move are still read, see
+// Open, until Reshard is run again.
+func (fs *FileStore) Reshard(moved func(done int, total int)) error {
+	state := fs.state()
+	state.mutex.Lock()
+	var err error
+	switch state.layout {
+	case Flat:
+		err = writeSynced(fs.prefix + layoutName, []byte(Sharded))
+		if err == nil {
+			state.layout = Sharded
+			err = fs.refreshIndex(state)
+		}
+	case Sharded:
+		// An interrupted move is finished.
+		err = fs.refreshIndex(state)
+		if err == nil && !state.resharding {
+			err = errors.New("Only a flat store can be resharded")
+		}
+	default:
+		err = errors.New("Only a flat store can be resharded")
+	}
+	var names []string
+	if err == nil {
+		names = append(names, state.shards[""].Names...)
+	}
+	state.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(names)
+	for i, name := range names {
+		err := fs.moveToShard(name)
+		if err != nil {
+			return err
+		}
+		if moved != nil {
+			moved(i + 1, len(names))
+		}
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return fs.refreshIndex(state)
+}
+
+func (fs *FileStore) moveToShard(file_name string) error {
+	defer Lock(file_name)()
+	flat := fs.prefix + file_name
+	if _, err := os.Stat(flat); os.IsNotExist(err) {
+		return nil
+	}
+	shard := fs.shardPath(file_name)
+	if _, err := os.Stat(shard); err == nil {
+		// Written since the layout changed, the flat file is older.
+		return os.Remove(flat)
+	}
+	err := os.MkdirAll(filepath.Dir(shard), 0777)
+	if err != nil {
+		return err
+	}
+	return os.Rename(flat, shard)
+}
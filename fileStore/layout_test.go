@@ -0,0 +1,227 @@
+package fileStore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Forget what is known about the store at prefix, as after a restart.
+func restart(prefix string) {
+	statesMutex.Lock()
+	delete(states, prefix)
+	delete(states, prefix + ".groups/")
+	path := filepath.Clean(prefix + databaseName)
+	if db, ok := databases[path]; ok {
+		db.Close()
+		delete(databases, path)
+	}
+	statesMutex.Unlock()
+}
+
+// Test:
+//	that a flat store is moved to shards and stays readable while it is
+//	that listings come from the index, and see changes made outside it
+//	that the index is kept across a restart
+func TestReshard(t *testing.T) {
+	directory, err := ioutil.TempDir("", "fileStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	prefix := directory + "/"
+	defer restart(prefix)
+	fs := FileStore{}
+	fs.SetPrefix(prefix)
+
+	for _, name := range []string{"foo", "bar", "baz"} {
+		if err = fs.Write(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = fs.Reshard(nil); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Layout() != Sharded || fs.Reshard(nil) == nil {
+		t.Error("Store was not sharded")
+	}
+	if _, err = os.Stat(prefix + "foo"); !os.IsNotExist(err) {
+		t.Error("foo was not moved")
+	}
+	if data, err := ioutil.ReadFile(fs.shardPath("foo")); err != nil || string(data) != "foo" {
+		t.Error("foo is not in its shard: ", err)
+	}
+
+	// Names of shard directories are not taken for files.
+	shard_name := strings.TrimPrefix(filepath.Base(filepath.Dir(fs.shardPath("foo"))), shardPrefix)
+	if fs.Exists(shard_name) {
+		t.Error("Shard directory was taken for ", shard_name)
+	}
+
+	// Files left in the store directory by an interrupted move are only
+	// found once it is opened again, until they are moved.
+	for _, name := range []string{"old", "older"} {
+		if err = ioutil.WriteFile(prefix + name, []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fs.Exists("old") {
+		t.Error("Flat file was found after resharding")
+	}
+	restart(prefix)
+	if err = fs.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.Load("old"); err != nil || string(data) != "old" || !fs.Exists("old") {
+		t.Error("Flat file was not found: ", err)
+	}
+	if err = fs.Delete("old"); err != nil || fs.Exists("old") {
+		t.Error("Flat file was not deleted: ", err)
+	}
+	if err = fs.Reshard(nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(fs.shardPath("older")); err != nil || string(data) != "older" || fs.Reshard(nil) == nil {
+		t.Error("Interrupted move was not finished: ", err)
+	}
+	fs.Delete("older")
+
+	tx := fs.Begin()
+	tx.Write("qux", []byte("qux"))
+	tx.Delete("bar")
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Delete("missing"); !os.IsNotExist(err) {
+		t.Error("Deleting a missing file did not fail: ", err)
+	}
+	expected := []string{"baz", "foo", "qux"}
+	if names, _ := fs.GetFiles(); !reflect.DeepEqual(names, expected) {
+		t.Error("Unexpected files: ", names)
+	}
+	if count, _, _ := fs.Stats(); count != 3 {
+		t.Error("Unexpected file count: ", count)
+	}
+
+	// Files changed by another process are listed once changed.
+	os.MkdirAll(filepath.Dir(fs.shardPath("stray")), 0777)
+	if err = ioutil.WriteFile(fs.shardPath("stray"), []byte("stray"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(fs.shardPath("baz"))
+	expected = []string{"foo", "qux", "stray"}
+	if names, _ := fs.GetFiles(); !reflect.DeepEqual(names, expected) {
+		t.Error("Unexpected files after outside changes: ", names)
+	}
+
+	// Directories not modified since they were read are not read again.
+	hidden := fs.shardPath("hidden")
+	os.MkdirAll(filepath.Dir(hidden), 0777)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Dir(hidden), old, old)
+	fs.GetFiles()
+	ioutil.WriteFile(hidden, []byte("hidden"), 0666)
+	os.Chtimes(filepath.Dir(hidden), old, old)
+	if names, _ := fs.GetFiles(); !reflect.DeepEqual(names, expected) {
+		t.Error("Unmodified directory was read again: ", names)
+	}
+	os.Remove(hidden)
+
+	// A restart starts from the index file.
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	restart(prefix)
+	if names, _ := fs.GetFiles(); !reflect.DeepEqual(names, expected) {
+		t.Error("Unexpected files after restart: ", names)
+	}
+}
+
+// Test:
+//	that a sharded store and its hidden subdirectories move into a database
+//	that files are read, listed and changed together in it after a restart
+//	that a snapshot of it opens as a database
+//	that a database that can not be read holds no files and fails CheckAccess
+func TestMoveToDatabase(t *testing.T) {
+	directory, err := ioutil.TempDir("", "fileStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	prefix := directory + "/"
+	defer restart(prefix)
+	fs := FileStore{}
+	fs.SetPrefix(prefix)
+	groups := FileStore{}
+	groups.SetPrefix(prefix + ".groups/")
+	groups.CreateDirectory()
+
+	fs.Write("foo", []byte("foo"))
+	fs.Reshard(nil)
+	fs.Write("bar", []byte("bar"))
+	fs.Write(".aliases", []byte("aliases"))
+	groups.Write("first", []byte("first"))
+	if err = fs.MoveToDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Layout() != Database || groups.Layout() != Database || fs.Reshard(nil) == nil {
+		t.Error("Store was not moved to a database")
+	}
+	for _, path := range []string{fs.shardPath("foo"), prefix + ".aliases", prefix + ".groups/first"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Error(path, " was not moved")
+		}
+	}
+
+	tx := fs.Begin()
+	tx.Write(".groups/second", []byte("second"))
+	tx.Write("baz", []byte("baz"))
+	tx.Delete("foo")
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	restart(prefix)
+	if err = fs.Open(); err != nil || fs.Recovering() {
+		t.Error("Database is not ready: ", err)
+	}
+	if names, _ := fs.GetFiles(); !reflect.DeepEqual(names, []string{"bar", "baz"}) {
+		t.Error("Unexpected files: ", names)
+	}
+	if names, _ := groups.GetFiles(); !reflect.DeepEqual(names, []string{"first", "second"}) {
+		t.Error("Unexpected groups: ", names)
+	}
+	if data, err := fs.Load(".aliases"); err != nil || string(data) != "aliases" || fs.Exists("foo") {
+		t.Error("Unexpected files after restart: ", string(data), err)
+	}
+	if err = fs.Delete("foo"); !os.IsNotExist(err) {
+		t.Error("Deleting a missing file did not fail: ", err)
+	}
+	if count, total_bytes, _ := fs.Stats(); count != 2 || total_bytes != 6 {
+		t.Error("Unexpected stats: ", count, total_bytes)
+	}
+
+	var snapshot bytes.Buffer
+	if err = fs.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	fs.Write("bar", []byte("changed"))
+	restart(prefix)
+	ioutil.WriteFile(prefix + databaseName, snapshot.Bytes(), 0666)
+	if data, _ := fs.Load("bar"); string(data) != "bar" {
+		t.Error("Snapshot was not restored: ", string(data))
+	}
+
+	// A database that can not be read is not taken to hold anything.
+	if err = fs.CheckAccess(); err != nil {
+		t.Error("Database is not accessible: ", err)
+	}
+	os.Remove(prefix + databaseName)
+	if fs.Exists("bar") || fs.CheckAccess() == nil {
+		t.Error("Missing database was not reported")
+	}
+}
@@ -0,0 +1,57 @@
+package fileStore
+
+import (
+	"sort"
+	"sync"
+)
+
+// Files are locked by name while they are read, changed and written back,
+// so concurrent requests do not overwrite each other's changes.
+type fileLock struct {
+	mutex sync.Mutex
+	users int
+}
+
+var locksMutex sync.Mutex
+var locks = make(map[string]*fileLock)
+
+// Lock the named files and return the function that unlocks them. Names
+// are locked in sorted order so that two callers can not deadlock.
+func Lock(file_names ...string) func() {
+	unique := make(map[string]bool)
+	var sorted []string
+	for _, file_name := range file_names {
+		if !unique[file_name] {
+			unique[file_name] = true
+			sorted = append(sorted, file_name)
+		}
+	}
+	sort.Strings(sorted)
+
+	var held []*fileLock
+	for _, file_name := range sorted {
+		locksMutex.Lock()
+		lock, ok := locks[file_name]
+		if !ok {
+			lock = &fileLock{}
+			locks[file_name] = lock
+		}
+		lock.users++
+		locksMutex.Unlock()
+
+		lock.mutex.Lock()
+		held = append(held, lock)
+	}
+
+	return func() {
+		locksMutex.Lock()
+		defer locksMutex.Unlock()
+		for i, lock := range held {
+			lock.mutex.Unlock()
+			lock.users--
+			if lock.users == 0 {
+				delete(locks, sorted[i])
+			}
+		}
+	}
+}
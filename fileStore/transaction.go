@@ -0,0 +1,242 @@
+package fileStore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Changes to several files are first written to a journal, then applied.
+// If the process dies part way through, Recover applies the journal again
+// on the next start, so either every change is made or none are.
+const journalName = ".journal"
+
+// Only one transaction is applied at a time.
+var commitLock sync.Mutex
+
+type Transaction struct {
+	fs *FileStore
+	writes map[string][]byte
+	deletes map[string]bool
+}
+
+type journal struct {
+	Writes map[string][]byte
+	Deletes []string
+}
+
+func (fs *FileStore) Begin() *Transaction {
+	return &Transaction{fs: fs, writes: make(map[string][]byte), deletes: make(map[string]bool)}
+}
+
+func (tx *Transaction) Write(file_name string, data []byte) {
+	delete(tx.deletes, file_name)
+	tx.writes[file_name] = data
+}
+
+func (tx *Transaction) Delete(file_name string) {
+	delete(tx.writes, file_name)
+	tx.deletes[file_name] = true
+}
+
+// Load a file as it will be once the transaction is committed.
+func (tx *Transaction) Load(file_name string) ([]byte, error) {
+	if data, ok := tx.writes[file_name]; ok {
+		return data, nil
+	}
+	if tx.deletes[file_name] {
+		return nil, os.ErrNotExist
+	}
+	return tx.fs.Load(file_name)
+}
+
+func (tx *Transaction) Exists(file_name string) bool {
+	if _, ok := tx.writes[file_name]; ok {
+		return true
+	}
+	if tx.deletes[file_name] {
+		return false
+	}
+	return tx.fs.Exists(file_name)
+}
+
+// Names of the files in the store as they will be once the transaction is
+// committed, hidden files left out as in GetFiles.
+func (tx *Transaction) GetFiles() ([]string, error) {
+	stored, err := tx.fs.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	var file_names []string
+	for _, file_name := range stored {
+		if _, ok := tx.writes[file_name]; !ok && !tx.deletes[file_name] {
+			file_names = append(file_names, file_name)
+		}
+	}
+	for file_name := range tx.writes {
+		if !strings.HasPrefix(file_name, ".") {
+			file_names = append(file_names, file_name)
+		}
+	}
+	sort.Strings(file_names)
+	return file_names, nil
+}
+
+// Names of the files written and deleted by the transaction, sorted.
+func (tx *Transaction) Changes() ([]string, []string) {
+	var written []string
+	for file_name := range tx.writes {
+		written = append(written, file_name)
+	}
+	var deleted []string
+	for file_name := range tx.deletes {
+		deleted = append(deleted, file_name)
+	}
+	sort.Strings(written)
+	sort.Strings(deleted)
+	return written, deleted
+}
+
+func (tx *Transaction) Commit() error {
+	commitLock.Lock()
+	defer commitLock.Unlock()
+	start := time.Now()
+
+	// A database makes every change in one write, without a journal.
+	if db, key, err := tx.fs.database(); db != nil || err != nil {
+		if err == nil {
+			db_tx := db.Begin()
+			for file_name, data := range tx.writes {
+				db_tx.Write(key + file_name, data)
+			}
+			for file_name := range tx.deletes {
+				db_tx.Delete(key + file_name)
+			}
+			err = db_tx.Commit()
+		}
+		tx.fs.observe("commit", start, err)
+		if err == nil {
+			_, deleted := tx.Changes()
+			tx.fs.changed(tx.writes, deleted)
+		}
+		return err
+	}
+
+	// Finish any earlier commit first, its journal would be overwritten.
+	err := tx.fs.recover()
+	if err != nil {
+		return err
+	}
+
+	_, deleted := tx.Changes()
+	entry := journal{Writes: tx.writes, Deletes: deleted}
+	journal_data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Until the journal is on disk nothing has changed.
+	err = writeSynced(tx.fs.prefix + journalName, journal_data)
+	if err != nil {
+		os.Remove(tx.fs.prefix + journalName)
+		tx.fs.observe("commit", start, err)
+		return err
+	}
+
+	err = tx.fs.apply(entry)
+	tx.fs.observe("commit", start, err)
+	if err != nil {
+		// The journal stays behind and is applied by Recover.
+		return err
+	}
+	return nil
+}
+
+// Whether a commit was interrupted and its journal not yet applied by
+// Recover.
+func (fs *FileStore) Recovering() bool {
+	_, err := os.Stat(fs.prefix + journalName)
+	return err == nil
+}
+
+// Apply a journal left behind by an interrupted commit.
+func (fs *FileStore) Recover() error {
+	commitLock.Lock()
+	defer commitLock.Unlock()
+	return fs.recover()
+}
+
+func (fs *FileStore) recover() error {
+	journal_data, err := ioutil.ReadFile(fs.prefix + journalName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entry journal
+	err = json.Unmarshal(journal_data, &entry)
+	if err != nil {
+		// A journal that was never completely written was never committed.
+		return os.Remove(fs.prefix + journalName)
+	}
+	return fs.apply(entry)
+}
+
+// Make the changes in a journal, then remove it. Applying a journal more
+// than once has the same result as applying it once.
+func (fs *FileStore) apply(entry journal) error {
+	err := fs.applyEntry(entry)
+	if err == nil {
+		fs.changed(entry.Writes, entry.Deletes)
+	}
+	return err
+}
+
+func (fs *FileStore) applyEntry(entry journal) error {
+	for file_name, data := range entry.Writes {
+		// Write to a temporary file next to it and rename it into place,
+		// so readers never see a partially written file.
+		path := fs.path(file_name)
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		if err != nil {
+			return err
+		}
+		temp := filepath.Join(filepath.Dir(path), ".tmp-" + filepath.Base(path))
+		err = writeSynced(temp, data)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(temp, path)
+		if err != nil {
+			return err
+		}
+	}
+	for _, file_name := range entry.Deletes {
+		err := fs.remove(file_name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(fs.prefix + journalName)
+}
+
+func writeSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
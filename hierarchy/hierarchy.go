@@ -0,0 +1,208 @@
+/*
+ * The purpose of this package is to follow the Parent references between
+ * sites: to find the children and ancestors of a site, to check that
+ * references do not form a cycle, and to work out what a site inherits.
+ */
+
+package hierarchy
+
+import (
+	"sort"
+	"strings"
+	"../entities"
+	"../schema"
+)
+
+// Where sites are read from: the File Store, or a transaction to see sites
+// as they will be once it is committed.
+type Store interface {
+	GetFiles() ([]string, error)
+	Load(file_name string) ([]byte, error)
+	Exists(file_name string) bool
+}
+
+// Every site by name.
+type Tree struct {
+	sites map[string]entities.Site
+}
+
+func New(sites []entities.Site) *Tree {
+	tree := &Tree{sites: make(map[string]entities.Site)}
+	for _, site := range sites {
+		tree.sites[site.Name] = site
+	}
+	return tree
+}
+
+// Read every site in store.
+func Load(store Store) (*Tree, error) {
+	file_names, err := store.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	tree := New(nil)
+	for _, file_name := range file_names {
+		file_data, err := store.Load(file_name)
+		if err != nil {
+			return nil, err
+		}
+		site, err := schema.DecodeSite(file_data)
+		if err != nil {
+			return nil, err
+		}
+		tree.sites[site.Name] = site
+	}
+	return tree, nil
+}
+
+// Read the ancestors of sites from store, up to a site without a parent or
+// whose parent does not exist. Enough to Check sites and work out what
+// they inherit, without reading every site.
+func LoadAncestors(store Store, sites ...entities.Site) (*Tree, error) {
+	tree := New(sites)
+	for _, site := range sites {
+		for parent := site.Parent; parent != ""; {
+			if _, ok := tree.sites[parent]; ok || !store.Exists(parent) {
+				break
+			}
+			file_data, err := store.Load(parent)
+			if err != nil {
+				return nil, err
+			}
+			ancestor, err := schema.DecodeSite(file_data)
+			if err != nil {
+				return nil, err
+			}
+			tree.sites[parent] = ancestor
+			parent = ancestor.Parent
+		}
+	}
+	return tree, nil
+}
+
+// Add site, or replace the site with its name.
+func (t *Tree) Put(site entities.Site) {
+	t.sites[site.Name] = site
+}
+
+func (t *Tree) Remove(name string) {
+	delete(t.sites, name)
+}
+
+func (t *Tree) Site(name string) (entities.Site, bool) {
+	site, ok := t.sites[name]
+	return site, ok
+}
+
+// Every site in the tree, by name.
+func (t *Tree) Sites() []entities.Site {
+	var sites []entities.Site
+	for _, site := range t.sites {
+		sites = append(sites, site)
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Name < sites[j].Name
+	})
+	return sites
+}
+
+// Sites whose parent is name, by name.
+func (t *Tree) Children(name string) []entities.Site {
+	var children []entities.Site
+	for _, site := range t.sites {
+		if site.Parent == name && site.Name != name {
+			children = append(children, site)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Name < children[j].Name
+	})
+	return children
+}
+
+// Children of name, then their children, and so on.
+func (t *Tree) Descendants(name string) []entities.Site {
+	var descendants []entities.Site
+	seen := map[string]bool{name: true}
+	for level := []string{name}; len(level) > 0; {
+		var next []string
+		for _, parent := range level {
+			for _, child := range t.Children(parent) {
+				if seen[child.Name] {
+					continue
+				}
+				seen[child.Name] = true
+				descendants = append(descendants, child)
+				next = append(next, child.Name)
+			}
+		}
+		level = next
+	}
+	return descendants
+}
+
+// Parent of name, then its parent, and so on up to a site without one or
+// whose parent does not exist.
+func (t *Tree) Ancestors(name string) []entities.Site {
+	var ancestors []entities.Site
+	seen := map[string]bool{name: true}
+	site, ok := t.sites[name]
+	for ok && site.Parent != "" && !seen[site.Parent] {
+		seen[site.Parent] = true
+		site, ok = t.sites[site.Parent]
+		if ok {
+			ancestors = append(ancestors, site)
+		}
+	}
+	return ancestors
+}
+
+// Check that the parent of site name exists and is not the site itself
+// or one of its descendants.
+func (t *Tree) Check(name string) []entities.Violation {
+	site, ok := t.sites[name]
+	if !ok || site.Parent == "" {
+		return nil
+	}
+	if _, ok := t.sites[site.Parent]; !ok {
+		return []entities.Violation{{Field: "Parent", Message: "Parent site " + site.Parent + " does not exist"}}
+	}
+	path := []string{name}
+	seen := map[string]bool{}
+	for parent := site.Parent; parent != "" && !seen[parent]; parent = t.sites[parent].Parent {
+		seen[parent] = true
+		path = append(path, parent)
+		if parent == name {
+			return []entities.Violation{{Field: "Parent", Message: "Parent makes a cycle: " + strings.Join(path, " > ")}}
+		}
+	}
+	return nil
+}
+
+// The site with what it inherits from its ancestors: their role if it has
+// none, and their labels where it does not set them. Nearer ancestors win.
+func (t *Tree) Inherited(site entities.Site) entities.Site {
+	ancestors := t.Ancestors(site.Name)
+	if site.Role == "" {
+		for _, ancestor := range ancestors {
+			if ancestor.Role != "" {
+				site.Role = ancestor.Role
+				break
+			}
+		}
+	}
+
+	labels := make(map[string]string)
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		for key, value := range ancestors[i].Labels {
+			labels[key] = value
+		}
+	}
+	for key, value := range site.Labels {
+		labels[key] = value
+	}
+	if len(labels) > 0 {
+		site.Labels = labels
+	}
+	return site
+}
@@ -0,0 +1,182 @@
+package hierarchy
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"../entities"
+	"../schema"
+)
+
+// Test:
+//	that children, descendants and ancestors follow Parent
+//	that missing parents and cycles are reported
+//	that role and labels are inherited from the nearest ancestor
+func TestTree(t *testing.T) {
+	tree := New([]entities.Site{
+		{Name: "region", Role: "region", Labels: map[string]string{"geo": "eu", "tier": "core"}},
+		{Name: "dc", Parent: "region", Labels: map[string]string{"tier": "dc"}},
+		{Name: "rack", Parent: "dc"},
+		{Name: "other", Parent: "region"},
+		{Name: "lost", Parent: "missing"},
+	})
+
+	names := func(sites []entities.Site) string {
+		joined := ""
+		for _, site := range sites {
+			joined += site.Name + " "
+		}
+		return joined
+	}
+	if children := names(tree.Children("region")); children != "dc other " {
+		t.Error("Unexpected children: ", children)
+	}
+	if descendants := names(tree.Descendants("region")); descendants != "dc other rack " {
+		t.Error("Unexpected descendants: ", descendants)
+	}
+	if ancestors := names(tree.Ancestors("rack")); ancestors != "dc region " {
+		t.Error("Unexpected ancestors: ", ancestors)
+	}
+
+	if violations := tree.Check("rack"); len(violations) != 0 {
+		t.Error("Unexpected violations: ", violations)
+	}
+	if violations := tree.Check("lost"); len(violations) != 1 {
+		t.Error("Missing parent was not reported: ", violations)
+	}
+	tree.Put(entities.Site{Name: "region", Parent: "rack"})
+	if violations := tree.Check("region"); len(violations) != 1 || violations[0].Message != "Parent makes a cycle: region > rack > dc > region" {
+		t.Error("Cycle was not reported: ", violations)
+	}
+	if ancestors := names(tree.Ancestors("rack")); ancestors != "dc region " {
+		t.Error("Unexpected ancestors with a cycle: ", ancestors)
+	}
+	tree.Put(entities.Site{Name: "region", Role: "region", Labels: map[string]string{"geo": "eu", "tier": "core"}})
+
+	rack, _ := tree.Site("rack")
+	inherited := tree.Inherited(rack)
+	if inherited.Role != "region" || inherited.Labels["geo"] != "eu" || inherited.Labels["tier"] != "dc" {
+		t.Error("Unexpected inherited site: ", inherited)
+	}
+	if rack.Labels != nil {
+		t.Error("Inheriting changed the site: ", rack)
+	}
+}
+
+// Sites by name, counting how often they are loaded.
+type memoryStore struct {
+	files map[string][]byte
+	loads int
+}
+
+func newMemoryStore(sites ...entities.Site) *memoryStore {
+	store := &memoryStore{files: make(map[string][]byte)}
+	for _, site := range sites {
+		store.files[site.Name], _ = schema.EncodeSite(&site)
+	}
+	return store
+}
+
+func (store *memoryStore) GetFiles() ([]string, error) {
+	var names []string
+	for name := range store.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (store *memoryStore) Load(file_name string) ([]byte, error) {
+	store.loads++
+	return store.files[file_name], nil
+}
+
+func (store *memoryStore) Exists(file_name string) bool {
+	_, ok := store.files[file_name]
+	return ok
+}
+
+// Test:
+//	that only the ancestors of the given sites are read
+//	that the given sites are checked as they will be written
+func TestLoadAncestors(t *testing.T) {
+	store := newMemoryStore(
+		entities.Site{Name: "region"},
+		entities.Site{Name: "dc", Parent: "region"},
+		entities.Site{Name: "rack", Parent: "dc"},
+		entities.Site{Name: "other", Parent: "region"},
+	)
+	tree, err := LoadAncestors(store, entities.Site{Name: "new", Parent: "dc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.loads != 2 {
+		t.Error("Unexpected number of sites read: ", store.loads)
+	}
+	if violations := tree.Check("new"); len(violations) != 0 {
+		t.Error("Unexpected violations: ", violations)
+	}
+
+	tree, err = LoadAncestors(store, entities.Site{Name: "region", Parent: "rack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if violations := tree.Check("region"); len(violations) != 1 || violations[0].Message != "Parent makes a cycle: region > rack > dc > region" {
+		t.Error("Cycle was not reported: ", violations)
+	}
+	tree, err = LoadAncestors(store, entities.Site{Name: "lost", Parent: "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if violations := tree.Check("lost"); len(violations) != 1 {
+		t.Error("Missing parent was not reported: ", violations)
+	}
+}
+
+// Test:
+//	that children and descendants are found from the index
+//	that updates move, add and remove children without reading the store
+//	that children removed without an update are dropped
+func TestIndex(t *testing.T) {
+	store := newMemoryStore(
+		entities.Site{Name: "region"},
+		entities.Site{Name: "dc", Parent: "region"},
+		entities.Site{Name: "rack", Parent: "dc"},
+		entities.Site{Name: "other", Parent: "region"},
+	)
+	index := NewIndex(store)
+	names := func(names []string, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(names, " ")
+	}
+	if children := names(index.Children("region")); children != "dc other" {
+		t.Error("Unexpected children: ", children)
+	}
+	if descendants := names(index.Descendants("region")); descendants != "dc other rack" {
+		t.Error("Unexpected descendants: ", descendants)
+	}
+
+	loads := store.loads
+	moved, _ := schema.EncodeSite(&entities.Site{Name: "rack", Parent: "other"})
+	added, _ := schema.EncodeSite(&entities.Site{Name: "shelf", Parent: "rack"})
+	store.files["rack"], store.files["shelf"] = moved, added
+	delete(store.files, "dc")
+	index.Update(map[string][]byte{"rack": moved, "shelf": added, ".journal": []byte("{}")}, []string{"dc"})
+	if children := names(index.Children("region")); children != "other" {
+		t.Error("Unexpected children after update: ", children)
+	}
+	if descendants := names(index.Descendants("other")); descendants != "rack shelf" {
+		t.Error("Unexpected descendants after update: ", descendants)
+	}
+	if store.loads != loads {
+		t.Error("Store was read again")
+	}
+
+	// Removed without an update.
+	delete(store.files, "shelf")
+	if descendants := names(index.Descendants("other")); descendants != "rack" {
+		t.Error("Unexpected descendants after removal: ", descendants)
+	}
+}
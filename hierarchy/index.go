@@ -0,0 +1,142 @@
+package hierarchy
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"../schema"
+)
+
+// The Parent of every site in a store, so that children are found without
+// reading every site. It is read from the store when first used, and kept
+// up to date with Update as sites are written and deleted.
+type Index struct {
+	store Store
+	mutex sync.Mutex
+	loaded bool
+	parents map[string]string
+	children map[string]map[string]bool
+}
+
+func NewIndex(store Store) *Index {
+	return &Index{store: store}
+}
+
+// Read the parent of every site, unless they have been read already. The
+// mutex is held, so changes passed to Update meanwhile are made after.
+func (index *Index) load() error {
+	if index.loaded {
+		return nil
+	}
+	tree, err := Load(index.store)
+	if err != nil {
+		return err
+	}
+	index.parents = make(map[string]string)
+	index.children = make(map[string]map[string]bool)
+	for name, site := range tree.sites {
+		index.set(name, site.Parent)
+	}
+	index.loaded = true
+	return nil
+}
+
+func (index *Index) set(name string, parent string) {
+	index.remove(name)
+	index.parents[name] = parent
+	if parent == "" {
+		return
+	}
+	if index.children[parent] == nil {
+		index.children[parent] = make(map[string]bool)
+	}
+	index.children[parent][name] = true
+}
+
+func (index *Index) remove(name string) {
+	parent, ok := index.parents[name]
+	if !ok {
+		return
+	}
+	delete(index.parents, name)
+	delete(index.children[parent], name)
+	if len(index.children[parent]) == 0 {
+		delete(index.children, parent)
+	}
+}
+
+// Record sites written and deleted in the store. Hidden files are not
+// sites, and are left out as in GetFiles.
+func (index *Index) Update(written map[string][]byte, deleted []string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if !index.loaded {
+		return
+	}
+	for name, file_data := range written {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		// A site that can not be read is still there, without a parent.
+		site, _ := schema.DecodeSite(file_data)
+		index.set(name, site.Parent)
+	}
+	for _, name := range deleted {
+		index.remove(name)
+	}
+}
+
+// Names of the sites whose parent is name, sorted.
+func (index *Index) Children(name string) ([]string, error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	err := index.load()
+	if err != nil {
+		return nil, err
+	}
+	return index.childNames(name), nil
+}
+
+// Children whose files were removed without an Update, such as by another
+// process, are dropped.
+func (index *Index) childNames(name string) []string {
+	var names []string
+	for child := range index.children[name] {
+		if !index.store.Exists(child) {
+			index.remove(child)
+			continue
+		}
+		if child != name {
+			names = append(names, child)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Children of name, then their children, and so on.
+func (index *Index) Descendants(name string) ([]string, error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	err := index.load()
+	if err != nil {
+		return nil, err
+	}
+	var descendants []string
+	seen := map[string]bool{name: true}
+	for level := []string{name}; len(level) > 0; {
+		var next []string
+		for _, parent := range level {
+			for _, child := range index.childNames(parent) {
+				if seen[child] {
+					continue
+				}
+				seen[child] = true
+				descendants = append(descendants, child)
+				next = append(next, child)
+			}
+		}
+		level = next
+	}
+	return descendants, nil
+}
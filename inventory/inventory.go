@@ -0,0 +1,360 @@
+/*
+ * The purpose of this package is to export the whole site inventory as a
+ * single archive and to work out what importing one would change.
+ */
+
+package inventory
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+	"../entities"
+)
+
+const ManifestVersion = 1
+
+// Archive formats.
+const (
+	Json = "json"
+	NDJson = "ndjson"
+	TarGz = "tar.gz"
+)
+
+// Import modes.
+const (
+	// Fail if any imported site already exists.
+	CreateOnly = "create-only"
+	// Create new sites and overwrite existing ones.
+	Upsert = "upsert"
+	// Upsert, then delete every site that was not imported.
+	ReplaceAll = "replace-all"
+)
+
+const manifestFile = "manifest.json"
+const sitesDirectory = "sites/"
+
+// A site and its JSON, which manifest checksums are computed over.
+type SiteFile struct {
+	Name string
+	Data []byte
+}
+
+type ManifestEntry struct {
+	Name string
+	Sha256 string
+	Bytes int
+}
+
+type Manifest struct {
+	Version int
+	CreatedAt time.Time
+	Count int
+	Sites []ManifestEntry
+}
+
+// The single document produced by a JSON export.
+type Document struct {
+	Manifest Manifest
+	Sites []entities.Site
+}
+
+// What an import changes, by site name.
+type Plan struct {
+	Mode string
+	DryRun bool
+	Created []string
+	Updated []string
+	Deleted []string
+	Unchanged []string
+}
+
+func NewManifest(files []SiteFile) Manifest {
+	manifest := Manifest{Version: ManifestVersion, CreatedAt: time.Now().UTC(), Count: len(files)}
+	for _, file := range files {
+		manifest.Sites = append(manifest.Sites, ManifestEntry{file.Name, checksum(file.Data), len(file.Data)})
+	}
+	return manifest
+}
+
+func Write(w io.Writer, format string, files []SiteFile) error {
+	switch format {
+	case Json:
+		return writeJson(w, files)
+	case NDJson:
+		return writeNDJson(w, files)
+	case TarGz:
+		return writeTarGz(w, files)
+	default:
+		return errors.New("Unknown export format: " + format)
+	}
+}
+
+// Read the sites in an archive, checking them against its manifest.
+func Read(r io.Reader, format string) ([]entities.Site, error) {
+	switch format {
+	case Json:
+		return readJson(r)
+	case NDJson:
+		return readNDJson(r)
+	case TarGz:
+		return readTarGz(r)
+	default:
+		return nil, errors.New("Unknown import format: " + format)
+	}
+}
+
+// Work out what importing sites into a store holding existing would do.
+func MakePlan(mode string, sites []entities.Site, existing map[string][]byte) (Plan, error) {
+	plan := Plan{Mode: mode}
+	if mode != CreateOnly && mode != Upsert && mode != ReplaceAll {
+		return plan, errors.New("Unknown import mode: " + mode)
+	}
+
+	imported := make(map[string]bool)
+	for _, site := range sites {
+		if imported[site.Name] {
+			return plan, errors.New("Site " + site.Name + " is imported more than once")
+		}
+		imported[site.Name] = true
+
+		err := site.Validate()
+		if err != nil {
+			return plan, errors.New("Site " + site.Name + ": " + err.Error())
+		}
+
+		old_data, exists := existing[site.Name]
+		if !exists {
+			plan.Created = append(plan.Created, site.Name)
+			continue
+		}
+		if mode == CreateOnly {
+			return plan, errors.New("Site " + site.Name + " already exists")
+		}
+		old_site, err := entities.SiteFromJson(old_data)
+		if err != nil {
+			return plan, err
+		}
+		// Audit fields are set by the server, so only content is compared.
+		if site.EqualTo(&old_site, false) {
+			plan.Unchanged = append(plan.Unchanged, site.Name)
+		} else {
+			plan.Updated = append(plan.Updated, site.Name)
+		}
+	}
+
+	if mode == ReplaceAll {
+		for name := range existing {
+			if !imported[name] {
+				plan.Deleted = append(plan.Deleted, name)
+			}
+		}
+		sort.Strings(plan.Deleted)
+	}
+	return plan, nil
+}
+
+func writeJson(w io.Writer, files []SiteFile) error {
+	document := Document{Manifest: NewManifest(files), Sites: []entities.Site{}}
+	for _, file := range files {
+		site, err := entities.SiteFromJson(file.Data)
+		if err != nil {
+			return err
+		}
+		document.Sites = append(document.Sites, site)
+	}
+	return json.NewEncoder(w).Encode(document)
+}
+
+func writeNDJson(w io.Writer, files []SiteFile) error {
+	for _, file := range files {
+		_, err := w.Write(append([]byte(strings.TrimSpace(string(file.Data))), '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Site files are stored as sites/<name>.json followed by the manifest.
+func writeTarGz(w io.Writer, files []SiteFile) error {
+	gzip_writer := gzip.NewWriter(w)
+	tar_writer := tar.NewWriter(gzip_writer)
+	now := time.Now()
+
+	add := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: now}
+		err := tar_writer.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = tar_writer.Write(data)
+		return err
+	}
+
+	for _, file := range files {
+		err := add(sitesDirectory + file.Name + ".json", file.Data)
+		if err != nil {
+			return err
+		}
+	}
+	manifest_json, err := json.MarshalIndent(NewManifest(files), "", "  ")
+	if err != nil {
+		return err
+	}
+	err = add(manifestFile, manifest_json)
+	if err != nil {
+		return err
+	}
+
+	err = tar_writer.Close()
+	if err != nil {
+		return err
+	}
+	return gzip_writer.Close()
+}
+
+// Accepts a Document or a plain array of sites.
+func readJson(r io.Reader) ([]entities.Site, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		var sites []entities.Site
+		err = json.Unmarshal(data, &sites)
+		return sites, err
+	}
+
+	var document Document
+	err = json.Unmarshal(data, &document)
+	if err != nil {
+		return nil, err
+	}
+	if len(document.Manifest.Sites) > 0 {
+		var files []SiteFile
+		for _, site := range document.Sites {
+			site_json, err := site.ToJson()
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, SiteFile{site.Name, site_json})
+		}
+		err = verify(document.Manifest, files)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return document.Sites, nil
+}
+
+func readNDJson(r io.Reader) ([]entities.Site, error) {
+	var sites []entities.Site
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		site, err := entities.SiteFromJson([]byte(line))
+		if err != nil {
+			return nil, err
+		}
+		sites = append(sites, site)
+	}
+	return sites, scanner.Err()
+}
+
+func readTarGz(r io.Reader) ([]entities.Site, error) {
+	gzip_reader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tar_reader := tar.NewReader(gzip_reader)
+
+	var files []SiteFile
+	var manifest *Manifest
+	for {
+		header, err := tar_reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(tar_reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Name == manifestFile {
+			manifest = &Manifest{}
+			err = json.Unmarshal(data, manifest)
+			if err != nil {
+				return nil, err
+			}
+		} else if strings.HasPrefix(header.Name, sitesDirectory) && strings.HasSuffix(header.Name, ".json") {
+			name := strings.TrimSuffix(strings.TrimPrefix(header.Name, sitesDirectory), ".json")
+			files = append(files, SiteFile{name, data})
+		}
+	}
+
+	if manifest == nil {
+		return nil, errors.New("Archive has no " + manifestFile)
+	}
+	err = verify(*manifest, files)
+	if err != nil {
+		return nil, err
+	}
+
+	var sites []entities.Site
+	for _, file := range files {
+		site, err := entities.SiteFromJson(file.Data)
+		if err != nil {
+			return nil, errors.New("Site " + file.Name + ": " + err.Error())
+		}
+		if site.Name != file.Name {
+			return nil, errors.New("Site " + file.Name + " contains site " + site.Name)
+		}
+		sites = append(sites, site)
+	}
+	return sites, nil
+}
+
+// Check that files are exactly the ones listed in the manifest.
+func verify(manifest Manifest, files []SiteFile) error {
+	if manifest.Version > ManifestVersion {
+		return errors.New("Unsupported manifest version")
+	}
+	if len(files) != len(manifest.Sites) {
+		return errors.New("Manifest lists a different number of sites than the archive holds")
+	}
+	checksums := make(map[string]string)
+	for _, entry := range manifest.Sites {
+		checksums[entry.Name] = entry.Sha256
+	}
+	for _, file := range files {
+		expected, ok := checksums[file.Name]
+		if !ok {
+			return errors.New("Site " + file.Name + " is not in the manifest")
+		}
+		if checksum(file.Data) != expected {
+			return errors.New("Checksum mismatch for site " + file.Name)
+		}
+	}
+	return nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,437 @@
+/*
+ * The purpose of this package is to keep many small values in a single
+ * file, so that changes to several of them can be made at once and they
+ * can be listed without reading a directory. The file is a log: every
+ * change is appended to it as a record, and reading the records from the
+ * start gives the current values. Compaction rewrites it with only those.
+ */
+
+package kvStore
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Written at the start of every store file.
+const header = "kvStore1"
+
+// Each record is the length and CRC-32 of its changes, followed by them.
+// A record that was not completely written, because the process died
+// while writing it, does not match its CRC and is not applied.
+const recordHeaderSize = 8
+
+// Kinds of change in a record. Each change is its kind, the length of its
+// key and the key, then for a write the length of the value and the value.
+const (
+	opWrite byte = 1
+	opDelete byte = 2
+)
+
+// Where a value is in the store file.
+type entry struct {
+	offset int64
+	length int
+}
+
+// A store file, kept open while the store or a snapshot of it uses it.
+type file struct {
+	*os.File
+	refs int
+}
+
+// An open store. Where each current value is in the file is kept in
+// memory. The file is read again from where it was last read before each
+// operation, so changes made by other processes are seen.
+type DB struct {
+	mutex sync.Mutex
+	path string
+	file *file
+	// Where the records read so far end.
+	end int64
+	index map[string]entry
+	// Size the file would have if compacted.
+	live int64
+}
+
+// Open the store file at path, creating it if it does not exist. A record
+// left incomplete at its end by a crash is removed.
+func Open(path string) (*DB, error) {
+	db := &DB{path: path}
+	if err := db.open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Read the file at path from the start.
+func (db *DB) open() error {
+	f, err := os.OpenFile(db.path, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() == 0 {
+		_, err = f.Write([]byte(header))
+		if err == nil {
+			err = f.Sync()
+		}
+	} else if err == nil {
+		start := make([]byte, len(header))
+		if _, err = f.ReadAt(start, 0); err != nil || string(start) != header {
+			err = errors.New(db.path + " is not a store file")
+		}
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if db.file != nil {
+		db.file.release()
+	}
+	db.file = &file{File: f, refs: 1}
+	db.end = int64(len(header))
+	db.index = make(map[string]entry)
+	db.live = int64(len(header))
+	torn, err := db.read()
+	if err == nil && torn {
+		err = f.Truncate(db.end)
+	}
+	return err
+}
+
+// Apply the records after the ones read so far. Returns whether the last
+// one is incomplete, which it may also be while another process writes it.
+func (db *DB) read() (bool, error) {
+	info, err := db.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	size := info.Size()
+	for db.end < size {
+		if db.end + recordHeaderSize > size {
+			return true, nil
+		}
+		head := make([]byte, recordHeaderSize)
+		if _, err := db.file.ReadAt(head, db.end); err != nil {
+			return false, err
+		}
+		length := int64(binary.BigEndian.Uint32(head))
+		if db.end + recordHeaderSize + length > size {
+			return true, nil
+		}
+		body := make([]byte, length)
+		if _, err := db.file.ReadAt(body, db.end + recordHeaderSize); err != nil {
+			return false, err
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(head[4:]) {
+			return true, nil
+		}
+		changes, ok := decode(body)
+		if !ok {
+			return true, nil
+		}
+		for _, change := range changes {
+			db.applyChange(change, db.end + recordHeaderSize)
+		}
+		db.end += recordHeaderSize + length
+	}
+	return false, nil
+}
+
+// A change read from a record, with where its value is in the record.
+type change struct {
+	op byte
+	key string
+	offset int
+	length int
+}
+
+func (db *DB) applyChange(c change, record int64) {
+	if old, ok := db.index[c.key]; ok {
+		db.live -= recordSize(c.key, old.length)
+		delete(db.index, c.key)
+	}
+	if c.op == opWrite {
+		db.index[c.key] = entry{offset: record + int64(c.offset), length: c.length}
+		db.live += recordSize(c.key, c.length)
+	}
+}
+
+// The size of a record writing a value of length to key.
+func recordSize(key string, length int) int64 {
+	var buffer [binary.MaxVarintLen64]byte
+	size := recordHeaderSize + 1
+	size += binary.PutUvarint(buffer[:], uint64(len(key))) + len(key)
+	size += binary.PutUvarint(buffer[:], uint64(length)) + length
+	return int64(size)
+}
+
+// The changes in a record, or false if it can not be read.
+func decode(body []byte) ([]change, bool) {
+	var changes []change
+	for position := 0; position < len(body); {
+		c := change{op: body[position]}
+		position++
+		key_length, n := binary.Uvarint(body[position:])
+		if n <= 0 || uint64(len(body) - position - n) < key_length {
+			return nil, false
+		}
+		position += n
+		c.key = string(body[position:position + int(key_length)])
+		position += int(key_length)
+		switch c.op {
+		case opWrite:
+			value_length, n := binary.Uvarint(body[position:])
+			if n <= 0 || uint64(len(body) - position - n) < value_length {
+				return nil, false
+			}
+			position += n
+			c.offset, c.length = position, int(value_length)
+			position += int(value_length)
+		case opDelete:
+		default:
+			return nil, false
+		}
+		changes = append(changes, c)
+	}
+	return changes, true
+}
+
+// A record making every change, deletes first, with its header.
+func encode(writes map[string][]byte, deletes []string) []byte {
+	var buffer [binary.MaxVarintLen64]byte
+	record := make([]byte, recordHeaderSize)
+	add := func(op byte, key string) {
+		record = append(record, op)
+		record = append(record, buffer[:binary.PutUvarint(buffer[:], uint64(len(key)))]...)
+		record = append(record, key...)
+	}
+	for _, key := range deletes {
+		add(opDelete, key)
+	}
+	keys := make([]string, 0, len(writes))
+	for key := range writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		add(opWrite, key)
+		record = append(record, buffer[:binary.PutUvarint(buffer[:], uint64(len(writes[key])))]...)
+		record = append(record, writes[key]...)
+	}
+	body := record[recordHeaderSize:]
+	binary.BigEndian.PutUint32(record, uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(body))
+	return record
+}
+
+// Read the changes made by other processes since the file was last read,
+// or the whole file if it was replaced by compacting it.
+func (db *DB) refresh() error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	current, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(info, current) {
+		return db.open()
+	}
+	// An incomplete record is being written by another process, and is
+	// read once it is complete.
+	_, err = db.read()
+	return err
+}
+
+// Append a record with the changes and read it back. Called with the store
+// locked.
+func (db *DB) commit(writes map[string][]byte, deletes []string) error {
+	if len(writes) == 0 && len(deletes) == 0 {
+		return nil
+	}
+	if err := db.refresh(); err != nil {
+		return err
+	}
+	// The record is appended with one write so that it is not mixed with
+	// records other processes append at the same time.
+	_, err := db.file.Write(encode(writes, deletes))
+	if err == nil {
+		err = db.file.Sync()
+	}
+	if err != nil {
+		// Remove what was written so later records are not lost behind it.
+		db.file.Truncate(db.end)
+		return err
+	}
+	_, err = db.read()
+	return err
+}
+
+func (db *DB) Load(key string) ([]byte, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err := db.refresh(); err != nil {
+		return nil, err
+	}
+	return load(db.file, db.index, key)
+}
+
+func load(f *file, index map[string]entry, key string) ([]byte, error) {
+	e, ok := index[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	value := make([]byte, e.length)
+	_, err := f.ReadAt(value, e.offset)
+	return value, err
+}
+
+func (db *DB) Exists(key string) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err := db.refresh(); err != nil {
+		return false, err
+	}
+	_, ok := db.index[key]
+	return ok, nil
+}
+
+// The length of the value of key, if it exists.
+func (db *DB) Size(key string) (int, bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err := db.refresh(); err != nil {
+		return 0, false, err
+	}
+	e, ok := db.index[key]
+	return e.length, ok, nil
+}
+
+func (db *DB) Write(key string, value []byte) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.commit(map[string][]byte{key: value}, nil)
+}
+
+// Delete key, failing with os.ErrNotExist if it does not exist.
+func (db *DB) Delete(key string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err := db.refresh(); err != nil {
+		return err
+	}
+	if _, ok := db.index[key]; !ok {
+		return os.ErrNotExist
+	}
+	return db.commit(nil, []string{key})
+}
+
+// Keys starting with prefix, sorted.
+func (db *DB) Keys(prefix string) ([]string, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err := db.refresh(); err != nil {
+		return nil, err
+	}
+	return keys(db.index, prefix), nil
+}
+
+func keys(index map[string]entry, prefix string) []string {
+	var matching []string
+	for key := range index {
+		if strings.HasPrefix(key, prefix) {
+			matching = append(matching, key)
+		}
+	}
+	sort.Strings(matching)
+	return matching
+}
+
+// The size of the file, and the size it would have if compacted.
+func (db *DB) Usage() (int64, int64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err := db.refresh(); err != nil {
+		return 0, 0, err
+	}
+	return db.end, db.live, nil
+}
+
+// Rewrite the file with only the current values, and replace it with that.
+// Only compact a store no other process has open, as changes they make to
+// the old file while it is rewritten are lost.
+func (db *DB) Compact() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err := db.refresh(); err != nil {
+		return err
+	}
+	temp := db.path + ".compact"
+	f, err := os.OpenFile(temp, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = writeValues(f, db.file, db.index)
+	if err == nil {
+		err = f.Sync()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(temp, db.path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	if directory, err := os.Open(filepath.Dir(db.path)); err == nil {
+		directory.Sync()
+		directory.Close()
+	}
+	return db.open()
+}
+
+// Write a store file holding the values in index, one record each.
+func writeValues(w io.Writer, f *file, index map[string]entry) (int64, error) {
+	n, err := io.WriteString(w, header)
+	written := int64(n)
+	for _, key := range keys(index, "") {
+		if err != nil {
+			break
+		}
+		var value []byte
+		value, err = load(f, index, key)
+		if err == nil {
+			n, err = w.Write(encode(map[string][]byte{key: value}, nil))
+			written += int64(n)
+		}
+	}
+	return written, err
+}
+
+func (f *file) release() {
+	f.refs--
+	if f.refs == 0 {
+		f.Close()
+	}
+}
+
+// Close the store. Its snapshots can still be read until they are closed.
+func (db *DB) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.file.release()
+	return nil
+}
@@ -0,0 +1,157 @@
+package kvStore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func tempStore(t *testing.T) (string, *DB) {
+	directory, err := ioutil.TempDir("", "kvStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := directory + "/store"
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, db
+}
+
+func expectValue(t *testing.T, db *DB, key string, expected string) {
+	value, err := db.Load(key)
+	if expected == "" {
+		if !os.IsNotExist(err) {
+			t.Error("Unexpected value of ", key, ": ", string(value), err)
+		}
+	} else if err != nil || string(value) != expected {
+		t.Error("Unexpected value of ", key, ": ", string(value), err)
+	}
+}
+
+// Test:
+//	that writes, deletes and transactions are kept across reopening
+//	that changes made through another handle are seen
+func TestTransactions(t *testing.T) {
+	path, db := tempStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	db.Write("foo", []byte("one"))
+	db.Write("bar", []byte("two"))
+	if err := db.Delete("missing"); !os.IsNotExist(err) {
+		t.Error("Deleting a missing key did not fail: ", err)
+	}
+	tx := db.Begin()
+	tx.Write("foo", []byte("three"))
+	tx.Write(".hidden/baz", []byte("four"))
+	tx.Delete("bar")
+	if value, _ := tx.Load("foo"); string(value) != "three" {
+		t.Error("Transaction does not see its own write")
+	}
+	expectValue(t, db, "foo", "one")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, other, "foo", "three")
+	expectValue(t, other, "bar", "")
+	other.Write("qux", []byte("five"))
+	expectValue(t, db, "qux", "five")
+	if keys, _ := db.Keys(".hidden/"); !reflect.DeepEqual(keys, []string{".hidden/baz"}) {
+		t.Error("Unexpected keys: ", keys)
+	}
+	if keys, _ := db.Keys(""); !reflect.DeepEqual(keys, []string{".hidden/baz", "foo", "qux"}) {
+		t.Error("Unexpected keys: ", keys)
+	}
+	other.Close()
+	db.Close()
+}
+
+// Test:
+//	that a record torn by a crash is dropped and the store still written to
+//	that a file that is not a store is refused
+func TestRecovery(t *testing.T) {
+	path, db := tempStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	db.Write("foo", []byte("one"))
+	size, _, _ := db.Usage()
+	db.Close()
+
+	record := encode(map[string][]byte{"foo": []byte("two"), "bar": []byte("three")}, nil)
+	file, _ := os.OpenFile(path, os.O_WRONLY | os.O_APPEND, 0666)
+	file.Write(record[:len(record) - 2])
+	file.Close()
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, db, "foo", "one")
+	expectValue(t, db, "bar", "")
+	if info, _ := os.Stat(path); info.Size() != size {
+		t.Error("Torn record was not removed: ", info.Size(), " bytes instead of ", size)
+	}
+	db.Write("bar", []byte("four"))
+	db.Close()
+	db, _ = Open(path)
+	expectValue(t, db, "bar", "four")
+	db.Close()
+
+	ioutil.WriteFile(path, []byte("something else"), 0666)
+	if _, err := Open(path); err == nil {
+		t.Error("A file that is not a store was opened")
+	}
+}
+
+// Test:
+//	that a snapshot keeps its values through later changes and compaction
+//	that compaction keeps the current values and shrinks the file
+//	that a written snapshot opens as a store
+func TestSnapshotAndCompact(t *testing.T) {
+	path, db := tempStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	for _, value := range []string{"one", "two", "three"} {
+		db.Write("foo", []byte(value))
+	}
+	db.Write("bar", []byte("bar"))
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Write("foo", []byte("four"))
+	db.Delete("bar")
+
+	size, live, _ := db.Usage()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if compacted, _, _ := db.Usage(); compacted != live || compacted >= size {
+		t.Error("Unexpected size after compaction: ", compacted, " expected ", live)
+	}
+	expectValue(t, db, "foo", "four")
+	expectValue(t, db, "bar", "")
+
+	if value, err := snapshot.Load("foo"); err != nil || string(value) != "three" {
+		t.Error("Snapshot changed: ", string(value), err)
+	}
+	var written bytes.Buffer
+	snapshot.WriteTo(&written)
+	snapshot.Close()
+	ioutil.WriteFile(path + "-restored", written.Bytes(), 0666)
+	restored, err := Open(path + "-restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, restored, "foo", "three")
+	expectValue(t, restored, "bar", "bar")
+	restored.Close()
+	db.Close()
+}
@@ -0,0 +1,97 @@
+package kvStore
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// Changes to several keys, written to the store as one record on Commit so
+// that either all of them are made or, after a crash, none are.
+type Transaction struct {
+	db *DB
+	writes map[string][]byte
+	deletes map[string]bool
+}
+
+func (db *DB) Begin() *Transaction {
+	return &Transaction{db: db, writes: make(map[string][]byte), deletes: make(map[string]bool)}
+}
+
+func (tx *Transaction) Write(key string, value []byte) {
+	delete(tx.deletes, key)
+	tx.writes[key] = value
+}
+
+func (tx *Transaction) Delete(key string) {
+	delete(tx.writes, key)
+	tx.deletes[key] = true
+}
+
+// Load a value as it will be once the transaction is committed.
+func (tx *Transaction) Load(key string) ([]byte, error) {
+	if value, ok := tx.writes[key]; ok {
+		return value, nil
+	}
+	if tx.deletes[key] {
+		return nil, os.ErrNotExist
+	}
+	return tx.db.Load(key)
+}
+
+// Make every change. Deleting a key that does not exist is not an error.
+func (tx *Transaction) Commit() error {
+	var deletes []string
+	for key := range tx.deletes {
+		deletes = append(deletes, key)
+	}
+	sort.Strings(deletes)
+	tx.db.mutex.Lock()
+	defer tx.db.mutex.Unlock()
+	return tx.db.commit(tx.writes, deletes)
+}
+
+// The values of a store as they were when the snapshot was taken, however
+// the store changes or is compacted afterwards.
+type Snapshot struct {
+	db *DB
+	file *file
+	index map[string]entry
+}
+
+func (db *DB) Snapshot() (*Snapshot, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err := db.refresh(); err != nil {
+		return nil, err
+	}
+	index := make(map[string]entry, len(db.index))
+	for key, e := range db.index {
+		index[key] = e
+	}
+	db.file.refs++
+	return &Snapshot{db: db, file: db.file, index: index}, nil
+}
+
+func (s *Snapshot) Load(key string) ([]byte, error) {
+	return load(s.file, s.index, key)
+}
+
+// Keys starting with prefix, sorted.
+func (s *Snapshot) Keys(prefix string) []string {
+	return keys(s.index, prefix)
+}
+
+// Write the snapshot as a compacted store file, which can be opened as a
+// store to restore it.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	return writeValues(w, s.file, s.index)
+}
+
+// Release the file the snapshot reads from.
+func (s *Snapshot) Close() error {
+	s.db.mutex.Lock()
+	defer s.db.mutex.Unlock()
+	s.file.release()
+	return nil
+}
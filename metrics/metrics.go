@@ -0,0 +1,239 @@
+/*
+ * The purpose of this package is to collect counters, gauges and
+ * histograms and render them in the Prometheus text exposition format.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Buckets used for latency histograms, in seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []collector
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+type GaugeVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (reg *Registry) register(c collector) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	reg.collectors = append(reg.collectors, c)
+}
+
+func (reg *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	reg.register(c)
+	return c
+}
+
+func (reg *Registry) NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	reg.register(g)
+	return g
+}
+
+func (reg *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	reg.register(h)
+	return h
+}
+
+func (c *CounterVec) Add(value float64, label_values ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[joinLabelValues(label_values)] += value
+}
+
+func (c *CounterVec) Inc(label_values ...string) {
+	c.Add(1, label_values...)
+}
+
+func (g *GaugeVec) Add(value float64, label_values ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[joinLabelValues(label_values)] += value
+}
+
+func (g *GaugeVec) Set(value float64, label_values ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[joinLabelValues(label_values)] = value
+}
+
+func (h *HistogramVec) Observe(value float64, label_values ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := joinLabelValues(label_values)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+// Write every registered metric to w in the text exposition format.
+func (reg *Registry) Write(w io.Writer) {
+	reg.mutex.Lock()
+	collectors := append([]collector{}, reg.collectors...)
+	reg.mutex.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		reg.Write(w)
+	})
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatValue(c.values[key]))
+	}
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, key, "", ""), formatValue(g.values[key]))
+	}
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatValue(bound)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatValue(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), hist.count)
+	}
+}
+
+// =============== Helper functions ================= //
+
+// Label values are kept in a single map key separated by a byte that
+// can not appear in a valid UTF-8 label value.
+const labelSeparator = "\xff"
+
+func joinLabelValues(label_values []string) string {
+	return strings.Join(label_values, labelSeparator)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w io.Writer, name string, help string, metric_type string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.Replace(help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metric_type)
+}
+
+// Label values escape only backslash, double quote and line feed.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, key string, extra_name string, extra_value string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(key, labelSeparator)
+		for i, name := range names {
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			pairs = append(pairs, name+"=\""+labelEscaper.Replace(value)+"\"")
+		}
+	}
+	if extra_name != "" {
+		pairs = append(pairs, extra_name+"=\""+labelEscaper.Replace(extra_value)+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Test:
+//	that counters, gauges and histograms are rendered in the text format
+//	that label values only escape backslash, double quote and line feed
+func TestWrite(t *testing.T) {
+	reg := NewRegistry()
+	counter := reg.NewCounterVec("test_requests_total", "Requests.", "code")
+	gauge := reg.NewGaugeVec("test_in_flight", "In flight.", "route")
+	histogram := reg.NewHistogramVec("test_duration_seconds", "Duration.", []float64{0.1, 1}, "op")
+
+	counter.Inc("200")
+	counter.Inc("200")
+	counter.Inc("400")
+	gauge.Add(1, "/sites")
+	gauge.Set(2, "café \"x\"\\\n")
+	histogram.Observe(0.5, "load")
+
+	var buf bytes.Buffer
+	reg.Write(&buf)
+	output := buf.String()
+
+	expected := []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{code="200"} 2`,
+		`test_requests_total{code="400"} 1`,
+		`test_in_flight{route="/sites"} 1`,
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{op="load",le="0.1"} 0`,
+		`test_duration_seconds_bucket{op="load",le="1"} 1`,
+		`test_duration_seconds_bucket{op="load",le="+Inf"} 1`,
+		`test_duration_seconds_sum{op="load"} 0.5`,
+		`test_duration_seconds_count{op="load"} 1`,
+		`test_in_flight{route="café \"x\"\\\n"} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line+"\n") {
+			t.Error("Expected line: ", line, " missing from output:\n", output)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * The purpose of this package is to check in the background whether the
+ * Urls of access points can be reached, keeping recent results for each.
+ */
+
+package prober
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access point statuses, and site statuses from Rollup.
+const (
+	Up = "up"
+	Down = "down"
+	// Not checked yet, or the Url is not something that can be checked.
+	Unknown = "unknown"
+	// Some access points of a site are up and some are down.
+	Degraded = "degraded"
+)
+
+type Config struct {
+	Interval time.Duration
+	Timeout time.Duration
+	// Number of checks made at the same time.
+	Concurrency int
+	// Number of results kept per access point.
+	HistorySize int
+}
+
+// An access point to check.
+type Target struct {
+	Site string
+	Label string
+	Url string
+}
+
+// The result of one check.
+type Sample struct {
+	CheckedAt time.Time
+	Status string
+	LatencyMs float64
+	Error string `json:",omitempty"`
+}
+
+// The latest result for an access point and the ones before it, oldest
+// first.
+type Health struct {
+	Site string
+	Label string
+	Url string
+	Status string
+	CheckedAt *time.Time `json:",omitempty"`
+	LatencyMs float64
+	Error string `json:",omitempty"`
+	History []Sample `json:",omitempty"`
+}
+
+type SiteHealth struct {
+	Site string
+	Status string
+	Up int
+	Down int
+	Unknown int
+	Access_points []Health
+}
+
+type Prober struct {
+	config Config
+	targets func() ([]Target, error)
+	client *http.Client
+
+	mutex sync.Mutex
+	health map[string]*Health
+}
+
+// A prober that checks the access points returned by targets.
+func New(config Config, targets func() ([]Target, error)) *Prober {
+	client := &http.Client{
+		Timeout: config.Timeout,
+		// A redirect means the Url answered.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &Prober{config: config, targets: targets, client: client, health: make(map[string]*Health)}
+}
+
+// Check every access point each Interval until ctx is done.
+func (p *Prober) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		p.CheckAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check every access point once. Results for access points that no
+// longer exist are dropped.
+func (p *Prober) CheckAll(ctx context.Context) error {
+	targets, err := p.targets()
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool)
+	for _, target := range targets {
+		current[key(target.Site, target.Label)] = true
+	}
+	p.mutex.Lock()
+	for k := range p.health {
+		if !current[k] {
+			delete(p.health, k)
+		}
+	}
+	p.mutex.Unlock()
+
+	concurrency := p.config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan bool, concurrency)
+	var wait sync.WaitGroup
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		slots <- true
+		wait.Add(1)
+		go func(target Target) {
+			defer wait.Done()
+			defer func() { <-slots }()
+			p.record(target, p.Check(ctx, target.Url))
+		}(target)
+	}
+	wait.Wait()
+	return nil
+}
+
+// Check one Url: a HEAD request, or GET if HEAD is not allowed, for http
+// and https, otherwise a TCP connection to its host and port.
+func (p *Prober) Check(ctx context.Context, raw string) Sample {
+	start := time.Now()
+	sample := Sample{CheckedAt: start.UTC(), Status: Down}
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		sample.Status = Unknown
+		sample.Error = "Url can not be checked"
+		return sample
+	}
+
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https":
+		code, err := p.request(ctx, "HEAD", raw)
+		if err == nil && (code == http.StatusMethodNotAllowed || code == http.StatusNotImplemented) {
+			code, err = p.request(ctx, "GET", raw)
+		}
+		if err != nil {
+			sample.Error = err.Error()
+		} else if code >= 500 {
+			sample.Error = http.StatusText(code)
+		} else {
+			sample.Status = Up
+		}
+	default:
+		port := parsed.Port()
+		if port == "" {
+			port = defaultPorts[strings.ToLower(parsed.Scheme)]
+		}
+		if port == "" {
+			sample.Status = Unknown
+			sample.Error = "No port to check for scheme " + parsed.Scheme
+			return sample
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(parsed.Hostname(), port))
+		if err != nil {
+			sample.Error = err.Error()
+		} else {
+			conn.Close()
+			sample.Status = Up
+		}
+	}
+	sample.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	return sample
+}
+
+var defaultPorts = map[string]string{
+	"ftp": "21",
+	"ssh": "22",
+	"ws": "80",
+	"wss": "443",
+}
+
+func (p *Prober) request(ctx context.Context, method string, raw string) (int, error) {
+	req, err := http.NewRequest(method, raw, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func (p *Prober) record(target Target, sample Sample) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	k := key(target.Site, target.Label)
+	health, ok := p.health[k]
+	if !ok || health.Url != target.Url {
+		// A changed Url starts a new history.
+		health = &Health{Site: target.Site, Label: target.Label, Url: target.Url}
+		p.health[k] = health
+	}
+	health.Status = sample.Status
+	health.CheckedAt = &sample.CheckedAt
+	health.LatencyMs = sample.LatencyMs
+	health.Error = sample.Error
+	health.History = append(health.History, sample)
+	if p.config.HistorySize > 0 && len(health.History) > p.config.HistorySize {
+		health.History = health.History[len(health.History) - p.config.HistorySize:]
+	}
+}
+
+// The health of an access point with Url url. Access points that have not
+// been checked yet, or whose Url changed since, are Unknown.
+func (p *Prober) Status(site string, label string, url string) Health {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	health, ok := p.health[key(site, label)]
+	if !ok || health.Url != url {
+		return Health{Site: site, Label: label, Url: url, Status: Unknown}
+	}
+	copied := *health
+	copied.History = append([]Sample{}, health.History...)
+	return copied
+}
+
+// Summarise the health of a site's access points: Degraded if some are up
+// and some down, otherwise Up or Down if any are, otherwise Unknown.
+func Rollup(site string, access_points []Health) SiteHealth {
+	rollup := SiteHealth{Site: site, Access_points: access_points}
+	for i := range rollup.Access_points {
+		switch rollup.Access_points[i].Status {
+		case Up:
+			rollup.Up++
+		case Down:
+			rollup.Down++
+		default:
+			rollup.Unknown++
+		}
+		// Only the latest result of each is listed.
+		rollup.Access_points[i].History = nil
+	}
+	switch {
+	case rollup.Down > 0 && rollup.Up > 0:
+		rollup.Status = Degraded
+	case rollup.Down > 0:
+		rollup.Status = Down
+	case rollup.Up > 0:
+		rollup.Status = Up
+	default:
+		rollup.Status = Unknown
+	}
+	return rollup
+}
+
+func key(site string, label string) string {
+	return site + "/" + label
+}
@@ -0,0 +1,89 @@
+package prober
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testConfig = Config{Interval: time.Hour, Timeout: time.Second, Concurrency: 2, HistorySize: 2}
+
+// Test:
+//	that reachable Urls are up and unreachable ones down
+//	that only the last HistorySize results are kept
+func TestCheckAll(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	// Only answers GET, so the HEAD check falls back to it.
+	get_only := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer get_only.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed_address := closed.Addr().String()
+	closed.Close()
+
+	targets := []Target{
+		{"foo", "up", up.URL},
+		{"foo", "getonly", get_only.URL},
+		{"foo", "failing", failing.URL},
+		{"foo", "tcp", "tcp://" + listener.Addr().String()},
+		{"foo", "closed", "tcp://" + closed_address},
+		{"foo", "text", "Harry Potter"},
+	}
+	prober := New(testConfig, func() ([]Target, error) { return targets, nil })
+	for i := 0; i < 3; i++ {
+		prober.CheckAll(context.Background())
+	}
+
+	expected := map[string]string{"up": Up, "getonly": Up, "failing": Down, "tcp": Up, "closed": Down, "text": Unknown}
+	var access_points []Health
+	for _, target := range targets {
+		health := prober.Status(target.Site, target.Label, target.Url)
+		if health.Status != expected[target.Label] {
+			t.Error(target.Label, ": status ", health.Status, ", expected ", expected[target.Label], " ", health.Error)
+		}
+		if len(health.History) != 2 {
+			t.Error(target.Label, ": history has ", len(health.History), " results, expected 2")
+		}
+		access_points = append(access_points, health)
+	}
+
+	if rollup := Rollup("foo", access_points); rollup.Status != Degraded || rollup.Up != 3 || rollup.Down != 2 || rollup.Unknown != 1 {
+		t.Error("Unexpected rollup: ", rollup)
+	}
+	if health := prober.Status("foo", "up", "http://changed.example"); health.Status != Unknown {
+		t.Error("A changed Url should not have a status yet")
+	}
+
+	targets = targets[:1]
+	prober.CheckAll(context.Background())
+	if health := prober.Status("foo", "tcp", "tcp://" + listener.Addr().String()); health.Status != Unknown {
+		t.Error("Results of removed access points should be dropped")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	prober := New(Config{Timeout: 50 * time.Millisecond}, nil)
+	if sample := prober.Check(context.Background(), slow.URL); sample.Status != Down {
+		t.Error("Expected a timed out check to be down, got ", sample.Status)
+	}
+}
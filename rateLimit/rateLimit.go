@@ -0,0 +1,152 @@
+/*
+ * The purpose of this package is to limit how quickly clients can make
+ * requests and how many expensive requests can run at the same time.
+ */
+
+package rateLimit
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Buckets are refilled at Rate tokens per second up to Burst tokens.
+type Config struct {
+	Rate float64
+	Burst int
+}
+
+// A token bucket limiter with one bucket per client key.
+type Limiter struct {
+	config Config
+	mutex sync.Mutex
+	buckets map[string]*bucket
+	now func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last time.Time
+}
+
+// Result of asking a Limiter for a token.
+type Decision struct {
+	Allowed bool
+	Limit int
+	Remaining int
+	// Time until the next token is available.
+	RetryAfter time.Duration
+	// Time until the bucket is full again.
+	Reset time.Duration
+}
+
+// Stale buckets are pruned once this many clients are being tracked, and
+// if that is not enough the least recently used are dropped.
+const maxTrackedKeys = 10000
+
+func NewLimiter(config Config) *Limiter {
+	return &Limiter{config: config, buckets: make(map[string]*bucket), now: time.Now}
+}
+
+func (l *Limiter) SetClock(now func() time.Time) {
+	l.now = now
+}
+
+// Take a token from the bucket for key if one is available.
+func (l *Limiter) Allow(key string) Decision {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxTrackedKeys {
+			l.prune(now)
+		}
+		b = &bucket{tokens: float64(l.config.Burst), last: now}
+		l.buckets[key] = b
+	} else {
+		l.refill(b, now)
+	}
+
+	decision := Decision{Limit: l.config.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = l.timeFor(1 - b.tokens)
+	}
+	decision.Remaining = int(math.Floor(b.tokens))
+	decision.Reset = l.timeFor(float64(l.config.Burst) - b.tokens)
+	return decision
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(l.config.Burst), b.tokens + elapsed * l.config.Rate)
+		b.last = now
+	}
+}
+
+func (l *Limiter) timeFor(tokens float64) time.Duration {
+	if tokens <= 0 || l.config.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / l.config.Rate * float64(time.Second))
+}
+
+// Remove buckets that have refilled completely, they carry no state. If
+// most are still in use, drop the least recently used down to nine tenths
+// of maxTrackedKeys so that pruning is not needed again straight away.
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.config.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	keep := maxTrackedKeys * 9 / 10
+	if len(l.buckets) <= keep {
+		return
+	}
+	keys := make([]string, 0, len(l.buckets))
+	for key := range l.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return l.buckets[keys[i]].last.Before(l.buckets[keys[j]].last)
+	})
+	for _, key := range keys[:len(keys) - keep] {
+		delete(l.buckets, key)
+	}
+}
+
+// Caps the number of operations that can run at the same time.
+type ConcurrencyLimiter struct {
+	slots chan struct{}
+}
+
+func NewConcurrencyLimiter(max int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{slots: make(chan struct{}, max)}
+}
+
+// Claim a slot without waiting, returns false if all slots are in use.
+func (c *ConcurrencyLimiter) TryAcquire() bool {
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *ConcurrencyLimiter) Release() {
+	<-c.slots
+}
+
+func (c *ConcurrencyLimiter) Limit() int {
+	return cap(c.slots)
+}
@@ -0,0 +1,111 @@
+package rateLimit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Test:
+//	that a client can use its burst and is then limited
+//	that tokens are refilled over time
+//	that clients have separate buckets
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewLimiter(Config{Rate: 1, Burst: 2})
+	limiter.SetClock(func() time.Time { return now })
+
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow("a").Allowed {
+			t.Error("Request ", i, " within burst was limited")
+		}
+	}
+
+	decision := limiter.Allow("a")
+	if decision.Allowed {
+		t.Error("Request over burst was allowed")
+	}
+	if decision.RetryAfter != time.Second || decision.Remaining != 0 {
+		t.Error("Unexpected decision: ", decision)
+	}
+
+	if !limiter.Allow("b").Allowed {
+		t.Error("Separate client was limited")
+	}
+
+	now = now.Add(time.Second)
+	if !limiter.Allow("a").Allowed {
+		t.Error("Request after refill was limited")
+	}
+}
+
+// Test:
+//	that the number of buckets stays bounded however many clients there are
+//	that the most recently used buckets are kept
+func TestLimiterBounded(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewLimiter(Config{Rate: 1, Burst: 2})
+	limiter.SetClock(func() time.Time { return now })
+	for i := 0; i < 3 * maxTrackedKeys; i++ {
+		now = now.Add(time.Millisecond)
+		limiter.Allow(strconv.Itoa(i))
+	}
+	if len(limiter.buckets) > maxTrackedKeys {
+		t.Error("Unexpected number of buckets: ", len(limiter.buckets))
+	}
+	if _, ok := limiter.buckets[strconv.Itoa(3 * maxTrackedKeys - 1)]; !ok {
+		t.Error("Most recently used bucket was dropped")
+	}
+}
+
+// Test:
+//	that only the configured number of slots can be held at once
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := NewConcurrencyLimiter(1)
+	if !limiter.TryAcquire() {
+		t.Error("First acquire failed")
+	}
+	if limiter.TryAcquire() {
+		t.Error("Second acquire succeeded while slot was held")
+	}
+	limiter.Release()
+	if !limiter.TryAcquire() {
+		t.Error("Acquire after release failed")
+	}
+}
+
+// Test:
+//	that route limits are read from a file
+//	that limits which can not be applied are refused
+func TestLoadRoutes(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rateLimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "rate-limits.json")
+
+	valid := `{"Default": {"Read": {"Rate": 50, "Burst": 100}}, "Routes": {"/sites": {"Concurrency": 4}, "/metrics": {"Unlimited": true}}}`
+	ioutil.WriteFile(path, []byte(valid), 0644)
+	config, err := LoadRoutes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Default.Read.Burst != 100 || config.Routes["/sites"].Concurrency != 4 || !config.Routes["/metrics"].Unlimited {
+		t.Errorf("Limits were not read: %+v", config)
+	}
+
+	for _, invalid := range []string{
+		`{"Default": {"Write": {"Rate": 0, "Burst": 1}}}`,
+		`{"Routes": {"/sites": {"Concurrency": -1}}}`,
+		`{"Routes": {"/sites": {"Limit": 1}}}`,
+	} {
+		ioutil.WriteFile(path, []byte(invalid), 0644)
+		if _, err := LoadRoutes(path); err == nil {
+			t.Error("Limits were accepted: " + invalid)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package rateLimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+)
+
+// Limits of one route. Reads are GET and HEAD requests, everything else
+// is a write.
+type RouteConfig struct {
+	// Nil falls back to the Default of the RoutesConfig.
+	Read *Config
+	Write *Config
+	// Caps concurrent reads, 0 for no cap.
+	Concurrency int
+	// Not rate limited at all, rather than falling back to the Default.
+	Unlimited bool
+}
+
+// Limits by route template. Routes share the buckets of the Default for
+// the limits they do not set.
+type RoutesConfig struct {
+	Default RouteConfig
+	Routes map[string]RouteConfig
+}
+
+// Read route limits from a JSON file, checking that they can be applied.
+func LoadRoutes(path string) (*RoutesConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &RoutesConfig{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
+	if err == nil {
+		err = config.check()
+	}
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return config, nil
+}
+
+func (config *RoutesConfig) check() error {
+	err := config.Default.check()
+	if err != nil {
+		return errors.New("Default: " + err.Error())
+	}
+	for template, route := range config.Routes {
+		err = route.check()
+		if err != nil {
+			return errors.New(template + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (route RouteConfig) check() error {
+	for _, config := range []*Config{route.Read, route.Write} {
+		if config != nil && (config.Rate <= 0 || config.Burst < 1) {
+			return errors.New("Rate and Burst must be positive")
+		}
+	}
+	if route.Concurrency < 0 {
+		return errors.New("Concurrency can not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package representation
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// CSV rows are flat, so the first list of objects in a resource (the
+// access points of a site) is expanded into one row per item with columns
+// named "Access_points.Label". The other fields are repeated on each row.
+// Values that are neither scalars nor expanded are written as JSON.
+
+type csvColumn struct {
+	name string
+	// Set for the columns of the expanded list.
+	child string
+}
+
+func csvColumns(t reflect.Type) []csvColumn {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct || reflect.PtrTo(t).Implements(textUnmarshaler) {
+		return []csvColumn{{name: "Value"}}
+	}
+
+	var columns []csvColumn
+	expanded := false
+	for _, field := range jsonFields(t) {
+		elem := field.typ
+		if !expanded && elem.Kind() == reflect.Slice {
+			elem = elem.Elem()
+			for elem.Kind() == reflect.Ptr {
+				elem = elem.Elem()
+			}
+			if elem.Kind() == reflect.Struct && !reflect.PtrTo(elem).Implements(textUnmarshaler) {
+				expanded = true
+				for _, child := range jsonFields(elem) {
+					columns = append(columns, csvColumn{field.name, child.name})
+				}
+				continue
+			}
+		}
+		columns = append(columns, csvColumn{name: field.name})
+	}
+	return columns
+}
+
+func (c csvColumn) header() string {
+	if c.child != "" {
+		return c.name + "." + c.child
+	}
+	return c.name
+}
+
+type csvListWriter struct {
+	writer *csv.Writer
+	columns []csvColumn
+}
+
+func newCSVListWriter(w io.Writer, t reflect.Type) *csvListWriter {
+	list := &csvListWriter{writer: csv.NewWriter(w), columns: csvColumns(t)}
+	var header []string
+	for _, column := range list.columns {
+		header = append(header, column.header())
+	}
+	list.writer.Write(header)
+	return list
+}
+
+func (list *csvListWriter) write(item interface{}) error {
+	generic, err := toGeneric(item)
+	if err != nil {
+		return err
+	}
+	o, ok := generic.(object)
+	if !ok {
+		o = object{{"Value", generic}}
+	}
+
+	// Find the items of the expanded list, if there is one.
+	var children []interface{}
+	for _, column := range list.columns {
+		if column.child != "" {
+			children, _ = lookup(o, column.name).([]interface{})
+			break
+		}
+	}
+	if len(children) == 0 {
+		children = []interface{}{nil}
+	}
+
+	for _, child := range children {
+		child_object, _ := child.(object)
+		var row []string
+		for _, column := range list.columns {
+			if column.child != "" {
+				row = append(row, csvCell(lookup(child_object, column.child)))
+			} else {
+				row = append(row, csvCell(lookup(o, column.name)))
+			}
+		}
+		if err := list.writer.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (list *csvListWriter) flush() error {
+	list.writer.Flush()
+	return list.writer.Error()
+}
+
+func encodeCSV(w io.Writer, v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() == reflect.Slice {
+		list := newCSVListWriter(w, value.Type().Elem())
+		for i := 0; i < value.Len(); i++ {
+			if err := list.write(value.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return list.flush()
+	}
+
+	list := newCSVListWriter(w, reflect.TypeOf(v))
+	if err := list.write(v); err != nil {
+		return err
+	}
+	return list.flush()
+}
+
+func lookup(o object, key string) interface{} {
+	for _, m := range o {
+		if m.Key == key {
+			return m.Value
+		}
+	}
+	return nil
+}
+
+func csvCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		return string(bytes.TrimSpace(mustJson(v)))
+	}
+}
+
+// Read rows back into objects. Consecutive rows with the same values in
+// the plain columns belong to the same object. A target that is not a
+// slice gets the first object.
+func decodeCSV(r io.Reader, target reflect.Type) (interface{}, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, errors.New("CSV needs a header row and at least one data row")
+	}
+	header := records[0]
+	plain_columns := make(map[string]bool)
+	for _, name := range header {
+		if !strings.Contains(name, ".") {
+			plain_columns[name] = true
+		}
+	}
+	for _, name := range header {
+		if dot := strings.Index(name, "."); dot > 0 && plain_columns[name[:dot]] {
+			return nil, errors.New("CSV column " + name[:dot] + " is both a plain column and a list")
+		}
+	}
+
+	var items []interface{}
+	var previous []string
+	for _, record := range records[1:] {
+		var plain []string
+		parent := object{}
+		child := object{}
+		var list_name string
+		for i, name := range header {
+			cell := ""
+			if i < len(record) {
+				cell = record[i]
+			}
+			if dot := strings.Index(name, "."); dot > 0 {
+				list_name = name[:dot]
+				if cell != "" {
+					child = append(child, member{name[dot + 1:], csvValue(cell)})
+				}
+			} else {
+				plain = append(plain, cell)
+				parent = append(parent, member{name, csvValue(cell)})
+			}
+		}
+
+		if len(items) > 0 && equalStrings(plain, previous) {
+			if len(child) > 0 {
+				last := items[len(items) - 1].(object)
+				for i, m := range last {
+					if m.Key != list_name {
+						continue
+					}
+					children, ok := m.Value.([]interface{})
+					if !ok {
+						return nil, errors.New("CSV column " + list_name + " is not a list")
+					}
+					last[i].Value = append(children, child)
+				}
+			}
+			continue
+		}
+
+		if list_name != "" {
+			children := []interface{}{}
+			if len(child) > 0 {
+				children = append(children, child)
+			}
+			parent = append(parent, member{list_name, children})
+		}
+		items = append(items, parent)
+		previous = plain
+	}
+
+	for target.Kind() == reflect.Ptr {
+		target = target.Elem()
+	}
+	if target.Kind() == reflect.Slice {
+		return items, nil
+	}
+	if o, ok := items[0].(object); ok && len(header) == 1 && header[0] == "Value" {
+		return lookup(o, "Value"), nil
+	}
+	return items[0], nil
+}
+
+// Cells holding JSON objects or lists are read back into that structure.
+func csvValue(cell string) interface{} {
+	if strings.HasPrefix(cell, "{") || strings.HasPrefix(cell, "[") {
+		decoder := json.NewDecoder(strings.NewReader(cell))
+		decoder.UseNumber()
+		if value, err := readGeneric(decoder); err == nil {
+			return value
+		}
+	}
+	return cell
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
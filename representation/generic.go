@@ -0,0 +1,218 @@
+package representation
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Values are converted to a generic form of objects, lists and scalars
+// by way of encoding/json, so every format honours the same json tags.
+// Objects keep their keys in the order encoding/json wrote them.
+type member struct {
+	Key string
+	Value interface{}
+}
+
+type object []member
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, m := range o {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		key, err := json.Marshal(m.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(value)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+func toGeneric(v interface{}) (interface{}, error) {
+	json_data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(json_data))
+	decoder.UseNumber()
+	return readGeneric(decoder)
+}
+
+func readGeneric(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		o := object{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readGeneric(decoder)
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, member{key.(string), value})
+		}
+		_, err = decoder.Token()
+		return o, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for decoder.More() {
+			value, err := readGeneric(decoder)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = decoder.Token()
+		return list, err
+	default:
+		return token, nil
+	}
+}
+
+// A struct field as encoding/json sees it.
+type jsonField struct {
+	name string
+	typ reflect.Type
+}
+
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(embedded)...)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, jsonField{name, field.Type})
+	}
+	return fields
+}
+
+var textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Convert the string scalars produced by the text formats into the types
+// that t expects, so that e.g. a YAML port number can fill an int field.
+func coerce(value interface{}, t reflect.Type) interface{} {
+	if value == nil {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(textUnmarshaler) {
+		// Types such as time.Time read themselves from strings.
+		return value
+	}
+
+	text, is_text := value.(string)
+	switch t.Kind() {
+	case reflect.String:
+		if number, ok := value.(json.Number); ok {
+			return number.String()
+		}
+		return value
+	case reflect.Bool:
+		if is_text {
+			if text == "" {
+				return nil
+			}
+			if b, err := strconv.ParseBool(text); err == nil {
+				return b
+			}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if is_text {
+			if text == "" {
+				return nil
+			}
+			if _, err := strconv.ParseFloat(text, 64); err == nil {
+				return json.Number(text)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		switch v := value.(type) {
+		case []interface{}:
+			list := make([]interface{}, len(v))
+			for i, item := range v {
+				list[i] = coerce(item, t.Elem())
+			}
+			return list
+		case string:
+			if v == "" {
+				return []interface{}{}
+			}
+		}
+		// A single XML element or CSV cell stands for a one item list.
+		return []interface{}{coerce(value, t.Elem())}
+	case reflect.Map:
+		if o, ok := value.(object); ok {
+			coerced := object{}
+			for _, m := range o {
+				coerced = append(coerced, member{m.Key, coerce(m.Value, t.Elem())})
+			}
+			return coerced
+		}
+		if is_text && text == "" {
+			return nil
+		}
+	case reflect.Struct:
+		if o, ok := value.(object); ok {
+			fields := jsonFields(t)
+			coerced := object{}
+			for _, m := range o {
+				var value interface{} = m.Value
+				for _, field := range fields {
+					if strings.EqualFold(field.name, m.Key) {
+						value = coerce(m.Value, field.typ)
+						break
+					}
+				}
+				coerced = append(coerced, member{m.Key, value})
+			}
+			return coerced
+		}
+		if is_text && text == "" {
+			return nil
+		}
+	}
+	return value
+}
@@ -0,0 +1,237 @@
+/*
+ * The purpose of this package is to convert resources to and from the
+ * representations clients can ask for: JSON, NDJSON, YAML, XML and CSV.
+ */
+
+package representation
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Format string
+
+const (
+	JSON Format = "application/json"
+	NDJSON Format = "application/x-ndjson"
+	YAML Format = "application/yaml"
+	XML Format = "application/xml"
+	CSV Format = "text/csv"
+)
+
+// Other media types clients use for the formats above.
+var aliases = map[string]Format{
+	"application/json": JSON,
+	"text/json": JSON,
+	"application/x-ndjson": NDJSON,
+	"application/jsonl": NDJSON,
+	"application/yaml": YAML,
+	"application/x-yaml": YAML,
+	"text/yaml": YAML,
+	"text/x-yaml": YAML,
+	"application/xml": XML,
+	"text/xml": XML,
+	"text/csv": CSV,
+}
+
+func (f Format) ContentType() string {
+	if f == CSV {
+		return string(f) + "; charset=utf-8"
+	}
+	return string(f)
+}
+
+// Pick the response format from an Accept header, defaulting to JSON.
+func Negotiate(accept string) Format {
+	type candidate struct {
+		format Format
+		quality float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		media_type, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		if format, ok := aliases[media_type]; ok {
+			candidates = append(candidates, candidate{format, quality})
+		} else if media_type == "*/*" || media_type == "application/*" {
+			candidates = append(candidates, candidate{JSON, quality})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return JSON
+	}
+	// Stable, so earlier types win between equal qualities.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+	return candidates[0].format
+}
+
+// Pick the request body format from a Content-Type header, defaulting
+// to JSON.
+func ForContentType(content_type string) Format {
+	media_type, _, err := mime.ParseMediaType(content_type)
+	if err != nil {
+		return JSON
+	}
+	if format, ok := aliases[media_type]; ok {
+		return format
+	}
+	return JSON
+}
+
+// Write a single value in the given format.
+func Encode(w io.Writer, format Format, v interface{}) error {
+	switch format {
+	case YAML:
+		return encodeYAML(w, v)
+	case XML:
+		return encodeXML(w, rootName(v), v)
+	case CSV:
+		return encodeCSV(w, v)
+	default:
+		return json.NewEncoder(w).Encode(v)
+	}
+}
+
+// Read a single value in the given format into the struct pointed to by v.
+func Decode(r io.Reader, format Format, v interface{}) error {
+	if format == JSON || format == NDJSON {
+		return json.NewDecoder(r).Decode(v)
+	}
+
+	target := reflect.TypeOf(v)
+	if target == nil || target.Kind() != reflect.Ptr {
+		return errors.New("Can only decode into a pointer")
+	}
+
+	var generic interface{}
+	var err error
+	switch format {
+	case YAML:
+		generic, err = decodeYAML(r)
+	case XML:
+		generic, err = decodeXML(r)
+	case CSV:
+		generic, err = decodeCSV(r, target.Elem())
+	default:
+		return errors.New("Unsupported format: " + string(format))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Plain scalars are read as strings, convert them to what the
+	// target expects before handing over to encoding/json.
+	json_data, err := json.Marshal(coerce(generic, target.Elem()))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(json_data, v)
+}
+
+// Writes a listing one item at a time in the given format.
+type ListEncoder struct {
+	w io.Writer
+	format Format
+	root string
+	count int
+	csv *csvListWriter
+}
+
+// Root is the name of the enclosing element for XML listings.
+func NewListEncoder(w io.Writer, format Format, root string) *ListEncoder {
+	return &ListEncoder{w: w, format: format, root: root}
+}
+
+func (list *ListEncoder) Write(item interface{}) error {
+	first := list.count == 0
+	list.count++
+	switch list.format {
+	case NDJSON:
+		return json.NewEncoder(list.w).Encode(item)
+	case YAML:
+		return encodeYAMLListItem(list.w, item)
+	case XML:
+		if first {
+			io.WriteString(list.w, "<" + list.root + ">")
+		}
+		return encodeXML(list.w, rootName(item), item)
+	case CSV:
+		if first {
+			list.csv = newCSVListWriter(list.w, reflect.TypeOf(item))
+		}
+		return list.csv.write(item)
+	default:
+		if first {
+			io.WriteString(list.w, "[")
+		} else {
+			io.WriteString(list.w, ",")
+		}
+		return json.NewEncoder(list.w).Encode(item)
+	}
+}
+
+func (list *ListEncoder) Close() error {
+	switch list.format {
+	case YAML:
+		if list.count == 0 {
+			_, err := io.WriteString(list.w, "[]\n")
+			return err
+		}
+	case XML:
+		if list.count == 0 {
+			_, err := io.WriteString(list.w, "<" + list.root + "></" + list.root + ">\n")
+			return err
+		}
+		_, err := io.WriteString(list.w, "</" + list.root + ">\n")
+		return err
+	case CSV:
+		if list.csv != nil {
+			return list.csv.flush()
+		}
+	case NDJSON:
+	default:
+		if list.count == 0 {
+			io.WriteString(list.w, "[")
+		}
+		_, err := io.WriteString(list.w, "]\n")
+		return err
+	}
+	return nil
+}
+
+func (list *ListEncoder) Count() int {
+	return list.count
+}
+
+func rootName(v interface{}) string {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Name() == "" {
+		return "Value"
+	}
+	return t.Name()
+}
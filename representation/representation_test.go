@@ -0,0 +1,108 @@
+package representation
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testAccessPoint struct {
+	Label string
+	Url string
+}
+
+type testSite struct {
+	Name string
+	Port int
+	Access_points []testAccessPoint
+}
+
+var exampleSite = testSite{"foo", 80, []testAccessPoint{{"a", "http://a.com"}, {"b", "#: tricky"}}}
+
+// Test:
+//	that a site survives being encoded and decoded in every format
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []Format{JSON, YAML, XML, CSV} {
+		var buf bytes.Buffer
+		err := Encode(&buf, format, exampleSite)
+		if err != nil {
+			t.Error(format, ": error encoding: ", err)
+			continue
+		}
+
+		var decoded testSite
+		err = Decode(&buf, format, &decoded)
+		if err != nil {
+			t.Error(format, ": error decoding: ", err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, exampleSite) {
+			t.Error(format, ": decoded: ", decoded, " does not match: ", exampleSite)
+		}
+	}
+}
+
+// Test:
+//	that hand written YAML with comments, quoting and nesting is read
+func TestDecodeYAML(t *testing.T) {
+	input := `
+# A site
+Name: foo   # trailing comment
+Port: "80"
+Access_points:
+- Label: a
+  Url: 'http://a.com'
+- {Label: b, Url: "#: tricky"}
+`
+	var decoded testSite
+	err := Decode(strings.NewReader(input), YAML, &decoded)
+	if err != nil {
+		t.Error("Error decoding: ", err)
+		return
+	}
+	if !reflect.DeepEqual(decoded, exampleSite) {
+		t.Error("Decoded: ", decoded, " does not match: ", exampleSite)
+	}
+}
+
+// Test:
+//	that access points are flattened into one CSV row each
+func TestEncodeCSV(t *testing.T) {
+	var buf bytes.Buffer
+	Encode(&buf, CSV, exampleSite)
+	expected := "Name,Port,Access_points.Label,Access_points.Url\n" +
+		"foo,80,a,http://a.com\n" +
+		"foo,80,b,#: tricky\n"
+	if buf.String() != expected {
+		t.Error("CSV output:\n", buf.String(), " does not match expected:\n", expected)
+	}
+}
+
+// Test:
+//	that a column that is both plain and a list is refused, not a panic
+func TestDecodeCSVConflictingColumns(t *testing.T) {
+	input := "Access_points,Access_points.Label\nx,a\nx,b\n"
+	var decoded testSite
+	if err := Decode(strings.NewReader(input), CSV, &decoded); err == nil {
+		t.Error("Conflicting columns were decoded: ", decoded)
+	}
+}
+
+// Test:
+//	that the Accept header picks the best supported format
+func TestNegotiate(t *testing.T) {
+	cases := map[string]Format{
+		"": JSON,
+		"*/*": JSON,
+		"text/csv": CSV,
+		"application/xml;q=0.5, application/yaml": YAML,
+		"text/html, text/xml": XML,
+		"application/json;q=0, text/csv;q=0.1": CSV,
+	}
+	for accept, expected := range cases {
+		if format := Negotiate(accept); format != expected {
+			t.Error("Accept: ", accept, " gave ", format, " expected ", expected)
+		}
+	}
+}
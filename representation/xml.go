@@ -0,0 +1,129 @@
+package representation
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Objects become elements with one child element per key. Lists repeat
+// the element of their key once per item, the same way encoding/xml
+// handles slices.
+
+func encodeXML(w io.Writer, name string, v interface{}) error {
+	generic, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	writeXMLElement(&buf, name, generic)
+	buf.WriteString("\n")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func writeXMLElement(buf *bytes.Buffer, name string, value interface{}) {
+	name = xmlName(name)
+	buf.WriteString("<" + name + ">")
+	switch v := value.(type) {
+	case nil:
+	case object:
+		for _, m := range v {
+			if list, ok := m.Value.([]interface{}); ok {
+				for _, item := range list {
+					writeXMLElement(buf, m.Key, item)
+				}
+			} else {
+				writeXMLElement(buf, m.Key, m.Value)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			writeXMLElement(buf, "item", item)
+		}
+	case string:
+		xml.EscapeText(buf, []byte(v))
+	case json.Number:
+		buf.WriteString(v.String())
+	default:
+		xml.EscapeText(buf, bytes.TrimSpace(mustJson(v)))
+	}
+	buf.WriteString("</" + name + ">")
+}
+
+// Replace characters that are not allowed in element names.
+func xmlName(name string) string {
+	if name == "" {
+		return "_"
+	}
+	var out []rune
+	for i, r := range name {
+		valid := unicode.IsLetter(r) || r == '_' || (i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.'))
+		if valid {
+			out = append(out, r)
+		} else {
+			out = append(out, '_')
+		}
+	}
+	return string(out)
+}
+
+func decodeXML(r io.Reader) (interface{}, error) {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := token.(xml.StartElement); ok {
+			return readXMLElement(decoder)
+		}
+	}
+}
+
+// Read the content of the element whose start was just consumed. Elements
+// without children are strings; repeated children are collected in lists.
+func readXMLElement(decoder *xml.Decoder) (interface{}, error) {
+	var text strings.Builder
+	var o object
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			child, err := readXMLElement(decoder)
+			if err != nil {
+				return nil, err
+			}
+			o = appendXMLChild(o, t.Name.Local, child)
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if o != nil {
+				return o, nil
+			}
+			return text.String(), nil
+		}
+	}
+}
+
+func appendXMLChild(o object, key string, value interface{}) object {
+	for i, m := range o {
+		if m.Key != key {
+			continue
+		}
+		// Children are strings or objects, so a list means a repeat.
+		if list, ok := m.Value.([]interface{}); ok {
+			o[i].Value = append(list, value)
+		} else {
+			o[i].Value = []interface{}{m.Value, value}
+		}
+		return o
+	}
+	return append(o, member{key, value})
+}
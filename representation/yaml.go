@@ -0,0 +1,411 @@
+package representation
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Only the block style subset of YAML needed for our resources is
+// supported: mappings, sequences, plain and quoted scalars and simple
+// flow collections. Anchors, tags and multi-line scalars are not.
+
+func encodeYAML(w io.Writer, v interface{}) error {
+	generic, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	if yamlIsInline(generic) {
+		lines = []string{yamlInline(generic)}
+	} else {
+		lines = yamlBlock(generic, 0)
+	}
+	_, err = io.WriteString(w, strings.Join(lines, "\n") + "\n")
+	return err
+}
+
+// Write item as one entry of a top level sequence.
+func encodeYAMLListItem(w io.Writer, item interface{}) error {
+	generic, err := toGeneric(item)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, strings.Join(yamlBlock([]interface{}{generic}, 0), "\n") + "\n")
+	return err
+}
+
+func yamlIsInline(value interface{}) bool {
+	switch v := value.(type) {
+	case object:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	default:
+		return true
+	}
+}
+
+func yamlInline(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		return yamlString(v)
+	case object:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	default:
+		return yamlString(strings.TrimSpace(string(mustJson(v))))
+	}
+}
+
+func yamlBlock(value interface{}, indent int) []string {
+	pad := strings.Repeat(" ", indent)
+	var lines []string
+	switch v := value.(type) {
+	case object:
+		for _, m := range v {
+			if yamlIsInline(m.Value) {
+				lines = append(lines, pad + yamlString(m.Key) + ": " + yamlInline(m.Value))
+			} else {
+				lines = append(lines, pad + yamlString(m.Key) + ":")
+				lines = append(lines, yamlBlock(m.Value, indent + 2)...)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if yamlIsInline(item) {
+				lines = append(lines, pad + "- " + yamlInline(item))
+				continue
+			}
+			// Nest the item two spaces in and put the dash on its first line.
+			nested := yamlBlock(item, indent + 2)
+			nested[0] = pad + "- " + nested[0][indent + 2:]
+			lines = append(lines, nested...)
+		}
+	}
+	return lines
+}
+
+func yamlString(s string) string {
+	if s == "" || strings.ContainsAny(s, "\n\r\t\"\\") || strings.Contains(s, ": ") ||
+		strings.Contains(s, " #") || strings.HasSuffix(s, ":") || strings.HasSuffix(s, " ") ||
+		strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'%@` ") {
+		return strconv.Quote(s)
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "y", "n", "null", "~":
+		return strconv.Quote(s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func mustJson(v interface{}) []byte {
+	json_data, _ := json.Marshal(v)
+	return json_data
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+}
+
+func decodeYAML(r io.Reader) (interface{}, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &yamlParser{}
+	for i, raw := range strings.Split(string(bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)), "\n") {
+		text := strings.TrimRight(stripYAMLComment(raw), " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" || trimmed == "..." {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, yamlError(i + 1, "tabs can not be used for indentation")
+		}
+		parser.lines = append(parser.lines, yamlLine{i + 1, len(text) - len(trimmed), trimmed})
+	}
+
+	if len(parser.lines) == 0 {
+		return nil, nil
+	}
+	value, next, err := parser.parseNode(0)
+	if err != nil {
+		return nil, err
+	}
+	if next < len(parser.lines) {
+		return nil, yamlError(parser.lines[next].number, "unexpected content")
+	}
+	return value, nil
+}
+
+func (p *yamlParser) parseNode(i int) (interface{}, int, error) {
+	line := p.lines[i]
+	if isYAMLSequenceItem(line.text) {
+		return p.parseSequence(i, line.indent)
+	}
+	if _, _, ok := splitYAMLEntry(line.text); ok {
+		return p.parseMapping(i, line.indent)
+	}
+	value, err := parseYAMLScalar(line.text)
+	if err != nil {
+		return nil, i, yamlError(line.number, err.Error())
+	}
+	return value, i + 1, nil
+}
+
+func (p *yamlParser) parseSequence(i int, indent int) (interface{}, int, error) {
+	list := []interface{}{}
+	for i < len(p.lines) && p.lines[i].indent == indent && isYAMLSequenceItem(p.lines[i].text) {
+		line := p.lines[i]
+		rest := strings.TrimLeft(line.text[1:], " ")
+		if rest == "" {
+			if i + 1 < len(p.lines) && p.lines[i + 1].indent > indent {
+				value, next, err := p.parseNode(i + 1)
+				if err != nil {
+					return nil, next, err
+				}
+				list = append(list, value)
+				i = next
+			} else {
+				list = append(list, nil)
+				i++
+			}
+			continue
+		}
+
+		// Treat the content after the dash as a line of its own, so that a
+		// mapping started there continues on the following lines.
+		offset := len(line.text) - len(rest)
+		p.lines[i] = yamlLine{line.number, indent + offset, rest}
+		value, next, err := p.parseNode(i)
+		if err != nil {
+			return nil, next, err
+		}
+		list = append(list, value)
+		i = next
+	}
+	if i < len(p.lines) && p.lines[i].indent > indent {
+		return nil, i, yamlError(p.lines[i].number, "bad indentation")
+	}
+	return list, i, nil
+}
+
+func (p *yamlParser) parseMapping(i int, indent int) (interface{}, int, error) {
+	o := object{}
+	for i < len(p.lines) && p.lines[i].indent == indent && !isYAMLSequenceItem(p.lines[i].text) {
+		line := p.lines[i]
+		key, rest, ok := splitYAMLEntry(line.text)
+		if !ok {
+			return nil, i, yamlError(line.number, "expected a key")
+		}
+
+		if rest != "" {
+			value, err := parseYAMLScalar(rest)
+			if err != nil {
+				return nil, i, yamlError(line.number, err.Error())
+			}
+			o = append(o, member{key, value})
+			i++
+			continue
+		}
+
+		// Nested block, sequences may sit at the same indentation as the key.
+		next := i + 1
+		if next < len(p.lines) && (p.lines[next].indent > indent ||
+			(p.lines[next].indent == indent && isYAMLSequenceItem(p.lines[next].text))) {
+			value, after, err := p.parseNode(next)
+			if err != nil {
+				return nil, after, err
+			}
+			o = append(o, member{key, value})
+			i = after
+		} else {
+			o = append(o, member{key, nil})
+			i = next
+		}
+	}
+	if i < len(p.lines) && p.lines[i].indent > indent {
+		return nil, i, yamlError(p.lines[i].number, "bad indentation")
+	}
+	return o, i, nil
+}
+
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// Split "key: value" into its parts, ok is false if text is not an entry.
+func splitYAMLEntry(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		end := closingQuote(text)
+		if end < 0 || end + 1 >= len(text) || text[end + 1] != ':' {
+			return "", "", false
+		}
+		key, err := parseYAMLScalar(text[:end + 1])
+		if err != nil {
+			return "", "", false
+		}
+		rest := text[end + 2:]
+		if rest != "" && rest[0] != ' ' {
+			return "", "", false
+		}
+		return key.(string), strings.TrimSpace(rest), true
+	}
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	if strings.HasSuffix(text, ":") {
+		return text[:len(text) - 1], "", true
+	}
+	if index := strings.Index(text, ": "); index >= 0 {
+		return text[:index], strings.TrimSpace(text[index + 2:]), true
+	}
+	return "", "", false
+}
+
+func parseYAMLScalar(text string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, "\""):
+		if closingQuote(text) != len(text) - 1 {
+			return nil, errors.New("unterminated string")
+		}
+		return strconv.Unquote(text)
+	case strings.HasPrefix(text, "'"):
+		if closingQuote(text) != len(text) - 1 {
+			return nil, errors.New("unterminated string")
+		}
+		return strings.Replace(text[1:len(text) - 1], "''", "'", -1), nil
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, errors.New("unterminated flow sequence")
+		}
+		list := []interface{}{}
+		for _, item := range splitFlow(text[1:len(text) - 1]) {
+			value, err := parseYAMLScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case strings.HasPrefix(text, "{"):
+		if !strings.HasSuffix(text, "}") {
+			return nil, errors.New("unterminated flow mapping")
+		}
+		o := object{}
+		for _, item := range splitFlow(text[1:len(text) - 1]) {
+			key, rest, ok := splitYAMLEntry(item)
+			if !ok {
+				return nil, errors.New("expected a key in flow mapping")
+			}
+			value, err := parseYAMLScalar(rest)
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, member{key, value})
+		}
+		return o, nil
+	case text == "|" || text == ">" || strings.HasPrefix(text, "|") || strings.HasPrefix(text, ">"):
+		return nil, errors.New("block scalars are not supported")
+	case text == "~" || text == "null" || text == "Null" || text == "NULL" || text == "":
+		return nil, nil
+	}
+	return text, nil
+}
+
+// Split the inside of a flow collection on commas outside quotes.
+func splitFlow(text string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(text[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// Index of the quote closing the string text starts with, or -1.
+func closingQuote(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		if quote == '"' && text[i] == '\\' {
+			i++
+			continue
+		}
+		if text[i] == quote {
+			if quote == '\'' && i + 1 < len(text) && text[i + 1] == '\'' {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			// Quotes only start a string at the beginning of a scalar.
+			if i == 0 || strings.ContainsAny(line[i - 1:i], " [{,:-") {
+				quote = c
+			}
+		case c == '#':
+			if i == 0 || line[i - 1] == ' ' || line[i - 1] == '\t' {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+func yamlError(line int, msg string) error {
+	return errors.New("YAML line " + strconv.Itoa(line) + ": " + msg)
+}
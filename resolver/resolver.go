@@ -0,0 +1,121 @@
+/*
+ * The purpose of this package is to pick one of a site's access points
+ * for a client, spreading clients over equivalent access points.
+ */
+
+package resolver
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"../entities"
+)
+
+// Strategies.
+const (
+	RoundRobin = "round-robin"
+	Random = "random"
+	// Random, in proportion to access point Weight.
+	Weighted = "weighted"
+	// Up before unknown before down, then lowest latency.
+	Healthiest = "healthiest"
+)
+
+// Health statuses, as reported by the prober.
+const (
+	Up = "up"
+	Down = "down"
+)
+
+// An access point that can be picked, with its latest health check.
+type Candidate struct {
+	AccessPoint entities.AccessPoint
+	Status string
+	LatencyMs float64
+}
+
+type Resolver struct {
+	mutex sync.Mutex
+	// Round robin position by site.
+	next map[string]int
+	random *rand.Rand
+}
+
+func New(seed int64) *Resolver {
+	return &Resolver{next: make(map[string]int), random: rand.New(rand.NewSource(seed))}
+}
+
+// Pick one of the candidates of site with strategy.
+func (r *Resolver) Pick(site string, strategy string, candidates []Candidate) (Candidate, error) {
+	if len(candidates) == 0 {
+		return Candidate{}, errors.New("Site has no access points to resolve to")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch strategy {
+	case RoundRobin, "":
+		i := r.next[site] % len(candidates)
+		r.next[site] = i + 1
+		return candidates[i], nil
+	case Random:
+		return candidates[r.random.Intn(len(candidates))], nil
+	case Weighted:
+		var total int64
+		for _, candidate := range candidates {
+			total += weight(candidate)
+		}
+		if total <= 0 {
+			return candidates[0], nil
+		}
+		n := r.random.Int63n(total)
+		for _, candidate := range candidates {
+			n -= weight(candidate)
+			if n < 0 {
+				return candidate, nil
+			}
+		}
+		return candidates[len(candidates) - 1], nil
+	case Healthiest:
+		best := candidates[0]
+		for _, candidate := range candidates[1:] {
+			if healthier(candidate, best) {
+				best = candidate
+			}
+		}
+		return best, nil
+	default:
+		return Candidate{}, errors.New("Unknown strategy: " + strategy)
+	}
+}
+
+// Access points without a Weight count as weight 1, and those stored with
+// more than entities.MaxWeight as that.
+func weight(candidate Candidate) int64 {
+	switch {
+	case candidate.AccessPoint.Weight <= 0:
+		return 1
+	case candidate.AccessPoint.Weight > entities.MaxWeight:
+		return entities.MaxWeight
+	}
+	return int64(candidate.AccessPoint.Weight)
+}
+
+func rank(status string) int {
+	switch status {
+	case Up:
+		return 0
+	case Down:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func healthier(a Candidate, b Candidate) bool {
+	if rank(a.Status) != rank(b.Status) {
+		return rank(a.Status) < rank(b.Status)
+	}
+	return a.Status == Up && a.LatencyMs < b.LatencyMs
+}
@@ -0,0 +1,85 @@
+package resolver
+
+import (
+	"math"
+	"testing"
+	"../entities"
+)
+
+func candidates(labels ...string) []Candidate {
+	var list []Candidate
+	for _, label := range labels {
+		list = append(list, Candidate{AccessPoint: entities.AccessPoint{Label: label}})
+	}
+	return list
+}
+
+func TestRoundRobin(t *testing.T) {
+	resolver := New(1)
+	list := candidates("a", "b", "c")
+	var picked string
+	for i := 0; i < 4; i++ {
+		candidate, _ := resolver.Pick("foo", RoundRobin, list)
+		picked += candidate.AccessPoint.Label
+	}
+	if picked != "abca" {
+		t.Error("Round robin picked ", picked)
+	}
+	// Sites are rotated independently.
+	if candidate, _ := resolver.Pick("bar", RoundRobin, list); candidate.AccessPoint.Label != "a" {
+		t.Error("Round robin for a new site started at ", candidate.AccessPoint.Label)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	resolver := New(1)
+	list := candidates("light", "heavy")
+	list[1].AccessPoint.Weight = 9
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		candidate, _ := resolver.Pick("foo", Weighted, list)
+		counts[candidate.AccessPoint.Label]++
+	}
+	if counts["heavy"] < 850 || counts["light"] < 50 {
+		t.Error("Weighted picks not in proportion: ", counts)
+	}
+}
+
+// Test:
+//	that weights too large to sum in an int are capped rather than panicking
+func TestWeightedLarge(t *testing.T) {
+	resolver := New(1)
+	list := candidates("a", "b", "c")
+	for i := range list {
+		list[i].AccessPoint.Weight = math.MaxInt64
+	}
+	if _, err := resolver.Pick("foo", Weighted, list); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHealthiest(t *testing.T) {
+	resolver := New(1)
+	list := []Candidate{
+		{entities.AccessPoint{Label: "down"}, Down, 1},
+		{entities.AccessPoint{Label: "slow"}, Up, 80},
+		{entities.AccessPoint{Label: "unknown"}, "unknown", 0},
+		{entities.AccessPoint{Label: "fast"}, Up, 5},
+	}
+	if candidate, _ := resolver.Pick("foo", Healthiest, list); candidate.AccessPoint.Label != "fast" {
+		t.Error("Healthiest picked ", candidate.AccessPoint.Label)
+	}
+	if candidate, _ := resolver.Pick("foo", Healthiest, list[:1]); candidate.AccessPoint.Label != "down" {
+		t.Error("Healthiest should fall back to a down access point")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	resolver := New(1)
+	if _, err := resolver.Pick("foo", RoundRobin, nil); err == nil {
+		t.Error("Expected an error with no candidates")
+	}
+	if _, err := resolver.Pick("foo", "fastest", candidates("a")); err == nil {
+		t.Error("Expected an error for an unknown strategy")
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * The purpose of this package is to keep changes that are to be made at a
+ * later time, and to make them once they are due.
+ */
+
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"../batch"
+	"../fileStore"
+)
+
+// Scheduled changes are kept in one hidden file in the store.
+const fileName = ".schedule"
+
+// Batch operations to apply together once At has passed.
+type Change struct {
+	Id string
+	At time.Time
+	Operations []batch.Operation
+	CreatedBy string
+	// Why the change could not be applied. Failed changes are kept, but
+	// not tried again.
+	Error string `json:",omitempty"`
+	Results []batch.Result `json:",omitempty"`
+}
+
+type stored struct {
+	Next int
+	Changes []Change
+}
+
+type Scheduler struct {
+	mutex sync.Mutex
+	fs *fileStore.FileStore
+	next int
+	changes []Change
+}
+
+func New(fs *fileStore.FileStore) *Scheduler {
+	return &Scheduler{fs: fs, next: 1}
+}
+
+// Read the changes saved in the store, replacing those in memory.
+func (s *Scheduler) Load() error {
+	data, err := s.fs.Load(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved stored
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.next = saved.Next
+	s.changes = saved.Changes
+	return nil
+}
+
+// Changes in the order they are due.
+func (s *Scheduler) List() []Change {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Change{}, s.changes...)
+}
+
+func (s *Scheduler) Get(id string) (Change, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, change := range s.changes {
+		if change.Id == id {
+			return change, true
+		}
+	}
+	return Change{}, false
+}
+
+// Save change with a new Id, which is returned with it.
+func (s *Scheduler) Add(change Change) (Change, error) {
+	if change.At.IsZero() {
+		return change, errors.New("Scheduled change needs a time")
+	}
+	if len(change.Operations) == 0 {
+		return change, errors.New("Scheduled change needs operations")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	change.Id = strconv.Itoa(s.next)
+	change.Error = ""
+	change.Results = nil
+	changes := append(append([]Change{}, s.changes...), change)
+	// Changes due at the same time keep the order they were added in.
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].At.Before(changes[j].At)
+	})
+	err := s.save(s.next + 1, changes)
+	if err != nil {
+		return change, err
+	}
+	s.next++
+	s.changes = changes
+	return change, nil
+}
+
+// Remove a change, returning false if there is none with id.
+func (s *Scheduler) Remove(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changes := without(s.changes, id)
+	if len(changes) == len(s.changes) {
+		return false, nil
+	}
+	err := s.save(s.next, changes)
+	if err != nil {
+		return true, err
+	}
+	s.changes = changes
+	return true, nil
+}
+
+// When the first change that has not failed falls due, false if there is
+// none.
+func (s *Scheduler) Next() (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, change := range s.changes {
+		if change.Error == "" {
+			return change.At, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Apply every change due at now, oldest first. Each is removed from the
+// schedule in the same transaction that applies it, so that it is applied
+// exactly once even if the server stops part way through.
+func (s *Scheduler) ApplyDue(now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, change := range append([]Change{}, s.changes...) {
+		if change.At.After(now) {
+			break
+		}
+		if change.Error != "" {
+			continue
+		}
+		remaining := without(s.changes, change.Id)
+		data, err := json.Marshal(stored{s.next, remaining})
+		if err != nil {
+			return err
+		}
+		results, err := batch.ApplyWith(s.fs, change.Operations, change.CreatedBy, func(tx *fileStore.Transaction) {
+			tx.Write(fileName, data)
+		})
+		if err == nil {
+			s.changes = remaining
+			continue
+		}
+
+		// Keep the change with why it failed.
+		for i := range s.changes {
+			if s.changes[i].Id == change.Id {
+				s.changes[i].Error = err.Error()
+				s.changes[i].Results = results
+			}
+		}
+		err = s.save(s.next, s.changes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) save(next int, changes []Change) error {
+	data, err := json.Marshal(stored{next, changes})
+	if err != nil {
+		return err
+	}
+	tx := s.fs.Begin()
+	tx.Write(fileName, data)
+	return tx.Commit()
+}
+
+func without(changes []Change, id string) []Change {
+	remaining := []Change{}
+	for _, change := range changes {
+		if change.Id != id {
+			remaining = append(remaining, change)
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,71 @@
+package schedule
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"../batch"
+	"../entities"
+	"../fileStore"
+)
+
+// Test:
+//	that changes survive being loaded again
+//	that only due changes are applied, and are then removed
+//	that failed changes are kept with their error and not tried again
+//	that the next change due is the first that has not failed
+func TestApplyDue(t *testing.T) {
+	directory, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(directory + "/")
+
+	now := time.Now().UTC()
+	scheduler := New(&fs)
+	site := entities.Site{Name: "foo", Role: "role", Uri: "uri"}
+	for _, change := range []Change{
+		{At: now.Add(time.Hour), Operations: []batch.Operation{{Op: batch.DeleteSite, Name: "foo"}}},
+		{At: now, Operations: []batch.Operation{{Op: batch.CreateSite, Site: &site}}},
+		{At: now, Operations: []batch.Operation{{Op: batch.DeleteSite, Name: "bar"}}},
+	} {
+		if _, err = scheduler.Add(change); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = scheduler.Add(Change{At: now}); err == nil {
+		t.Error("Change without operations was added")
+	}
+
+	loaded := New(&fs)
+	if err = loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err = loaded.ApplyDue(now); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.Exists("foo") {
+		t.Error("Due change was not applied")
+	}
+
+	reloaded := New(&fs)
+	if err = reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	changes := reloaded.List()
+	if len(changes) != 2 || changes[0].Id != "3" || changes[0].Error == "" || changes[1].Id != "1" || changes[1].Error != "" {
+		t.Fatal("Unexpected changes: ", changes)
+	}
+	if next, ok := reloaded.Next(); !ok || !next.Equal(now.Add(time.Hour)) {
+		t.Error("Unexpected next change: ", next)
+	}
+	if found, err := reloaded.Remove("3"); !found || err != nil {
+		t.Error("Failed change was not removed: ", err)
+	}
+	if change, err := reloaded.Add(Change{At: now, Operations: changes[1].Operations}); err != nil || change.Id != "4" {
+		t.Error("Unexpected Id for new change: ", change.Id, err)
+	}
+}
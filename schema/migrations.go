@@ -0,0 +1,13 @@
+package schema
+
+// Migrations by the version they upgrade from. Each one moves a document
+// up a single version; add one here whenever CurrentVersion is raised,
+// along with a fixture in testdata for the version being left behind.
+var migrations = map[int]Migration{
+	// Version 2 introduced the envelope. The fields added to version 1
+	// documents over time (tags, labels and audit fields) were all
+	// optional, so the document itself is unchanged.
+	1: func(document map[string]interface{}) error {
+		return nil
+	},
+}
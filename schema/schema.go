@@ -0,0 +1,156 @@
+/*
+ * The purpose of this package is to version the documents kept in the
+ * File Store, so that stored sites keep loading as entities change.
+ */
+
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"../entities"
+	"../fileStore"
+)
+
+// Version of the documents written by Encode.
+const CurrentVersion = 2
+
+// A stored document. Files written before versioning hold the bare
+// document instead and are read as version 1.
+type Envelope struct {
+	SchemaVersion int
+	Data json.RawMessage
+}
+
+// Changes a document from one version to the next, in place.
+type Migration func(document map[string]interface{}) error
+
+// Wrap v in an envelope at the current version.
+func Encode(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{CurrentVersion, data})
+}
+
+// Read a stored document of any version into v, migrating it on the way.
+// The version it was stored at is returned.
+func Decode(stored []byte, v interface{}) (int, error) {
+	data, version, err := upgrade(stored)
+	if err != nil {
+		return version, err
+	}
+	return version, json.Unmarshal(data, v)
+}
+
+// The stored document rewritten at the current version, and whether that
+// differs from what was stored.
+func Upgrade(stored []byte) ([]byte, bool, error) {
+	data, version, err := upgrade(stored)
+	if err != nil || version == CurrentVersion {
+		return stored, false, err
+	}
+	upgraded, err := json.Marshal(Envelope{CurrentVersion, data})
+	return upgraded, true, err
+}
+
+func EncodeSite(site *entities.Site) ([]byte, error) {
+	return Encode(site)
+}
+
+func DecodeSite(stored []byte) (entities.Site, error) {
+	var site entities.Site
+	_, err := Decode(stored, &site)
+	return site, err
+}
+
+// Upgrade every document in fs that is not at the current version, in a
+// single transaction. The names of the upgraded files are returned; with
+// dry_run nothing is written.
+func MigrateStore(fs *fileStore.FileStore, dry_run bool) ([]string, error) {
+	file_names, err := fs.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	tx := fs.Begin()
+	var migrated []string
+	for _, file_name := range file_names {
+		stored, err := fs.Load(file_name)
+		if err != nil {
+			return nil, err
+		}
+		upgraded, changed, err := Upgrade(stored)
+		if err != nil {
+			return nil, errors.New(file_name + ": " + err.Error())
+		}
+		if changed {
+			tx.Write(file_name, upgraded)
+			migrated = append(migrated, file_name)
+		}
+	}
+	if dry_run || len(migrated) == 0 {
+		return migrated, nil
+	}
+	return migrated, tx.Commit()
+}
+
+// The bare document in stored, migrated to the current version, and the
+// version it was stored at.
+func upgrade(stored []byte) ([]byte, int, error) {
+	version, data, err := unwrap(stored)
+	if err != nil {
+		return nil, version, err
+	}
+	if version > CurrentVersion {
+		return nil, version, errors.New("Document has schema version " + strconv.Itoa(version) +
+			", newer than the supported " + strconv.Itoa(CurrentVersion))
+	}
+	if version == CurrentVersion {
+		return data, version, nil
+	}
+
+	var document map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&document)
+	if err != nil {
+		return nil, version, err
+	}
+	for from := version; from < CurrentVersion; from++ {
+		migration, ok := migrations[from]
+		if !ok {
+			return nil, version, errors.New("No migration from schema version " + strconv.Itoa(from))
+		}
+		err = migration(document)
+		if err != nil {
+			return nil, version, err
+		}
+	}
+	data, err = json.Marshal(document)
+	return data, version, err
+}
+
+func unwrap(stored []byte) (int, []byte, error) {
+	var probe map[string]json.RawMessage
+	err := json.Unmarshal(stored, &probe)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, ok := probe["SchemaVersion"]; !ok {
+		return 1, stored, nil
+	}
+
+	var envelope Envelope
+	err = json.Unmarshal(stored, &envelope)
+	if err != nil {
+		return 0, nil, err
+	}
+	if envelope.SchemaVersion < 1 || len(envelope.Data) == 0 {
+		return envelope.SchemaVersion, nil, errors.New("Invalid schema envelope")
+	}
+	return envelope.SchemaVersion, envelope.Data, nil
+}
@@ -0,0 +1,92 @@
+package schema
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"../entities"
+)
+
+// Test:
+//	that there is a fixture for every schema version
+//	that every fixture loads as a valid site
+//	that upgrading a fixture keeps its content and reaches the current version
+func TestFixtures(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/site-v*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := make(map[int]bool)
+	for _, fixture := range fixtures {
+		name := strings.TrimPrefix(filepath.Base(fixture), "site-v")
+		version, err := strconv.Atoi(strings.SplitN(strings.TrimSuffix(name, ".json"), "-", 2)[0])
+		if err != nil {
+			t.Error(fixture, ": no version in name")
+			continue
+		}
+		versions[version] = true
+
+		stored, err := ioutil.ReadFile(fixture)
+		if err != nil {
+			t.Error(fixture, ": ", err)
+			continue
+		}
+		var site entities.Site
+		read_version, err := Decode(stored, &site)
+		if err != nil {
+			t.Error(fixture, ": error decoding: ", err)
+			continue
+		}
+		if read_version != version {
+			t.Error(fixture, ": read as version ", read_version)
+		}
+		if err = site.Validate(); err != nil {
+			t.Error(fixture, ": ", err)
+		}
+
+		upgraded, changed, err := Upgrade(stored)
+		if err != nil || changed != (version != CurrentVersion) {
+			t.Error(fixture, ": upgrade changed: ", changed, ", error: ", err)
+			continue
+		}
+		upgraded_site, err := DecodeSite(upgraded)
+		if err != nil || !reflect.DeepEqual(upgraded_site, site) {
+			t.Error(fixture, ": upgraded site differs: ", upgraded_site, err)
+		}
+		if again, changed, _ := Upgrade(upgraded); changed || string(again) != string(upgraded) {
+			t.Error(fixture, ": upgrading twice changed the document")
+		}
+	}
+
+	for version := 1; version <= CurrentVersion; version++ {
+		if !versions[version] {
+			t.Error("No fixture for schema version ", version)
+		}
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	var site entities.Site
+	_, err := Decode([]byte(`{"SchemaVersion":99,"Data":{"Name":"future"}}`), &site)
+	if err == nil {
+		t.Error("Expected an error for a newer schema version")
+	}
+}
+
+func TestEncode(t *testing.T) {
+	site := entities.Site{Name: "foo", Role: "role1", Uri: "uri1"}
+	stored, err := EncodeSite(&site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(stored), `{"SchemaVersion":` + strconv.Itoa(CurrentVersion) + `,`) {
+		t.Error("Unexpected envelope: ", string(stored))
+	}
+	decoded, err := DecodeSite(stored)
+	if err != nil || !reflect.DeepEqual(decoded, site) {
+		t.Error("Site changed by encoding: ", decoded, err)
+	}
+}
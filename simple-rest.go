@@ -1,34 +1,460 @@
 package main
 
 import (
-	"encoding/json"
+	"compress/gzip"
+	"context"
 	"net/http"
-	//"log"
+	"log"
+	"encoding/json"
 	"errors"
+	"flag"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"github.com/gorilla/mux"
 	"./fileStore"
 	"./entities"
+	"./metrics"
+	"./rateLimit"
+	"./representation"
+	"./inventory"
+	"./batch"
+	"./aliases"
+	"./schema"
+	"./validation"
+	"./prober"
+	"./clicks"
+	"./urls"
+	"./resolver"
+	"./schedule"
+	"./hierarchy"
+	"./expiry"
 )
 
 const FileStorePrefix = "./data/"
+// Templates are kept in a hidden directory so they are not listed as sites.
+const TemplateStorePrefix = FileStorePrefix + ".templates/"
+// Groups likewise, in a directory of the site store so that they can be
+// changed in the same transaction as sites.
+const GroupDirectory = ".groups/"
+const GroupStorePrefix = FileStorePrefix + GroupDirectory
+const ListenAddress = ":8080"
+// Validation rules, used if the file exists. See rules.example.json.
+const ValidationRulesFile = "./rules.json"
+// API keys known to the server, used if the file exists. See
+// api-keys.example.json.
+const APIKeysFile = "./api-keys.json"
+// Rate limits per route, used if the file exists instead of
+// DefaultRateLimits. See rate-limits.example.json.
+const RateLimitsFile = "./rate-limits.json"
+
+// Time between reporting not ready and closing the listener, so that
+// load balancers stop sending traffic before connections are refused.
+const ShutdownDrainDelay = 5 * time.Second
+const ShutdownTimeout = 10 * time.Second
+
+// Set at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+var startTime = time.Now()
+var shuttingDown int32
+
+// Rate and concurrency limits applied to a route. Reads are GET and HEAD
+// requests, everything else is a write. Nil limiters are not enforced.
+type RouteLimits struct {
+	Read *rateLimit.Limiter
+	Write *rateLimit.Limiter
+	// Caps concurrent reads, used for listings that load every site file.
+	Concurrency *rateLimit.ConcurrencyLimiter
+}
+
+// Limits used when RateLimitsFile does not exist.
+var DefaultRateLimits = rateLimit.RoutesConfig{
+	Default: rateLimit.RouteConfig{
+		Read: &rateLimit.Config{Rate: 50, Burst: 100},
+		Write: &rateLimit.Config{Rate: 20, Burst: 40},
+	},
+	Routes: map[string]rateLimit.RouteConfig{
+		"/sites": {Read: &rateLimit.Config{Rate: 5, Burst: 20}, Concurrency: 4},
+		"/metrics": {Unlimited: true},
+		"/healthz": {Unlimited: true},
+		"/readyz": {Unlimited: true},
+	},
+}
+
+// The limits of routes without their own, and per route template overrides.
+var defaultLimits, routeLimits = NewRouteLimits(&DefaultRateLimits)
+
+// What a client sending an API key known to the server gets. Clients are
+// only told apart by keys the server knows, so that sending a new key does
+// not get a new bucket.
+type APIKey struct {
+	// Who uses the key, recorded as the actor of their changes.
+	Name string
+	// Requests with the key are not rate limited.
+	Exempt bool
+}
+
+// The keys in APIKeysFile, read again when it changes.
+var apiKeys = map[string]APIKey{}
+var apiKeysMutex sync.Mutex
+var apiKeysChecked time.Time
+var apiKeysModified time.Time
+
+// How often APIKeysFile is checked for changes.
+const APIKeysReloadInterval = time.Second
+
+// How /go short links behave.
+type RedirectConfig struct {
+	// Add the query string of the short link to the access point Url.
+	PassQuery bool
+	// Where links to missing sites or access points go, with {site} and
+	// {label} replaced. If empty they get a 404.
+	Fallback string
+}
+
+var redirectConfig = RedirectConfig{PassQuery: true}
+
+// Click counts are saved to the File Store this often.
+const ClickFlushInterval = 10 * time.Second
+
+var clickCounter = clicks.NewCounter()
+
+// Expired sites and access points are removed, and scheduled changes are
+// made, when they fall due or a site changes. They are also looked for
+// this often, set with -expiry-interval, in case one is missed.
+const DefaultExpiryInterval = time.Minute
+
+var expiryInterval = DefaultExpiryInterval
+
+// When the stored sites expire, so that they are not read to find out.
+var expiryIndex = newExpiryIndex()
+
+// Wakes the expiry loop when the store changes.
+var expiryWake = make(chan struct{}, 1)
+
+// Recorded as the author of changes made to remove expired items.
+const ExpiryActor = "expiry"
+
+var scheduler *schedule.Scheduler
+
+// How access points are checked in the background.
+var probeConfig = prober.Config{
+	Interval: 60 * time.Second,
+	Timeout: 5 * time.Second,
+	Concurrency: 8,
+	HistorySize: 20,
+}
+
+var probes = prober.New(probeConfig, ProbeTargets)
+
+var siteResolver = resolver.New(time.Now().UnixNano())
+
+var registry = metrics.NewRegistry()
+
+var (
+	requestCount = registry.NewCounterVec("simple_rest_http_requests_total",
+		"Number of HTTP requests handled.", "method", "route", "code")
+	requestDuration = registry.NewHistogramVec("simple_rest_http_request_duration_seconds",
+		"Time taken to handle HTTP requests.", metrics.DefaultBuckets, "method", "route", "code")
+	requestsInFlight = registry.NewGaugeVec("simple_rest_http_requests_in_flight",
+		"Number of HTTP requests currently being handled.", "route")
+	storeDuration = registry.NewHistogramVec("simple_rest_filestore_operation_duration_seconds",
+		"Time taken by File Store operations.", metrics.DefaultBuckets, "op")
+	storeErrors = registry.NewCounterVec("simple_rest_filestore_errors_total",
+		"Number of failed File Store operations.", "op")
+	siteCount = registry.NewGaugeVec("simple_rest_sites", "Number of stored sites.")
+	accessPointCount = registry.NewGaugeVec("simple_rest_access_points", "Number of stored access points.")
+)
+
+// Parents of the stored sites, so that writes find children without
+// reading every site.
+var siteIndex = newSiteIndex()
+
+func newSiteIndex() *hierarchy.Index {
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	return hierarchy.NewIndex(&fs)
+}
+
+func newExpiryIndex() *expiry.Index {
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	return expiry.NewIndex(&fs)
+}
 
 func main() {
 	fs := fileStore.FileStore{}
 	fs.SetPrefix(FileStorePrefix)
+	fileStore.Observer = ObserveFileStore
+	fileStore.Changed = func(prefix string, written map[string][]byte, deleted []string) {
+		if prefix == FileStorePrefix {
+			siteIndex.Update(written, deleted)
+			expiryIndex.Update(written, deleted)
+			PruneClicks(written, deleted)
+			select {
+			case expiryWake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	batch.Children = siteIndex.Children
+	batch.Deleting = removeGroupMembers
+	// Finish any transaction that was interrupted by a crash, and load the
+	// index or open the database.
+	err := fs.Recover()
+	if err == nil {
+		err = fs.Open()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	templates := fileStore.FileStore{}
+	templates.SetPrefix(TemplateStorePrefix)
+	err = templates.CreateDirectory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	groups := fileStore.FileStore{}
+	groups.SetPrefix(GroupStorePrefix)
+	err = groups.CreateDirectory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rules := validation.DefaultRules()
+	if _, err := os.Stat(ValidationRulesFile); err == nil {
+		rules, err = validation.Load(ValidationRulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	entities.Rules = rules.Check
+	if rules.UniqueUrls == validation.UniqueGlobal {
+		entities.SitesRules = rules.AgainstSites
+	}
+
+	if err := ReloadAPIKeys(); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := os.Stat(RateLimitsFile); err == nil {
+		config, err := rateLimit.LoadRoutes(RateLimitsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defaultLimits, routeLimits = NewRouteLimits(config)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		Migrate(os.Args[2:], &fs, &templates, &groups)
+		return
+	}
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.DurationVar(&expiryInterval, "expiry-interval", DefaultExpiryInterval, "longest time between looks for expired items and due scheduled changes")
+	flags.Parse(os.Args[1:])
+	if expiryInterval <= 0 {
+		log.Fatal("-expiry-interval must be positive")
+	}
+
+	// Nothing else uses the store yet, so a database can be compacted.
+	err = fs.Compact()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = clickCounter.Load(&fs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scheduler = schedule.New(&fs)
+	err = scheduler.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Changes that fell due while the server was stopped are made first.
+	go func() {
+		for {
+			now := time.Now().UTC()
+			if err := scheduler.ApplyDue(now); err != nil {
+				log.Println("Applying scheduled changes failed:", err)
+			}
+			ReapExpired(&fs, now)
+
+			// Sleep until the next item expires or change falls due.
+			wait := expiryInterval
+			if next, ok := expiryIndex.Next(now); ok && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+			if next, ok := scheduler.Next(); ok && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-expiryWake:
+				timer.Stop()
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(ClickFlushInterval)
+		for {
+			if err := clickCounter.Flush(&fs); err != nil {
+				log.Println("Saving click counts failed:", err)
+			}
+			<-ticker.C
+		}
+	}()
 	router := mux.NewRouter()
+	router.Use(LimitHandler)
+	router.Use(CompressHandler)
+	router.Use(AliasHandler)
+	router.Handle("/metrics", InventoryHandler(registry.Handler())).Methods("GET")
+	router.HandleFunc("/healthz", HealthHandler).Methods("GET")
+	router.HandleFunc("/readyz", ReadyHandler).Methods("GET")
+	router.HandleFunc("/debug/info", DebugInfoHandler).Methods("GET")
+	router.HandleFunc("/debug/storage/reshard", ReshardHandler).Methods("POST")
+	router.HandleFunc("/debug/storage/snapshot", SnapshotHandler).Methods("GET")
+	router.HandleFunc("/export", ExportHandler).Methods("GET")
+	router.HandleFunc("/import", ImportHandler).Methods("POST")
+	router.HandleFunc("/batch", BatchHandler).Methods("POST")
+	router.HandleFunc("/schedule", GetScheduledChanges).Methods("GET")
+	router.HandleFunc("/schedule", ScheduleChange).Methods("POST")
+	router.HandleFunc("/schedule/{id}", GetScheduledChange).Methods("GET")
+	router.HandleFunc("/schedule/{id}", CancelScheduledChange).Methods("DELETE")
+	router.HandleFunc("/go/{site}/{label}", GoHandler)
 	router.HandleFunc("/sites", SiteHandler).Methods("GET", "POST", "PUT")
 	router.HandleFunc("/sites/{name}", SiteHandler).Methods("GET", "DELETE")
+	router.HandleFunc("/sites/{name}/rename", RenameSite).Methods("POST")
+	router.HandleFunc("/sites/{name}/clone", CloneSite).Methods("POST")
+	router.HandleFunc("/sites/{name}/children", GetChildren).Methods("GET")
+	router.HandleFunc("/sites/{name}/ancestors", GetAncestors).Methods("GET")
+	router.HandleFunc("/sites/{name}/maintenance", StartMaintenance).Methods("PUT")
+	router.HandleFunc("/sites/{name}/maintenance", EndMaintenance).Methods("DELETE")
+	router.HandleFunc("/templates", GetTemplates).Methods("GET")
+	router.HandleFunc("/templates", CreateUpdateTemplate).Methods("POST", "PUT")
+	router.HandleFunc("/templates/{template}", GetTemplate).Methods("GET")
+	router.HandleFunc("/templates/{template}", DeleteTemplate).Methods("DELETE")
+	router.HandleFunc("/templates/{template}/instantiate", InstantiateTemplate).Methods("POST")
+	router.HandleFunc("/groups", GetGroups).Methods("GET")
+	router.HandleFunc("/groups", CreateUpdateGroup).Methods("POST", "PUT")
+	router.HandleFunc("/groups/{group}", GetGroup).Methods("GET")
+	router.HandleFunc("/groups/{group}", DeleteGroup).Methods("DELETE")
+	router.HandleFunc("/groups/{group}/sites", GetGroupSites).Methods("GET")
+	router.HandleFunc("/groups/{group}/accesspoints", GetGroupAPs).Methods("GET")
 	router.HandleFunc("/sites/{name}/accesspoints", APHandler).Methods("GET", "POST", "PUT")
+	router.HandleFunc("/sites/{name}/accesspoints/reorder", ReorderAPs).Methods("POST")
 	router.HandleFunc("/sites/{name}/accesspoints/{label}", APHandler).Methods("GET", "DELETE")
+	router.HandleFunc("/sites/{name}/accesspoints/{label}/enable", EnableAP).Methods("POST")
+	router.HandleFunc("/sites/{name}/accesspoints/{label}/disable", DisableAP).Methods("POST")
+	router.HandleFunc("/sites/{name}/accesspoints/{label}/move", MoveAP).Methods("POST")
+	router.HandleFunc("/sites/{name}/accesspoints/{label}/copy", CopyAP).Methods("POST")
+	router.HandleFunc("/sites/{name}/health", SiteHealthHandler).Methods("GET")
+	router.HandleFunc("/sites/{name}/resolve", ResolveHandler).Methods("GET")
+	router.HandleFunc("/sites/{name}/accesspoints/{label}/health", APHealthHandler).Methods("GET")
+
+	probe_context, stop_probes := context.WithCancel(context.Background())
+	go probes.Run(probe_context)
+
+	// Instrument the router itself so unmatched requests are counted too.
+	server := &http.Server{Addr: ListenAddress, Handler: InstrumentHandler(router)}
+	stopped := make(chan bool)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		// Report not ready first, then stop accepting connections.
+		atomic.StoreInt32(&shuttingDown, 1)
+		stop_probes()
+		time.Sleep(ShutdownDrainDelay)
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+		if err := clickCounter.Flush(&fs); err != nil {
+			log.Println("Saving click counts failed:", err)
+		}
+		if err := fs.Close(); err != nil {
+			log.Println("Saving the store index failed:", err)
+		}
+		close(stopped)
+	}()
+
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Wait for requests in flight to finish and click counts and the store
+	// index to be saved.
+	<-stopped
+}
+
+// The migrate command: rewrite every stored site, template and group at
+// the current schema version, and move the site store, with the templates
+// and groups in it, to another layout with -layout. Run it while the server
+// is stopped.
+func Migrate(args []string, stores ...*fileStore.FileStore) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dry_run := flags.Bool("dry-run", false, "only list the files that would be migrated")
+	layout := flags.String("layout", "", "also move the site store to this layout, " + fileStore.Sharded + " or " + fileStore.Database)
+	flags.Parse(args)
+	if *layout != "" && *layout != fileStore.Sharded && *layout != fileStore.Database {
+		log.Fatal("Unknown layout: ", *layout)
+	}
+
+	for _, store := range stores {
+		migrated, err := schema.MigrateStore(store, *dry_run)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, file_name := range migrated {
+			if *dry_run {
+				log.Println("Would migrate", store.Path(file_name))
+			} else {
+				log.Println("Migrated", store.Path(file_name))
+			}
+		}
+	}
 
-	http.ListenAndServe(":8080", router)
+	// The first store holds the sites. An interrupted reshard is finished.
+	if *layout == "" || stores[0].Layout() == *layout && !stores[0].Resharding() {
+		return
+	}
+	if *dry_run {
+		log.Println("Would move", stores[0].Path(""), "to the", *layout, "layout")
+		return
+	}
+	var err error
+	if *layout == fileStore.Database {
+		err = stores[0].MoveToDatabase()
+	} else {
+		err = stores[0].Reshard(nil)
+		if err == nil {
+			err = stores[0].Close()
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Moved", stores[0].Path(""), "to the", *layout, "layout")
 }
 
-func WriteSiteToStore(site entities.Site) (error) {
+// Stamp site against the version in the File Store and write it there.
+func WriteSiteToStore(site *entities.Site, actor string) (error) {
 	fs := fileStore.FileStore{}
 	fs.SetPrefix(FileStorePrefix)
 
-	site_json, err := site.ToJson()
+	StampSite(&fs, site, actor)
+	site_json, err := schema.EncodeSite(site)
 	if err != nil {
 		return err
 	}
@@ -43,106 +469,154 @@ func WriteSiteToStore(site entities.Site) (error) {
 
 func CreateSite(w http.ResponseWriter, r *http.Request) {
 	var site entities.Site
-	_ = json.NewDecoder(r.Body).Decode(&site)
+	err := decodeBody(r, &site)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	defer fileStore.Lock(site.Name)()
+	// Maintenance is only started through its own endpoint.
+	site.Maintenance = nil
 
 	// Check if site exists in File Store.
 	fs := fileStore.FileStore{}
 	fs.SetPrefix(FileStorePrefix)
 	exists := fs.Exists(site.Name)
 	if exists {
-		sendError(w, "A site already exists with this name")
+		sendError(w, r, "A site already exists with this name")
 	} else {
 		err := site.Validate()
+		if err == nil {
+			err = CheckSites(&fs, site)
+		}
 		if err != nil {
-			sendError(w, err.Error())
+			sendInvalid(w, r, err)
 			return
 		}
-		err = WriteSiteToStore(site)
+		err = WriteSiteToStore(&site, Actor(r))
 		if err != nil {
-			sendError(w, err.Error())
+			sendError(w, r, err.Error())
 			return
 		} else {
 			// Set the proper response code and return the created item.
-			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(site)
+			sendResponse(w, r, 200, site)
 		}
 	}
 }
 
 func EditSite(w http.ResponseWriter, r *http.Request) {
 	var site entities.Site
-	_ = json.NewDecoder(r.Body).Decode(&site)
+	err := decodeBody(r, &site)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	defer fileStore.Lock(site.Name)()
 	fs := fileStore.FileStore{}
 	fs.SetPrefix(FileStorePrefix)
 
 	// Check if the site exists.
 	exists := fs.Exists(site.Name)
 	if !exists {
-		sendError(w, "Site does not exist")
+		sendError(w, r, "Site does not exist")
 		return
 	}
 
 	// Load data from file so we can get our access points.
 	old_site_data, err := fs.Load(site.Name)
 	if err != nil {
-		sendError(w, err.Error())
+		sendError(w, r, err.Error())
 		return
 	}
 
 	// Build site from file data.
-	old_site, err := entities.SiteFromJson(old_site_data)
+	old_site, err := schema.DecodeSite(old_site_data)
 
 	if err != nil {
-		sendError(w, err.Error())
+		sendError(w, r, err.Error())
 		return
 	} else {
 		// Since access_points shouldn't be updatable through this call, set
-		// access_points to value in current site object.
+		// access_points to value in current site object. The same goes for
+		// maintenance, which has endpoints of its own.
 		site.Access_points = old_site.Access_points
+		site.Maintenance = old_site.Maintenance
 		err := site.Validate()
+		if err == nil {
+			err = CheckSites(&fs, site)
+		}
 		if err != nil {
-			sendError(w, err.Error())
+			sendInvalid(w, r, err)
 			return
 		}
 		// Write updated Site to FileStore.
-		err = WriteSiteToStore(site)
+		err = WriteSiteToStore(&site, Actor(r))
 		if err != nil {
-			sendError(w, err.Error())
+			sendError(w, r, err.Error())
 			return
 		} else {
 			// Set the proper response code and return the created item.
-			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(site)
+			sendResponse(w, r, 200, site)
 		}
 	}
 }
 
 func GetSites(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseListFilter(r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	inherit, err := boolQuery(r, "inherit")
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
 	// Get all Site names in the FileStore
 	fs := fileStore.FileStore{}
 	fs.SetPrefix(FileStorePrefix)
+	var tree *hierarchy.Tree
+	if inherit {
+		tree, err = hierarchy.Load(&fs)
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+	}
 	site_names, err := fs.GetFiles()
 	if err != nil {
-		sendError(w, err.Error())
+		sendError(w, r, err.Error())
 	} else {
-		var sites []entities.Site
-		// Load all site objects
+		// Stream sites as they are loaded rather than holding them all.
+		list := NewListWriter(w, r, "Sites")
 		for _, site_name := range site_names {
 			// Get File data.
 			file_data, err := fs.Load(site_name)
 			if err != nil {
-				sendError(w, err.Error())
+				list.Fail(err)
 				return
 			}
 			// Build site object from file data.
-			site, err := entities.SiteFromJson(file_data)
+			site, err := schema.DecodeSite(file_data)
 			if err != nil {
-				sendError(w, err.Error())
+				list.Fail(err)
 				return
 			}
-			sites = append(sites, site)
+			if inherit {
+				site = tree.Inherited(site)
+			}
+			if !filter.Matches(site.Tags, site.Labels, site.Audit) {
+				continue
+			}
+			if !filter.IncludeDisabled && site.InMaintenance(time.Now()) {
+				continue
+			}
+			CountClicks(&site)
+			list.Write(site)
 		}
-		json.NewEncoder(w).Encode(sites)
+		list.Close()
 	}
 }
 
@@ -163,7 +637,7 @@ func GetSiteFromStore(w http.ResponseWriter, r *http.Request) (entities.Site, er
 			return site, err
 		}
 		// Build site object from file data.
-		site, err = entities.SiteFromJson(file_data)
+		site, err = schema.DecodeSite(file_data)
 		if err != nil {
 			return site, err
 		}
@@ -175,169 +649,1728 @@ func GetSiteFromStore(w http.ResponseWriter, r *http.Request) (entities.Site, er
 }
 
 func GetSite(w http.ResponseWriter, r *http.Request) {
+	inherit, err := boolQuery(r, "inherit")
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
 	site, err := GetSiteFromStore(w, r)
 	if err != nil {
-		sendError(w, err.Error())
+		sendError(w, r, err.Error())
 		return
 	}
-
-	json.NewEncoder(w).Encode(site)
-}
-
-func DeleteSite(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	// Check if site exists in the File Store.
-	fs := fileStore.FileStore{}
-	fs.SetPrefix(FileStorePrefix)
-	exists := fs.Exists(params["name"])
-	if exists {
-		err := fs.Delete(params["name"])
+	if inherit {
+		fs := fileStore.FileStore{}
+		fs.SetPrefix(FileStorePrefix)
+		tree, err := hierarchy.LoadAncestors(&fs, site)
 		if err != nil {
-			sendError(w, err.Error())
-			return
-		} else {
-			sendSuccess(w, "Site Deleted")
+			sendError(w, r, err.Error())
 			return
 		}
-	} else {
-		sendError(w, "Site does not exist")
-		return
+		site = tree.Inherited(site)
 	}
+
+	CountClicks(&site)
+	sendResponse(w, r, 200, site)
 }
 
-func GetAPs(w http.ResponseWriter, r *http.Request) {
-	site, err := GetSiteFromStore(w, r)
+// List the children of a site, or every site below it with recursive.
+func GetChildren(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseListFilter(r)
 	if err != nil {
-		sendError(w, err.Error())
+		sendError(w, r, err.Error())
 		return
 	}
-
-	json.NewEncoder(w).Encode(site.Access_points)
+	recursive, err := boolQuery(r, "recursive")
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	tree, site, err := loadSiteTree(r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	children := tree.Children(site.Name)
+	if recursive {
+		children = tree.Descendants(site.Name)
+	}
+	sendSiteTree(w, r, tree, children, &filter)
 }
 
-func GetAP(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	site, err := GetSiteFromStore(w, r)
+// List the parent of a site, then its parent, up to the top.
+func GetAncestors(w http.ResponseWriter, r *http.Request) {
+	tree, site, err := loadSiteTree(r)
 	if err != nil {
-		sendError(w, err.Error())
+		sendError(w, r, err.Error())
 		return
 	}
+	sendSiteTree(w, r, tree, tree.Ancestors(site.Name), nil)
+}
 
-
-	// Find the accesspoint
-	var ap entities.AccessPoint
-	for _, site_ap := range site.Access_points {
-		if site_ap.Label == params["label"] {
-			ap = site_ap
-			break
-		}
+func loadSiteTree(r *http.Request) (*hierarchy.Tree, entities.Site, error) {
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	tree, err := hierarchy.Load(&fs)
+	if err != nil {
+		return nil, entities.Site{}, err
 	}
+	site, ok := tree.Site(mux.Vars(r)["name"])
+	if !ok {
+		return nil, site, errors.New("Site does not exist")
+	}
+	return tree, site, nil
+}
 
-	// ap doesn't exist
-	if (entities.AccessPoint{}) == ap {
-		sendError(w, "Access point does not exist")
+// List sites from tree, with what they inherit if asked to and only those
+// matching filter if there is one.
+func sendSiteTree(w http.ResponseWriter, r *http.Request, tree *hierarchy.Tree, sites []entities.Site, filter *ListFilter) {
+	inherit, err := boolQuery(r, "inherit")
+	if err != nil {
+		sendError(w, r, err.Error())
 		return
 	}
-
-	json.NewEncoder(w).Encode(ap)
+	list := NewListWriter(w, r, "Sites")
+	for _, site := range sites {
+		if inherit {
+			site = tree.Inherited(site)
+		}
+		if filter != nil {
+			if !filter.Matches(site.Tags, site.Labels, site.Audit) {
+				continue
+			}
+			if !filter.IncludeDisabled && site.InMaintenance(time.Now()) {
+				continue
+			}
+		}
+		CountClicks(&site)
+		list.Write(site)
+	}
+	list.Close()
 }
 
-func CreateUpdateAP(w http.ResponseWriter, r *http.Request, op string) {
-	// Get the site
-	site, err := GetSiteFromStore(w, r)
+// What happens to the children of a deleted site, from the children query
+// parameter.
+const (
+	// Sites with children are not deleted. The default.
+	DeleteRestrict = "restrict"
+	// Every site below the deleted one is deleted with it.
+	DeleteCascade = "cascade"
+	// The children are kept, without a parent.
+	DeleteOrphan = "orphan"
+)
+
+func DeleteSite(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	policy := r.URL.Query().Get("children")
+	if policy == "" {
+		policy = DeleteRestrict
+	}
+	if policy != DeleteRestrict && policy != DeleteCascade && policy != DeleteOrphan {
+		sendError(w, r, "children must be restrict, cascade or orphan")
+		return
+	}
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	descendants, err := siteIndex.Descendants(params["name"])
 	if err != nil {
-		sendError(w, err.Error())
+		sendError(w, r, err.Error())
+		return
 	}
+	site_names := append([]string{params["name"]}, descendants...)
+	defer fileStore.Lock(site_names...)()
 
-	// Parse the access point
-	var ap entities.AccessPoint
-	_ = json.NewDecoder(r.Body).Decode(&ap)
-
-	// Check for accesspoint label
-	found := 0
-	for i := 0; i < len(site.Access_points); i++ {
-		// Label exists in system.
-		if site.Access_points[i].Label == ap.Label {
-			found = 1
-			if op == "create" {
-				// Fail if trying to create.
-				sendError(w, "Access Point already exists")
-				return
-			} else if op == "update" {
-				// Otherwise update.
-				site.Access_points[i].Url = ap.Url
-				break;
-			}
+	// Check if site exists in the File Store.
+	exists := fs.Exists(params["name"])
+	if exists && len(site_names) > 1 {
+		if policy == DeleteRestrict {
+			sendError(w, r, "Site has children, delete them first or use children=cascade or children=orphan")
+			return
 		}
+		deleteWithChildren(w, r, &fs, site_names, policy)
+		return
 	}
-
-	// Label does not exit.
-	if found == 0 {
-		if op == "create" {
-			// Add new label.
-			site.Access_points = append(site.Access_points, ap)
+	if exists {
+		// The site is removed from groups along with its file.
+		tx := fs.Begin()
+		err := batch.DeleteSites(tx, params["name"])
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
 		} else {
-			// Fail if trying to edit or delete.
-			sendError(w, "Access Point does not exist")
+			sendSuccess(w, r, "Site Deleted")
 			return
 		}
+	} else {
+		sendError(w, r, "Site does not exist")
+		return
 	}
+}
 
-	// Rewrite entire site to file - I think this is easier than piece-wise update
-	err = WriteSiteToStore(site)
+// Put a site in maintenance, or change the reason or end time of its
+// maintenance.
+func StartMaintenance(w http.ResponseWriter, r *http.Request) {
+	var maintenance entities.Maintenance
+	err := decodeBody(r, &maintenance)
 	if err != nil {
-		sendError(w, err.Error())
+		sendError(w, r, err.Error())
 		return
-	} else {
-		// Set the proper response code and return the created item.
-		w.WriteHeader(200)
-		json.NewEncoder(w).Encode(ap)
 	}
-}
-
-func DeleteAP(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+	defer fileStore.Lock(mux.Vars(r)["name"])()
 
 	site, err := GetSiteFromStore(w, r)
 	if err != nil {
-		sendError(w, err.Error())
+		sendError(w, r, err.Error())
 		return
 	}
-
-	// Find the accesspoint
-	found := 0
-	for i, site_ap := range site.Access_points {
-		// if we find it, remove it by slice
-		if site_ap.Label == params["label"] {
-			found = 1
-			site.Access_points[i] = site.Access_points[0]
-			site.Access_points = site.Access_points[1:]
-			break
-		}
+	now := time.Now().UTC()
+	if site.InMaintenance(now) {
+		maintenance.StartedAt = site.Maintenance.StartedAt
+		maintenance.StartedBy = site.Maintenance.StartedBy
+	} else {
+		maintenance.StartedAt = &now
+		maintenance.StartedBy = Actor(r)
 	}
-
-	// ap doesn't exist
-	if found == 0 {
-		sendError(w, "Access point does not exist")
+	site.Maintenance = &maintenance
+	err = site.Validate()
+	if err != nil {
+		sendInvalid(w, r, err)
 		return
 	}
-
-	// Write changes to site
-	err = WriteSiteToStore(site)
+	err = WriteSiteToStore(&site, Actor(r))
 	if err != nil {
-		sendError(w, err.Error())
+		sendError(w, r, err.Error())
 		return
 	}
-
-	sendSuccess(w, "Access point Deleted")
+	CountClicks(&site)
+	sendResponse(w, r, 200, site)
 }
 
-func APHandler(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	ap_label := params["label"]
+func EndMaintenance(w http.ResponseWriter, r *http.Request) {
+	defer fileStore.Lock(mux.Vars(r)["name"])()
 
-	if r.Method == "GET" || len(r.Method) == 0 {
-		if ap_label != "" {
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	if site.Maintenance == nil {
+		sendError(w, r, "Site is not in maintenance")
+		return
+	}
+	site.Maintenance = nil
+	err = WriteSiteToStore(&site, Actor(r))
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	CountClicks(&site)
+	sendResponse(w, r, 200, site)
+}
+
+// Delete site_names[0], and the sites below it, site_names[1:], too for
+// cascade or keep them without a parent for orphan.
+func deleteWithChildren(w http.ResponseWriter, r *http.Request, fs *fileStore.FileStore, site_names []string, policy string) {
+	tx := fs.Begin()
+	deleted := site_names[:1]
+	if policy == DeleteCascade {
+		deleted = site_names
+	}
+	err := batch.DeleteSites(tx, deleted...)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	if policy == DeleteOrphan {
+		children, err := siteIndex.Children(site_names[0])
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		for _, child_name := range children {
+			child, err := LoadSite(fs, child_name)
+			if err != nil {
+				sendError(w, r, err.Error())
+				return
+			}
+			if child.Parent != site_names[0] {
+				continue
+			}
+			child.Parent = ""
+			err = writeSiteTx(tx, &child, Actor(r))
+			if err != nil {
+				sendError(w, r, err.Error())
+				return
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		sendErrorCode(w, r, 500, err.Error())
+		return
+	}
+	sendSuccess(w, r, "Site Deleted")
+}
+
+// Rename a site, moving its file and access points in one transaction.
+func RenameSite(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	var rename entities.RenameRequest
+	err := decodeBody(r, &rename)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	// Children are changed to name the site by its new name.
+	children, err := siteIndex.Children(params["name"])
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	site_names := append([]string{params["name"], rename.NewName}, children...)
+	defer fileStore.Lock(site_names...)()
+
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	if rename.NewName == site.Name {
+		sendError(w, r, "Site already has this name")
+		return
+	}
+
+	old_site := site
+	site.Name = rename.NewName
+	err = site.Validate()
+	if err != nil {
+		sendInvalid(w, r, err)
+		return
+	}
+	if fs.Exists(site.Name) {
+		sendError(w, r, "A site already exists with this name")
+		return
+	}
+
+	site.Stamp(&old_site, Actor(r), time.Now().UTC())
+	site_json, err := schema.EncodeSite(&site)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	tx := fs.Begin()
+	tx.Write(site.Name, site_json)
+	tx.Delete(params["name"])
+	for _, child_name := range children {
+		child, err := LoadSite(&fs, child_name)
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		if child.Parent != params["name"] {
+			continue
+		}
+		child.Parent = site.Name
+		err = writeSiteTx(tx, &child, Actor(r))
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+	}
+	err = renameGroupMembers(tx, params["name"], site.Name)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	err = aliases.Rename(tx, params["name"], site.Name, rename.Redirect)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	// Counts are moved before the commit prunes those of the old name.
+	clickCounter.Rename(params["name"], site.Name)
+	err = tx.Commit()
+	if err != nil {
+		clickCounter.Rename(site.Name, params["name"])
+		sendErrorCode(w, r, 500, err.Error())
+		return
+	}
+	sendResponse(w, r, 200, site)
+}
+
+func GetAPs(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseListFilter(r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	CountClicks(&site)
+	list := NewListWriter(w, r, "AccessPoints")
+	for _, ap := range site.Access_points {
+		if !filter.Matches(ap.Tags, ap.Labels, ap.Audit) {
+			continue
+		}
+		if !filter.IncludeDisabled && !ap.IsEnabled() {
+			continue
+		}
+		list.Write(ap)
+	}
+	list.Close()
+}
+
+// What a listing is filtered by, from the selector, tag and updated_since
+// query parameters. Only items matching all of them are listed.
+type ListFilter struct {
+	Selector entities.Selector
+	Tags []string
+	UpdatedSince *time.Time
+	// From include_disabled. Disabled access points and sites in
+	// maintenance are left out unless it is set.
+	IncludeDisabled bool
+}
+
+func ParseListFilter(r *http.Request) (ListFilter, error) {
+	query := r.URL.Query()
+	var filter ListFilter
+	var err error
+	filter.Selector, err = entities.ParseSelector(query.Get("selector"))
+	if err != nil {
+		return filter, err
+	}
+	filter.Tags = query["tag"]
+	if since := query.Get("updated_since"); since != "" {
+		updated_since, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, errors.New("updated_since must be an RFC 3339 time")
+		}
+		filter.UpdatedSince = &updated_since
+	}
+	filter.IncludeDisabled, err = boolQuery(r, "include_disabled")
+	if err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// Read a query parameter that is true or false, false if not given.
+func boolQuery(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New(name + " must be true or false")
+	}
+	return parsed, nil
+}
+
+func (filter *ListFilter) Matches(tags []string, labels map[string]string, audit entities.Audit) bool {
+	if filter.UpdatedSince != nil && !audit.UpdatedSince(*filter.UpdatedSince) {
+		return false
+	}
+	return filter.Selector.Matches(labels) && entities.HasTags(tags, filter.Tags)
+}
+
+func GetAP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+
+	// Find the accesspoint
+	var ap entities.AccessPoint
+	found := 0
+	for _, site_ap := range site.Access_points {
+		if site_ap.Label == params["label"] {
+			ap = site_ap
+			found = 1
+			break
+		}
+	}
+
+	// ap doesn't exist
+	if found == 0 {
+		sendError(w, r, "Access point does not exist")
+		return
+	}
+
+	ap.Clicks = clickCounter.Count(site.Name, ap.Label)
+	sendResponse(w, r, 200, ap)
+}
+
+func CreateUpdateAP(w http.ResponseWriter, r *http.Request, op string) {
+	// Hold the site while it is read, changed and written back.
+	defer fileStore.Lock(mux.Vars(r)["name"])()
+
+	// Get the site
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	// Parse the access point
+	var ap entities.AccessPoint
+	err = decodeBody(r, &ap)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	// Check for accesspoint label
+	found := 0
+	for i := 0; i < len(site.Access_points); i++ {
+		// Label exists in system.
+		if site.Access_points[i].Label == ap.Label {
+			found = 1
+			if op == "create" {
+				// Fail if trying to create.
+				sendError(w, r, "Access Point already exists")
+				return
+			} else if op == "update" {
+				// Otherwise replace it, tags and labels included.
+				site.Access_points[i] = ap
+				break;
+			}
+		}
+	}
+
+	// Label does not exit.
+	if found == 0 {
+		if op == "create" {
+			// Add new label.
+			site.Access_points = append(site.Access_points, ap)
+		} else {
+			// Fail if trying to edit or delete.
+			sendError(w, r, "Access Point does not exist")
+			return
+		}
+	}
+	err = site.Validate()
+	if err == nil {
+		fs := fileStore.FileStore{}
+		fs.SetPrefix(FileStorePrefix)
+		err = CheckSites(&fs, site)
+	}
+	if err != nil {
+		sendInvalid(w, r, err)
+		return
+	}
+
+	// Rewrite entire site to file - I think this is easier than piece-wise update
+	err = WriteSiteToStore(&site, Actor(r))
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	} else {
+		// Set the proper response code and return the created item, as
+		// stamped when it was written.
+		for _, site_ap := range site.Access_points {
+			if site_ap.Label == ap.Label {
+				ap = site_ap
+			}
+		}
+		sendResponse(w, r, 200, ap)
+	}
+}
+
+// Set the order of every access point of a site at once.
+func ReorderAPs(w http.ResponseWriter, r *http.Request) {
+	var reorder entities.ReorderRequest
+	err := decodeBody(r, &reorder)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	defer fileStore.Lock(mux.Vars(r)["name"])()
+
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	if len(reorder.Labels) != len(site.Access_points) {
+		sendError(w, r, "Every access point must be listed exactly once")
+		return
+	}
+	positions := make(map[string]int)
+	for i, label := range reorder.Labels {
+		if _, ok := positions[label]; ok {
+			sendError(w, r, "Every access point must be listed exactly once")
+			return
+		}
+		positions[label] = i + 1
+	}
+	for i, ap := range site.Access_points {
+		position, ok := positions[ap.Label]
+		if !ok {
+			sendError(w, r, "Access point " + ap.Label + " is not listed")
+			return
+		}
+		site.Access_points[i].Priority = position
+	}
+
+	err = WriteSiteToStore(&site, Actor(r))
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	CountClicks(&site)
+	sendResponse(w, r, 200, site.Access_points)
+}
+
+func EnableAP(w http.ResponseWriter, r *http.Request) {
+	SetAPEnabled(w, r, true)
+}
+
+func DisableAP(w http.ResponseWriter, r *http.Request) {
+	SetAPEnabled(w, r, false)
+}
+
+// Take an access point in or out of rotation without otherwise changing it.
+func SetAPEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	params := mux.Vars(r)
+	defer fileStore.Lock(params["name"])()
+
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	index := -1
+	for i, ap := range site.Access_points {
+		if ap.Label == params["label"] {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		sendError(w, r, "Access point does not exist")
+		return
+	}
+	site.Access_points[index].Enabled = &enabled
+
+	label := site.Access_points[index].Label
+	err = WriteSiteToStore(&site, Actor(r))
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	for _, ap := range site.Access_points {
+		if ap.Label == label {
+			ap.Clicks = clickCounter.Count(site.Name, ap.Label)
+			sendResponse(w, r, 200, ap)
+		}
+	}
+}
+
+func DeleteAP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	defer fileStore.Lock(params["name"])()
+
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	// Find the accesspoint
+	found := 0
+	for i, site_ap := range site.Access_points {
+		// if we find it, remove it by slice
+		if site_ap.Label == params["label"] {
+			found = 1
+			// Keep the other access points in order.
+			site.Access_points = append(site.Access_points[:i], site.Access_points[i + 1:]...)
+			break
+		}
+	}
+
+	// ap doesn't exist
+	if found == 0 {
+		sendError(w, r, "Access point does not exist")
+		return
+	}
+
+	// Write changes to site
+	err = WriteSiteToStore(&site, Actor(r))
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	sendSuccess(w, r, "Access point Deleted")
+}
+
+// Lock the named sites and every stored site, returning the function that
+// unlocks them. Sites created before the lock was taken are locked too by
+// listing the sites again until no new one appears.
+func lockAllSites(fs *fileStore.FileStore, site_names []string) (func(), error) {
+	for {
+		stored, err := fs.GetFiles()
+		if err != nil {
+			return nil, err
+		}
+		unlock := fileStore.Lock(append(stored, site_names...)...)
+		again, err := fs.GetFiles()
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		locked := make(map[string]bool)
+		for _, site_name := range stored {
+			locked[site_name] = true
+		}
+		complete := true
+		for _, site_name := range again {
+			complete = complete && locked[site_name]
+		}
+		if complete {
+			return unlock, nil
+		}
+		unlock()
+	}
+}
+
+// Load every site in the File Store as JSON keyed by site name.
+func LoadAllSites() (map[string][]byte, error) {
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	site_names, err := fs.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	sites := make(map[string][]byte)
+	for _, site_name := range site_names {
+		file_data, err := fs.Load(site_name)
+		if err != nil {
+			return nil, err
+		}
+		site, err := schema.DecodeSite(file_data)
+		if err != nil {
+			return nil, err
+		}
+		site_json, err := site.ToJson()
+		if err != nil {
+			return nil, err
+		}
+		sites[site_name] = site_json
+	}
+	return sites, nil
+}
+
+// Every site in the File Store.
+func StoredSites() ([]entities.Site, error) {
+	stored, err := LoadAllSites()
+	if err != nil {
+		return nil, err
+	}
+	var sites []entities.Site
+	for _, site_name := range sortedNames(stored) {
+		site, err := entities.SiteFromJson(stored[site_name])
+		if err != nil {
+			return nil, err
+		}
+		sites = append(sites, site)
+	}
+	return sites, nil
+}
+
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = archiveFormat(r.Header.Get("Accept"))
+	}
+	content_types := map[string]string{
+		inventory.Json: "application/json",
+		inventory.NDJson: "application/x-ndjson",
+		inventory.TarGz: "application/gzip",
+	}
+	content_type, ok := content_types[format]
+	if !ok {
+		sendError(w, r, "Unknown export format: " + format)
+		return
+	}
+
+	sites, err := LoadAllSites()
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	var files []inventory.SiteFile
+	for _, site_name := range sortedNames(sites) {
+		files = append(files, inventory.SiteFile{Name: site_name, Data: sites[site_name]})
+	}
+
+	w.Header().Set("Content-Type", content_type)
+	if format == inventory.TarGz {
+		w.Header().Set("Content-Disposition", "attachment; filename=\"sites.tar.gz\"")
+	}
+	err = inventory.Write(w, format, files)
+	if err != nil {
+		log.Println("Export failed:", err)
+	}
+}
+
+// Import an archive of sites as a single transaction. With dry_run=true
+// only the changes that would be made are reported.
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = inventory.CreateOnly
+	}
+	dry_run := r.URL.Query().Get("dry_run") == "true"
+
+	sites, err := inventory.Read(r.Body, archiveFormat(r.Header.Get("Content-Type")))
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	// The existing sites are loaded and planned against under the lock, so
+	// no site is changed or created behind the import's back.
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	var site_names []string
+	for _, site := range sites {
+		site_names = append(site_names, site.Name)
+	}
+	unlock, err := lockAllSites(&fs, site_names)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	defer unlock()
+	existing, err := LoadAllSites()
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	plan, err := inventory.MakePlan(mode, sites, existing)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	plan.DryRun = dry_run
+
+	tx := fs.Begin()
+	for _, site := range sites {
+		err = writeSiteTx(tx, &site, Actor(r))
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+	}
+	err = batch.DeleteSites(tx, plan.Deleted...)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	// Parents may be imported along with their children, and Urls moved
+	// between them, so they are checked against the store as the import
+	// leaves it.
+	tree, err := hierarchy.LoadAncestors(tx, sites...)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	check_urls, err := checkUrls(tx)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	var violations []entities.Violation
+	for _, site := range sites {
+		for _, violation := range append(tree.Check(site.Name), check_urls(&site)...) {
+			violation.Message = site.Name + ": " + violation.Message
+			violations = append(violations, violation)
+		}
+	}
+	if len(violations) > 0 {
+		sendInvalid(w, r, &entities.ValidationError{Violations: violations})
+		return
+	}
+	if dry_run {
+		sendResponse(w, r, 200, plan)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		sendErrorCode(w, r, 500, err.Error())
+		return
+	}
+	sendResponse(w, r, 200, plan)
+}
+
+// Remove the sites and access points that expired by now. Each site is
+// changed in a batch of its own, so that one failure does not hold up the
+// others. Only the sites expiryIndex has as due are read.
+func ReapExpired(fs *fileStore.FileStore, now time.Time) {
+	site_names, err := expiryIndex.Due(now)
+	if err != nil {
+		log.Println("Removing expired items failed:", err)
+		return
+	}
+	for _, site_name := range site_names {
+		site, err := LoadSite(fs, site_name)
+		if err != nil {
+			log.Println("Removing expired items of", site_name, "failed:", err)
+			continue
+		}
+		var operations []batch.Operation
+		if site.Expired(now) {
+			// Sites with children are removed once their children are.
+			children, err := siteIndex.Children(site.Name)
+			if err != nil {
+				log.Println("Removing expired items of", site_name, "failed:", err)
+				continue
+			}
+			if len(children) > 0 {
+				continue
+			}
+			operations = append(operations, batch.Operation{Op: batch.DeleteSite, Name: site.Name})
+		} else {
+			for _, ap := range site.Access_points {
+				if ap.Expired(now) {
+					operations = append(operations, batch.Operation{Op: batch.DeleteAP, Name: site.Name, Label: ap.Label})
+				}
+			}
+		}
+		if len(operations) == 0 {
+			continue
+		}
+		_, err = batch.Apply(fs, operations, ExpiryActor)
+		if err != nil {
+			log.Println("Removing expired items of", site.Name, "failed:", err)
+		}
+	}
+}
+
+func GetScheduledChanges(w http.ResponseWriter, r *http.Request) {
+	sendResponse(w, r, 200, scheduler.List())
+}
+
+func GetScheduledChange(w http.ResponseWriter, r *http.Request) {
+	change, ok := scheduler.Get(mux.Vars(r)["id"])
+	if !ok {
+		sendErrorCode(w, r, 404, "Scheduled change does not exist")
+		return
+	}
+	sendResponse(w, r, 200, change)
+}
+
+// Schedule batch operations to be applied at a later time.
+func ScheduleChange(w http.ResponseWriter, r *http.Request) {
+	var change schedule.Change
+	err := decodeBody(r, &change)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	change.CreatedBy = Actor(r)
+	change, err = scheduler.Add(change)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	sendResponse(w, r, 200, change)
+}
+
+func CancelScheduledChange(w http.ResponseWriter, r *http.Request) {
+	found, err := scheduler.Remove(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	if !found {
+		sendErrorCode(w, r, 404, "Scheduled change does not exist")
+		return
+	}
+	sendSuccess(w, r, "Scheduled change cancelled")
+}
+
+// Apply a list of operations atomically, reporting the result of each.
+func BatchHandler(w http.ResponseWriter, r *http.Request) {
+	var operations []batch.Operation
+	err := decodeBody(r, &operations)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	results, err := batch.Apply(&fs, operations, Actor(r))
+	if err != nil {
+		sendResponse(w, r, 400, batch.Response{Committed: false, Results: results})
+		return
+	}
+	sendResponse(w, r, 200, batch.Response{Committed: true, Results: results})
+}
+
+// Archive format named by an Accept or Content-Type header.
+func archiveFormat(media_type string) string {
+	switch {
+	case strings.Contains(media_type, "gzip"):
+		return inventory.TarGz
+	case strings.Contains(media_type, "ndjson"):
+		return inventory.NDJson
+	default:
+		return inventory.Json
+	}
+}
+
+func sortedNames(sites map[string][]byte) []string {
+	var names []string
+	for name := range sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Create a site with a new name and the same fields and access points
+// as an existing one.
+func CloneSite(w http.ResponseWriter, r *http.Request) {
+	var clone entities.CloneRequest
+	err := decodeBody(r, &clone)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	site.Name = clone.Name
+	createNewSite(w, r, site)
+}
+
+// Validate and store a site that must not exist yet. It starts out of
+// maintenance, whatever it was made from.
+func createNewSite(w http.ResponseWriter, r *http.Request, site entities.Site) {
+	site.Maintenance = nil
+	err := site.Validate()
+	if err != nil {
+		sendInvalid(w, r, err)
+		return
+	}
+	defer fileStore.Lock(site.Name)()
+
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	if fs.Exists(site.Name) {
+		sendError(w, r, "A site already exists with this name")
+		return
+	}
+	err = CheckSites(&fs, site)
+	if err != nil {
+		sendInvalid(w, r, err)
+		return
+	}
+	err = WriteSiteToStore(&site, Actor(r))
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	sendResponse(w, r, 200, site)
+}
+
+func GetTemplates(w http.ResponseWriter, r *http.Request) {
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(TemplateStorePrefix)
+	template_names, err := fs.GetFiles()
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	list := NewListWriter(w, r, "Templates")
+	for _, template_name := range template_names {
+		template, err := loadTemplate(template_name)
+		if err != nil {
+			list.Fail(err)
+			return
+		}
+		list.Write(template)
+	}
+	list.Close()
+}
+
+func GetTemplate(w http.ResponseWriter, r *http.Request) {
+	template, err := loadTemplate(mux.Vars(r)["template"])
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	sendResponse(w, r, 200, template)
+}
+
+// Templates are created or replaced as a whole.
+func CreateUpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	var template entities.Template
+	err := decodeBody(r, &template)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	err = template.Validate()
+	if err != nil {
+		sendInvalid(w, r, err)
+		return
+	}
+
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(TemplateStorePrefix)
+	exists := fs.Exists(template.Name)
+	if r.Method == "POST" && exists {
+		sendError(w, r, "A template already exists with this name")
+		return
+	} else if r.Method == "PUT" && !exists {
+		sendError(w, r, "Template does not exist")
+		return
+	}
+
+	template_json, err := schema.Encode(&template)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	err = fs.Write(template.Name, template_json)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	sendResponse(w, r, 200, template)
+}
+
+func DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	template_name := mux.Vars(r)["template"]
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(TemplateStorePrefix)
+	if !entities.ValidSiteName(template_name) || !fs.Exists(template_name) {
+		sendError(w, r, "Template does not exist")
+		return
+	}
+	err := fs.Delete(template_name)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	sendSuccess(w, r, "Template Deleted")
+}
+
+// Create a site from a template, filling in its variables.
+func InstantiateTemplate(w http.ResponseWriter, r *http.Request) {
+	var instantiate entities.InstantiateRequest
+	err := decodeBody(r, &instantiate)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	template, err := loadTemplate(mux.Vars(r)["template"])
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	site, err := template.Instantiate(instantiate.Name, instantiate.Variables)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	createNewSite(w, r, site)
+}
+
+func loadTemplate(template_name string) (entities.Template, error) {
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(TemplateStorePrefix)
+	if !entities.ValidSiteName(template_name) || !fs.Exists(template_name) {
+		return entities.Template{}, errors.New("Template does not exist")
+	}
+	file_data, err := fs.Load(template_name)
+	if err != nil {
+		return entities.Template{}, err
+	}
+	var template entities.Template
+	_, err = schema.Decode(file_data, &template)
+	return template, err
+}
+
+func GetGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := loadGroups()
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	list := NewListWriter(w, r, "Groups")
+	for _, group := range groups {
+		list.Write(group)
+	}
+	list.Close()
+}
+
+func GetGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := loadGroup(mux.Vars(r)["group"])
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	sendResponse(w, r, 200, group)
+}
+
+// Groups are created or replaced as a whole.
+func CreateUpdateGroup(w http.ResponseWriter, r *http.Request) {
+	var group entities.Group
+	err := decodeBody(r, &group)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	err = group.Validate()
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(GroupStorePrefix)
+	exists := fs.Exists(group.Name)
+	if r.Method == "POST" && exists {
+		sendError(w, r, "A group already exists with this name")
+		return
+	} else if r.Method == "PUT" && !exists {
+		sendError(w, r, "Group does not exist")
+		return
+	}
+
+	group_json, err := schema.Encode(&group)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	err = fs.Write(group.Name, group_json)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	sendResponse(w, r, 200, group)
+}
+
+func DeleteGroup(w http.ResponseWriter, r *http.Request) {
+	group_name := mux.Vars(r)["group"]
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(GroupStorePrefix)
+	if !entities.ValidSiteName(group_name) || !fs.Exists(group_name) {
+		sendError(w, r, "Group does not exist")
+		return
+	}
+	err := fs.Delete(group_name)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	sendSuccess(w, r, "Group Deleted")
+}
+
+// List the sites in a group, filtered as GET /sites is.
+func GetGroupSites(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseListFilter(r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	tree, members, err := groupMembers(r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	sendSiteTree(w, r, tree, members, &filter)
+}
+
+// List the access points of every site in a group, each with the name of
+// its site. The filters apply to the access points, and sites in
+// maintenance are left out unless include_disabled is set.
+func GetGroupAPs(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseListFilter(r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	_, members, err := groupMembers(r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	list := NewListWriter(w, r, "AccessPoints")
+	now := time.Now()
+	for _, site := range members {
+		if !filter.IncludeDisabled && site.InMaintenance(now) {
+			continue
+		}
+		CountClicks(&site)
+		for _, ap := range site.Access_points {
+			if !filter.Matches(ap.Tags, ap.Labels, ap.Audit) {
+				continue
+			}
+			if !filter.IncludeDisabled && !ap.IsEnabled() {
+				continue
+			}
+			list.Write(entities.SiteAccessPoint{Site: site.Name, AccessPoint: ap})
+		}
+	}
+	list.Close()
+}
+
+// The sites in the group named in the request, by name. Sites are matched
+// with what they inherit from their ancestors.
+func groupMembers(r *http.Request) (*hierarchy.Tree, []entities.Site, error) {
+	group, err := loadGroup(mux.Vars(r)["group"])
+	if err != nil {
+		return nil, nil, err
+	}
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	tree, err := hierarchy.Load(&fs)
+	if err != nil {
+		return nil, nil, err
+	}
+	site_names, err := fs.GetFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	var members []entities.Site
+	for _, site_name := range site_names {
+		site, ok := tree.Site(site_name)
+		if !ok {
+			continue
+		}
+		inherited := tree.Inherited(site)
+		if group.Contains(&inherited) {
+			members = append(members, site)
+		}
+	}
+	return tree, members, nil
+}
+
+func loadGroup(group_name string) (entities.Group, error) {
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(GroupStorePrefix)
+	if !entities.ValidSiteName(group_name) || !fs.Exists(group_name) {
+		return entities.Group{}, errors.New("Group does not exist")
+	}
+	file_data, err := fs.Load(group_name)
+	if err != nil {
+		return entities.Group{}, err
+	}
+	var group entities.Group
+	_, err = schema.Decode(file_data, &group)
+	return group, err
+}
+
+func loadGroups() ([]entities.Group, error) {
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(GroupStorePrefix)
+	group_names, err := fs.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	var groups []entities.Group
+	for _, group_name := range group_names {
+		group, err := loadGroup(group_name)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// Change the groups that list old_name as a member to list new_name, in tx
+// so that they change along with the site.
+func renameGroupMembers(tx *fileStore.Transaction, old_name string, new_name string) error {
+	groups, err := loadGroups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if !group.RenameMember(old_name, new_name) {
+			continue
+		}
+		group_json, err := schema.Encode(&group)
+		if err != nil {
+			return err
+		}
+		tx.Write(GroupDirectory + group.Name, group_json)
+	}
+	return nil
+}
+
+// Remove site_names from the groups that list them as members, in tx so
+// that they change along with the sites.
+func removeGroupMembers(tx *fileStore.Transaction, site_names ...string) error {
+	groups, err := loadGroups()
+	if err != nil {
+		return err
+	}
+	for _, stored := range groups {
+		// Read the group as tx has it, an earlier deletion in the same
+		// batch may have changed it already.
+		file_data, err := tx.Load(GroupDirectory + stored.Name)
+		if err != nil {
+			return err
+		}
+		var group entities.Group
+		_, err = schema.Decode(file_data, &group)
+		if err != nil {
+			return err
+		}
+		removed := false
+		for _, site_name := range site_names {
+			if group.RemoveMember(site_name) {
+				removed = true
+			}
+		}
+		if !removed {
+			continue
+		}
+		group_json, err := schema.Encode(&group)
+		if err != nil {
+			return err
+		}
+		tx.Write(GroupDirectory + group.Name, group_json)
+	}
+	return nil
+}
+
+// Every access point in the File Store, for the prober to check.
+func ProbeTargets() ([]prober.Target, error) {
+	sites, err := StoredSites()
+	if err != nil {
+		return nil, err
+	}
+	var targets []prober.Target
+	for _, site := range sites {
+		for _, ap := range site.Access_points {
+			targets = append(targets, prober.Target{Site: site.Name, Label: ap.Label, Url: ap.Url})
+		}
+	}
+	return targets, nil
+}
+
+// The latest check results of every access point of a site.
+func SiteHealthHandler(w http.ResponseWriter, r *http.Request) {
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	access_points := []prober.Health{}
+	for _, ap := range site.Access_points {
+		access_points = append(access_points, probes.Status(site.Name, ap.Label, ap.Url))
+	}
+	sendResponse(w, r, 200, prober.Rollup(site.Name, access_points))
+}
+
+// The latest check results of an access point, with its recent history.
+func APHealthHandler(w http.ResponseWriter, r *http.Request) {
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	for _, ap := range site.Access_points {
+		if ap.Label == mux.Vars(r)["label"] {
+			sendResponse(w, r, 200, probes.Status(site.Name, ap.Label, ap.Url))
+			return
+		}
+	}
+	sendError(w, r, "Access point does not exist")
+}
+
+// Pick one access point of a site with the strategy query parameter,
+// round-robin by default. The candidates can be narrowed with the same
+// filters as the access point listing.
+func ResolveHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseListFilter(r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	site, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	if !filter.IncludeDisabled && site.InMaintenance(time.Now()) {
+		sendErrorCode(w, r, 503, "Site is in maintenance: " + site.Maintenance.Reason)
+		return
+	}
+
+	var candidates []resolver.Candidate
+	for _, ap := range site.Access_points {
+		if !filter.Matches(ap.Tags, ap.Labels, ap.Audit) {
+			continue
+		}
+		if !filter.IncludeDisabled && !ap.IsEnabled() {
+			continue
+		}
+		health := probes.Status(site.Name, ap.Label, ap.Url)
+		candidates = append(candidates, resolver.Candidate{AccessPoint: ap, Status: health.Status, LatencyMs: health.LatencyMs})
+	}
+	picked, err := siteResolver.Pick(site.Name, r.URL.Query().Get("strategy"), candidates)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	sendResponse(w, r, 200, picked.AccessPoint)
+}
+
+// Redirect a short link to the Url of the access point it names.
+func GoHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	site_name := params["site"]
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	if !entities.ValidSiteName(site_name) {
+		site_name = ""
+	} else if current, ok := aliases.Lookup(&fs, site_name); ok && !fs.Exists(site_name) {
+		// Short links keep working when a site is renamed.
+		site_name = current
+	}
+
+	target := ""
+	if site_name != "" && fs.Exists(site_name) {
+		file_data, err := fs.Load(site_name)
+		if err != nil {
+			sendErrorCode(w, r, 500, err.Error())
+			return
+		}
+		site, err := schema.DecodeSite(file_data)
+		if err != nil {
+			sendErrorCode(w, r, 500, err.Error())
+			return
+		}
+		// As for resolution, sites in maintenance and disabled access
+		// points are not redirected to.
+		if site.InMaintenance(time.Now()) {
+			sendErrorCode(w, r, 503, "Site is in maintenance: " + site.Maintenance.Reason)
+			return
+		}
+		for _, ap := range site.Access_points {
+			if ap.Label == params["label"] && ap.Url != "" && ap.IsEnabled() {
+				target = ap.Url
+				clickCounter.Add(site.Name, ap.Label)
+			}
+		}
+	}
+
+	if target == "" {
+		if redirectConfig.Fallback == "" {
+			sendErrorCode(w, r, 404, "Access point does not exist")
+			return
+		}
+		target = urls.Expand(redirectConfig.Fallback, params)
+	} else if redirectConfig.PassQuery {
+		target = urls.AddQuery(target, r.URL.RawQuery)
+	}
+
+	code := http.StatusTemporaryRedirect
+	if r.Method == "GET" || r.Method == "HEAD" {
+		code = http.StatusFound
+	}
+	http.Redirect(w, r, target, code)
+}
+
+// Forget the click counts of access points that are gone from the sites
+// written and deleted.
+func PruneClicks(written map[string][]byte, deleted []string) {
+	for site_name, file_data := range written {
+		if strings.HasPrefix(site_name, ".") {
+			continue
+		}
+		site, err := schema.DecodeSite(file_data)
+		if err != nil {
+			continue
+		}
+		var labels []string
+		for _, ap := range site.Access_points {
+			labels = append(labels, ap.Label)
+		}
+		clickCounter.Retain(site_name, labels)
+	}
+	for _, site_name := range deleted {
+		clickCounter.Retain(site_name, nil)
+	}
+}
+
+// Fill in how often each access point of site was opened by short link.
+func CountClicks(site *entities.Site) {
+	for i := range site.Access_points {
+		site.Access_points[i].Clicks = clickCounter.Count(site.Name, site.Access_points[i].Label)
+	}
+}
+
+func MoveAP(w http.ResponseWriter, r *http.Request) {
+	TransferAP(w, r, "move")
+}
+
+func CopyAP(w http.ResponseWriter, r *http.Request) {
+	TransferAP(w, r, "copy")
+}
+
+// Move or copy an access point to another site, or to a new label on the
+// same site. Both sites are locked and written in one transaction.
+func TransferAP(w http.ResponseWriter, r *http.Request, op string) {
+	params := mux.Vars(r)
+	var transfer entities.TransferRequest
+	err := decodeBody(r, &transfer)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	if transfer.Site == "" {
+		transfer.Site = params["name"]
+	}
+	if transfer.Label == "" {
+		transfer.Label = params["label"]
+	}
+	if !entities.ValidSiteName(transfer.Site) {
+		sendError(w, r, "Target site does not exist")
+		return
+	}
+	if transfer.Site == params["name"] && transfer.Label == params["label"] {
+		sendError(w, r, "Access point is already at this site and label")
+		return
+	}
+	defer fileStore.Lock(params["name"], transfer.Site)()
+
+	source, err := GetSiteFromStore(w, r)
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+	index := -1
+	for i, site_ap := range source.Access_points {
+		if site_ap.Label == params["label"] {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		sendError(w, r, "Access point does not exist")
+		return
+	}
+	ap := source.Access_points[index]
+	ap.Label = transfer.Label
+
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	target := source
+	if transfer.Site != source.Name {
+		if !fs.Exists(transfer.Site) {
+			sendError(w, r, "Target site does not exist")
+			return
+		}
+		file_data, err := fs.Load(transfer.Site)
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		target, err = schema.DecodeSite(file_data)
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+	}
+
+	if op == "move" {
+		source.Access_points = append(source.Access_points[:index:index], source.Access_points[index + 1:]...)
+		if transfer.Site == source.Name {
+			target = source
+		}
+	}
+	for _, site_ap := range target.Access_points {
+		if site_ap.Label == ap.Label {
+			sendError(w, r, "Access Point already exists")
+			return
+		}
+	}
+	target.Access_points = append(target.Access_points, ap)
+	err = target.Validate()
+	if err != nil {
+		sendInvalid(w, r, err)
+		return
+	}
+
+	tx := fs.Begin()
+	sites := []entities.Site{target}
+	if op == "move" && source.Name != target.Name {
+		sites = append(sites, source)
+	}
+	for _, site := range sites {
+		StampSite(&fs, &site, Actor(r))
+		site_json, err := schema.EncodeSite(&site)
+		if err != nil {
+			sendError(w, r, err.Error())
+			return
+		}
+		tx.Write(site.Name, site_json)
+		if site.Name == target.Name {
+			target = site
+		}
+	}
+	// A moved Url is checked against the source as it will be without it.
+	err = CheckSites(tx, target)
+	if err != nil {
+		sendInvalid(w, r, err)
+		return
+	}
+	// Counts are moved before the commit prunes those of the old label.
+	if op == "move" {
+		clickCounter.Move(source.Name, params["label"], target.Name, ap.Label)
+	}
+	err = tx.Commit()
+	if err != nil {
+		if op == "move" {
+			clickCounter.Move(target.Name, ap.Label, source.Name, params["label"])
+		}
+		sendErrorCode(w, r, 500, err.Error())
+		return
+	}
+	for _, site_ap := range target.Access_points {
+		if site_ap.Label == ap.Label {
+			ap = site_ap
+		}
+	}
+	sendResponse(w, r, 200, ap)
+}
+
+func APHandler(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	ap_label := params["label"]
+
+	if r.Method == "GET" || len(r.Method) == 0 {
+		if ap_label != "" {
 			GetAP(w, r)
 		} else {
 			GetAPs(w, r)
@@ -376,12 +2409,713 @@ func SiteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func sendError(w http.ResponseWriter, msg string) {
-	w.WriteHeader(400)
-	json.NewEncoder(w).Encode(entities.ErrorResponse{msg})
+// The process is up and able to serve requests.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	sendResponse(w, r, 200, entities.HealthResponse{Status: "ok"})
+}
+
+// The service can handle traffic: the data directory is usable and we
+// are not shutting down.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string)
+	ready := true
+
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		checks["shutdown"] = "shutting down"
+		ready = false
+	} else {
+		checks["shutdown"] = "ok"
+	}
+
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	if err := fs.CheckAccess(); err != nil {
+		checks["storage"] = err.Error()
+		ready = false
+	} else {
+		checks["storage"] = "ok"
+	}
+
+	if fs.Recovering() {
+		checks["journal"] = "an interrupted commit has not been applied"
+		ready = false
+	} else {
+		checks["journal"] = "ok"
+	}
+
+	// The index of a sharded store must be loaded, and the database of one
+	// in the database layout open.
+	if layout := fs.Layout(); layout != fileStore.Flat {
+		name := "index"
+		if layout == fileStore.Database {
+			name = "database"
+		}
+		if err := fs.Open(); err != nil {
+			checks[name] = err.Error()
+			ready = false
+		} else {
+			checks[name] = "ok"
+		}
+	}
+
+	if ready {
+		sendResponse(w, r, 200, entities.HealthResponse{Status: "ok", Checks: checks})
+	} else {
+		sendResponse(w, r, 503, entities.HealthResponse{Status: "unavailable", Checks: checks})
+	}
+}
+
+func DebugInfoHandler(w http.ResponseWriter, r *http.Request) {
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	files, total_bytes, err := fs.Stats()
+	if err != nil {
+		sendError(w, r, err.Error())
+		return
+	}
+
+	info := entities.DebugInfo{
+		Version: Version,
+		Uptime: time.Since(startTime).Round(time.Second).String(),
+		Config: map[string]string{
+			"listen_address": ListenAddress,
+			"data_directory": FileStorePrefix,
+			"shutdown_drain_delay": ShutdownDrainDelay.String(),
+		},
+		Storage: entities.StorageStats{Files: files, Bytes: total_bytes, Layout: fs.Layout()},
+	}
+	reshardMutex.Lock()
+	if reshardStatus != nil {
+		status := *reshardStatus
+		info.Storage.Reshard = &status
+	}
+	reshardMutex.Unlock()
+	sendResponse(w, r, 200, info)
+}
+
+// Progress of moving the site store to the sharded layout.
+var reshardMutex sync.Mutex
+var reshardStatus *entities.ReshardStatus
+
+// Move the site store to the sharded layout in the background, while it
+// stays in use. Progress is shown by /debug/info.
+func ReshardHandler(w http.ResponseWriter, r *http.Request) {
+	reshardMutex.Lock()
+	defer reshardMutex.Unlock()
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	// A sharded store is resharded again to finish an interrupted move.
+	if fs.Layout() != fileStore.Flat && !fs.Resharding() {
+		sendError(w, r, "Only a flat store can be resharded")
+		return
+	}
+	if reshardStatus != nil && !reshardStatus.Done {
+		sendError(w, r, "Store is already being resharded")
+		return
+	}
+
+	status := &entities.ReshardStatus{}
+	reshardStatus = status
+	go func() {
+		err := fs.Reshard(func(moved int, total int) {
+			reshardMutex.Lock()
+			status.Moved, status.Total = moved, total
+			reshardMutex.Unlock()
+		})
+		if err != nil {
+			log.Println("Resharding failed:", err)
+		}
+		reshardMutex.Lock()
+		status.Done = true
+		if err != nil {
+			status.Error = err.Error()
+		}
+		reshardMutex.Unlock()
+	}()
+	sendResponse(w, r, 202, *status)
+}
+
+// Send a copy of the site store as it is at one moment, if it is in the
+// database layout. Replacing its database file with it restores it.
+func SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	if fs.Layout() != fileStore.Database {
+		sendError(w, r, "Only a store in the database layout can be snapshot")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"snapshot.database\"")
+	if err := fs.Snapshot(w); err != nil {
+		// The status has been sent, the client sees a short snapshot.
+		log.Println("Sending a snapshot failed:", err)
+	}
+}
+
+// Writes a listing one item at a time in the representation the client
+// asked for.
+type ListWriter struct {
+	w http.ResponseWriter
+	r *http.Request
+	format representation.Format
+	encoder *representation.ListEncoder
+}
+
+// Root names the element enclosing the items in XML.
+func NewListWriter(w http.ResponseWriter, r *http.Request, root string) *ListWriter {
+	format := representation.Negotiate(r.Header.Get("Accept"))
+	return &ListWriter{w, r, format, representation.NewListEncoder(w, format, root)}
+}
+
+func (list *ListWriter) Write(item interface{}) {
+	if list.encoder.Count() == 0 {
+		list.w.Header().Set("Content-Type", list.format.ContentType())
+	}
+	list.encoder.Write(item)
+	// NDJSON is read one line at a time, so each item is sent as written.
+	if flusher, ok := list.w.(http.Flusher); ok && list.format == representation.NDJSON {
+		flusher.Flush()
+	}
+}
+
+func (list *ListWriter) Close() {
+	if list.encoder.Count() == 0 {
+		list.w.Header().Set("Content-Type", list.format.ContentType())
+	}
+	list.encoder.Close()
+}
+
+// Report an error. Once items have been written the status can no longer
+// change, so the listing is left unterminated to signal the failure.
+func (list *ListWriter) Fail(err error) {
+	if list.encoder.Count() == 0 {
+		sendError(list.w, list.r, err.Error())
+	} else {
+		log.Println("Listing failed after", list.encoder.Count(), "items:", err)
+	}
+}
+
+// Compresses the response body with gzip when the client accepts it. Whether
+// to is decided when the header is written, from what the handler set.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	// Nil until the header is written, and if the body is not compressed.
+	writer *gzip.Writer
+	decided bool
+}
+
+// Media types whose content is already compressed.
+var compressedTypes = []string{"application/gzip", "application/x-gzip", "application/zip", "image/", "video/", "audio/"}
+
+// Whether a response with header and status code is worth compressing:
+// one that has a body that is not already compressed.
+func compressible(header http.Header, code int) bool {
+	if code < 200 || code == 204 || code == 304 || (code >= 300 && code < 400) {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	content_type := header.Get("Content-Type")
+	for _, compressed := range compressedTypes {
+		if strings.HasPrefix(content_type, compressed) {
+			return false
+		}
+	}
+	return true
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if !gw.decided {
+		gw.decided = true
+		if compressible(gw.Header(), code) {
+			gw.Header().Set("Content-Encoding", "gzip")
+			gw.Header().Del("Content-Length")
+			gw.writer = gzip.NewWriter(gw.ResponseWriter)
+		}
+	}
+	gw.ResponseWriter.WriteHeader(code)
+}
+
+func (gw *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !gw.decided {
+		gw.WriteHeader(200)
+	}
+	if gw.writer == nil {
+		return gw.ResponseWriter.Write(data)
+	}
+	return gw.writer.Write(data)
+}
+
+// Send what has been written so far, for streamed listings.
+func (gw *gzipResponseWriter) Flush() {
+	if gw.writer != nil {
+		gw.writer.Flush()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (gw *gzipResponseWriter) Close() error {
+	if gw.writer == nil {
+		return nil
+	}
+	return gw.writer.Close()
+}
+
+func CompressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsEncoding(r, "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		writer := &gzipResponseWriter{ResponseWriter: w}
+		defer writer.Close()
+		next.ServeHTTP(writer, r)
+	})
+}
+
+// Whether the client accepts encoding, by name or through "*", with a
+// q-value above 0. An entry naming the encoding takes precedence.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	named, wildcard := -1.0, -1.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(accepted, ";")
+		q := 1.0
+		for _, parameter := range parts[1:] {
+			key_value := strings.SplitN(strings.TrimSpace(parameter), "=", 2)
+			if len(key_value) == 2 && strings.TrimSpace(key_value[0]) == "q" {
+				var err error
+				q, err = strconv.ParseFloat(strings.TrimSpace(key_value[1]), 64)
+				if err != nil {
+					q = 0
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case encoding:
+			named = q
+		case "*":
+			wildcard = q
+		}
+	}
+	if named >= 0 {
+		return named > 0
+	}
+	return wildcard > 0
+}
+
+// Wraps a ResponseWriter so the status code can be recorded.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Methods recorded as themselves in request metrics, others as "other", so
+// that clients can not add labels without bound.
+var knownMethods = map[string]bool{"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true}
+
+// Wraps the router, recording request counts, latencies and in-flight
+// requests per route template, "unknown" for requests matching no route.
+func InstrumentHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		requestsInFlight.Add(1, route)
+		defer requestsInFlight.Add(-1, route)
+
+		start := time.Now()
+		rec := &statusRecorder{w, 200}
+		router.ServeHTTP(rec, r)
+
+		code := strconv.Itoa(rec.status)
+		method := r.Method
+		if !knownMethods[method] {
+			method = "other"
+		}
+		requestCount.Inc(method, route, code)
+		requestDuration.Observe(time.Since(start).Seconds(), method, route, code)
+	})
+}
+
+// Middleware enforcing the RouteLimits of the matched route per client.
+func LimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := defaultLimits
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				if route_limits, ok := routeLimits[template]; ok {
+					limits = route_limits
+				}
+			}
+		}
+
+		is_read := r.Method == "GET" || r.Method == "HEAD"
+		limiter := limits.Write
+		if is_read {
+			limiter = limits.Read
+		}
+
+		_, api_key, _ := RequestAPIKey(r)
+		if limiter != nil && !api_key.Exempt {
+			decision := limiter.Allow(ClientKey(r))
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+			if !decision.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(decision.RetryAfter)))
+				sendErrorCode(w, r, 429, "Rate limit exceeded")
+				return
+			}
+		}
+
+		if is_read && limits.Concurrency != nil {
+			if !limits.Concurrency.TryAcquire() {
+				w.Header().Set("Retry-After", "1")
+				sendErrorCode(w, r, 429, "Too many concurrent requests")
+				return
+			}
+			defer limits.Concurrency.Release()
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware redirecting requests for a renamed site to its new name.
+// GET and HEAD get a 301, other methods a 308 so they are not turned
+// into GETs.
+func AliasHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		site_name, ok := mux.Vars(r)["name"]
+		if !ok || !entities.ValidSiteName(site_name) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		fs := fileStore.FileStore{}
+		fs.SetPrefix(FileStorePrefix)
+		if fs.Exists(site_name) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Aliases of sites that were since deleted are ignored.
+		current, ok := aliases.Lookup(&fs, site_name)
+		if !ok || !fs.Exists(current) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		target := *r.URL
+		target.Path = strings.Replace(r.URL.Path, "/sites/" + site_name, "/sites/" + current, 1)
+		code := 308
+		if r.Method == "GET" || r.Method == "HEAD" {
+			code = 301
+		}
+		http.Redirect(w, r, target.String(), code)
+	})
+}
+
+// Who is making a change, recorded in the audit fields of what it
+// changes: the name of the API key the request was sent with, otherwise
+// the client's IP.
+func Actor(r *http.Request) string {
+	if _, api_key, ok := RequestAPIKey(r); ok && api_key.Name != "" {
+		return api_key.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// A File Store or a Transaction.
+type SiteStore interface {
+	Exists(file_name string) bool
+	Load(file_name string) ([]byte, error)
+}
+
+// Set the audit fields of site against the version of it in store.
+func StampSite(store SiteStore, site *entities.Site, actor string) {
+	var old *entities.Site
+	if store.Exists(site.Name) {
+		file_data, err := store.Load(site.Name)
+		if err == nil {
+			old_site, err := schema.DecodeSite(file_data)
+			if err == nil {
+				old = &old_site
+			}
+		}
+	}
+	site.Stamp(old, actor, time.Now().UTC())
+}
+
+func LoadSite(store SiteStore, site_name string) (entities.Site, error) {
+	if !store.Exists(site_name) {
+		return entities.Site{}, errors.New("Site does not exist")
+	}
+	file_data, err := store.Load(site_name)
+	if err != nil {
+		return entities.Site{}, err
+	}
+	return schema.DecodeSite(file_data)
+}
+
+// Stamp site against its version in tx and write it there.
+func writeSiteTx(tx *fileStore.Transaction, site *entities.Site, actor string) error {
+	StampSite(tx, site, actor)
+	site_json, err := schema.EncodeSite(site)
+	if err != nil {
+		return err
+	}
+	tx.Write(site.Name, site_json)
+	return nil
+}
+
+// Check sites against every site in store as it will be once they are
+// written: that the Parent of each exists and does not make a cycle, and
+// that their Urls are not used by other sites if they must be unique.
+func CheckSites(store hierarchy.Store, sites ...entities.Site) error {
+	tree, err := hierarchy.LoadAncestors(store, sites...)
+	if err != nil {
+		return err
+	}
+	check_urls, err := checkUrls(store, sites...)
+	if err != nil {
+		return err
+	}
+	var violations []entities.Violation
+	for _, site := range sites {
+		violations = append(violations, tree.Check(site.Name)...)
+		violations = append(violations, check_urls(&site)...)
+	}
+	if len(violations) > 0 {
+		return &entities.ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+// The check of Urls against every other site in store, with sites written
+// to it. Only global uniqueness needs every site, so without it none are
+// read.
+func checkUrls(store hierarchy.Store, sites ...entities.Site) (func(site *entities.Site) []entities.Violation, error) {
+	if entities.SitesRules == nil {
+		return entities.AgainstSites(nil), nil
+	}
+	tree, err := hierarchy.Load(store)
+	if err != nil {
+		return nil, err
+	}
+	for _, site := range sites {
+		tree.Put(site)
+	}
+	return entities.AgainstSites(tree.Sites()), nil
+}
+
+// Identify the client by API key if it sent one the server knows,
+// otherwise by IP.
+func ClientKey(r *http.Request) string {
+	if key, _, ok := RequestAPIKey(r); ok {
+		return "key:" + key
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// The API key a request was sent with, if the server knows it.
+func RequestAPIKey(r *http.Request) (string, APIKey, bool) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return "", APIKey{}, false
+	}
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	if time.Since(apiKeysChecked) >= APIKeysReloadInterval {
+		if err := reloadAPIKeys(); err != nil {
+			log.Println("Keeping the previous API keys: " + err.Error())
+		}
+	}
+	api_key, ok := apiKeys[key]
+	return key, api_key, ok
+}
+
+// Read APIKeysFile if it changed since it was last read. Without the file
+// no keys are known.
+func ReloadAPIKeys() error {
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	return reloadAPIKeys()
+}
+
+func reloadAPIKeys() error {
+	apiKeysChecked = time.Now()
+	info, err := os.Stat(APIKeysFile)
+	if os.IsNotExist(err) {
+		apiKeys = map[string]APIKey{}
+		apiKeysModified = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(apiKeysModified) {
+		return nil
+	}
+	keys, err := LoadAPIKeys(APIKeysFile)
+	if err != nil {
+		return err
+	}
+	apiKeys = keys
+	apiKeysModified = info.ModTime()
+	return nil
+}
+
+// Read the API keys known to the server, by key.
+func LoadAPIKeys(path string) (map[string]APIKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]APIKey{}
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return keys, nil
+}
+
+// Create the limiters for a configuration. Routes share the limiters of
+// the default for limits they do not set.
+func NewRouteLimits(config *rateLimit.RoutesConfig) (RouteLimits, map[string]RouteLimits) {
+	defaults := newLimits(config.Default, RouteLimits{})
+	routes := map[string]RouteLimits{}
+	for template, route := range config.Routes {
+		routes[template] = newLimits(route, defaults)
+	}
+	return defaults, routes
+}
+
+func newLimits(config rateLimit.RouteConfig, defaults RouteLimits) RouteLimits {
+	if config.Unlimited {
+		return RouteLimits{}
+	}
+	limits := defaults
+	limits.Concurrency = nil
+	if config.Read != nil {
+		limits.Read = rateLimit.NewLimiter(*config.Read)
+	}
+	if config.Write != nil {
+		limits.Write = rateLimit.NewLimiter(*config.Write)
+	}
+	if config.Concurrency > 0 {
+		limits.Concurrency = rateLimit.NewConcurrencyLimiter(config.Concurrency)
+	}
+	return limits
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func ObserveFileStore(op string, duration time.Duration, err error) {
+	storeDuration.Observe(duration.Seconds(), op)
+	if err != nil {
+		storeErrors.Inc(op)
+	}
+}
+
+// Set the inventory gauges before the metrics are written, so the sites
+// are only read once per scrape.
+func InventoryHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sites, access_points := CountInventory()
+		siteCount.Set(float64(sites))
+		accessPointCount.Set(float64(access_points))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Count the sites and access points currently in the File Store. The reads
+// are left out of the File Store metrics.
+func CountInventory() (int, int) {
+	fs := fileStore.FileStore{}
+	fs.SetPrefix(FileStorePrefix)
+	fs.SetObserved(false)
+	site_names, err := fs.GetFiles()
+	if err != nil {
+		return 0, 0
+	}
+
+	access_points := 0
+	for _, site_name := range site_names {
+		file_data, err := fs.Load(site_name)
+		if err != nil {
+			continue
+		}
+		site, err := schema.DecodeSite(file_data)
+		if err != nil {
+			continue
+		}
+		access_points += len(site.Access_points)
+	}
+	return len(site_names), access_points
+}
+
+// Decode the request body according to its Content-Type.
+func decodeBody(r *http.Request, v interface{}) error {
+	format := representation.ForContentType(r.Header.Get("Content-Type"))
+	return representation.Decode(r.Body, format, v)
+}
+
+// Write v in the representation the client asked for.
+func sendResponse(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	format := representation.Negotiate(r.Header.Get("Accept"))
+	w.Header().Set("Content-Type", format.ContentType())
+	w.WriteHeader(code)
+	representation.Encode(w, format, v)
+}
+
+func sendError(w http.ResponseWriter, r *http.Request, msg string) {
+	sendErrorCode(w, r, 400, msg)
+}
+
+func sendErrorCode(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	sendResponse(w, r, code, entities.ErrorResponse{Error: msg})
+}
+
+// Send a failed validation, listing every rule that was broken.
+func sendInvalid(w http.ResponseWriter, r *http.Request, err error) {
+	response := entities.ErrorResponse{Error: err.Error()}
+	if invalid, ok := err.(*entities.ValidationError); ok {
+		response.Violations = invalid.Violations
+	}
+	sendResponse(w, r, 400, response)
 }
 
-func sendSuccess(w http.ResponseWriter, msg string) {
-	w.WriteHeader(200)
-	json.NewEncoder(w).Encode(entities.SuccessResponse{msg})
+func sendSuccess(w http.ResponseWriter, r *http.Request, msg string) {
+	sendResponse(w, r, 200, entities.SuccessResponse{msg})
 }
@@ -4,16 +4,79 @@ import (
 	"testing"
 	"net/http"
 	"bytes"
+	"bufio"
+	"compress/gzip"
 	"./entities"
 	"./fileStore"
+	"./inventory"
+	"./batch"
+	"./prober"
+	"./schedule"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
 )
 
 const url = "http://localhost:8080"
 // Prefix allows us to select data to remove at end of testing.
 const test_prefix = "test"
 
+// The suite makes more requests than the rate limits allow one client, so
+// every request is sent with an exempt API key added to the server's key
+// file while the suite runs. Requests acting as a user send their own key.
+type apiKeyTransport struct {
+	key string
+}
+
+// Keys of the users changes are made as, by name.
+var userKeys = map[string]string{}
+
+func (transport *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("X-API-Key") != "" {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("X-API-Key", transport.key)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestMain(m *testing.M) {
+	original, read_err := ioutil.ReadFile(APIKeysFile)
+	keys := map[string]APIKey{}
+	if read_err == nil {
+		if err := json.Unmarshal(original, &keys); err != nil {
+			fmt.Println("Can not read " + APIKeysFile + ": " + err.Error())
+			os.Exit(1)
+		}
+	}
+	key := fmt.Sprint("test-suite-", time.Now().UnixNano())
+	keys[key] = APIKey{Exempt: true}
+	for _, name := range []string{"tester", "alice", "bob"} {
+		userKeys[name] = fmt.Sprint("test-", name, "-", time.Now().UnixNano())
+		keys[userKeys[name]] = APIKey{Name: name}
+	}
+	data, _ := json.Marshal(keys)
+	if err := ioutil.WriteFile(APIKeysFile, data, 0600); err != nil {
+		fmt.Println("Can not write " + APIKeysFile + ": " + err.Error())
+		os.Exit(1)
+	}
+	http.DefaultClient.Transport = &apiKeyTransport{key}
+	// Give the server time to notice the new key.
+	time.Sleep(APIKeysReloadInterval + 100 * time.Millisecond)
+
+	code := m.Run()
+
+	if read_err == nil {
+		ioutil.WriteFile(APIKeysFile, original, 0600)
+	} else {
+		os.Remove(APIKeysFile)
+	}
+	os.Exit(code)
+}
+
 // Test:
 // 	that a site can be created
 //	that two sites with the same name can not be created
@@ -22,7 +85,7 @@ func TestCreateSite(t *testing.T) {
 	// Always remove whatever testing data we created.
 	defer RemoveTestData(t)
 	var emptyAP = []entities.AccessPoint{}
-	example_site := entities.Site{test_prefix + "one", test_prefix + "role1", test_prefix + "uri1", emptyAP}
+	example_site := entities.Site{Name: test_prefix + "one", Role: test_prefix + "role1", Uri: test_prefix + "uri1", Access_points: emptyAP}
 
 	fmt.Println("\tCreating Site:", example_site)
 	createTestSite(t, example_site, 200)
@@ -40,13 +103,13 @@ func TestEditSite(t *testing.T) {
 	defer RemoveTestData(t)
 	var emptyAP = []entities.AccessPoint{}
 	var access_points = []entities.AccessPoint{}
-	ap := entities.AccessPoint{"pet", "http://pets.com"}
-	ap1 := entities.AccessPoint{"book", "Harry Potter"}
-	ap2 := entities.AccessPoint{"cat", "Olive"}
+	ap := entities.AccessPoint{Label: "pet", Url: "http://pets.com"}
+	ap1 := entities.AccessPoint{Label: "book", Url: "Harry Potter"}
+	ap2 := entities.AccessPoint{Label: "cat", Url: "Olive"}
 	access_points = append(access_points, ap)
 	access_points = append(access_points, ap1)
 	access_points = append(access_points, ap2)
-	example_site := entities.Site{test_prefix + "two", test_prefix + "role1", test_prefix + "uri1", access_points}
+	example_site := entities.Site{Name: test_prefix + "two", Role: test_prefix + "role1", Uri: test_prefix + "uri1", Access_points: access_points}
 
 	fmt.Println("\tCreating Site:", example_site)
 	createTestSite(t, example_site, 200)
@@ -54,14 +117,14 @@ func TestEditSite(t *testing.T) {
 	getTestAccessPoint(t, example_site.Name, "cat", 200, ap2)
 	getTestAccessPoint(t, example_site.Name, "ffrog", 400, entities.AccessPoint{})
 
-	example_site_update := entities.Site{test_prefix + "two", test_prefix + "role_update", test_prefix + "uri_update", emptyAP}
+	example_site_update := entities.Site{Name: test_prefix + "two", Role: test_prefix + "role_update", Uri: test_prefix + "uri_update", Access_points: emptyAP}
 	fmt.Println("\tUpdating Site:", example_site_update)
 	editTestSite(t, example_site_update, 200)
 	// Ensure our access points weren't updated
 	getTestAccessPoint(t, example_site.Name, "cat", 200, ap2)
 
 	fmt.Println("\tTrying to update nonexistant site. (Failure expected)")
-	example_site_update_fake := entities.Site{test_prefix + "fake", test_prefix + "role_update", test_prefix + "uri_update", emptyAP}
+	example_site_update_fake := entities.Site{Name: test_prefix + "fake", Role: test_prefix + "role_update", Uri: test_prefix + "uri_update", Access_points: emptyAP}
 	editTestSite(t, example_site_update_fake, 400)
 }
 
@@ -74,13 +137,13 @@ func TestDeleteSite (t *testing.T) {
 	fmt.Println("RUNNING: Test Delete Site")
 	defer RemoveTestData(t)
 	var access_points = []entities.AccessPoint{}
-	ap := entities.AccessPoint{"pet", "http://pets.com"}
-	ap1 := entities.AccessPoint{"book", "Harry Potter"}
-	ap2 := entities.AccessPoint{"cat", "Olive"}
+	ap := entities.AccessPoint{Label: "pet", Url: "http://pets.com"}
+	ap1 := entities.AccessPoint{Label: "book", Url: "Harry Potter"}
+	ap2 := entities.AccessPoint{Label: "cat", Url: "Olive"}
 	access_points = append(access_points, ap)
 	access_points = append(access_points, ap1)
 	access_points = append(access_points, ap2)
-	example_site := entities.Site{test_prefix + "three", test_prefix + "role1", test_prefix + "uri1", access_points}
+	example_site := entities.Site{Name: test_prefix + "three", Role: test_prefix + "role1", Uri: test_prefix + "uri1", Access_points: access_points}
 
 	fmt.Println("\tCreating Site:", example_site)
 	createTestSite(t, example_site, 200)
@@ -99,6 +162,1047 @@ func TestDeleteSite (t *testing.T) {
 	deleteTestSite(t, "cats_r_cool", 400)
 }
 
+// Test:
+//	that the metrics endpoint reports requests and inventory in text format
+//	that requests matching no route are counted
+//	that unknown methods are counted as other
+func TestMetrics(t *testing.T) {
+	fmt.Println("RUNNING: Test Metrics")
+	defer RemoveTestData(t)
+	var emptyAP = []entities.AccessPoint{}
+	example_site := entities.Site{Name: test_prefix + "metrics", Role: test_prefix + "role1", Uri: test_prefix + "uri1", Access_points: emptyAP}
+	createTestSite(t, example_site, 200)
+	if resp, err := http.Get(url + "/no/such/route"); err == nil {
+		resp.Body.Close()
+	}
+	if req, err := http.NewRequest("BREW", url + "/sites", nil); err == nil {
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	expected := []string{
+		`simple_rest_http_requests_total{method="POST",route="/sites",code="200"}`,
+		`simple_rest_http_request_duration_seconds_bucket{method="GET",route="/sites/{name}",code="200",le="+Inf"}`,
+		`simple_rest_http_requests_total{method="GET",route="unknown",code="404"}`,
+		`simple_rest_http_requests_total{method="other",route="unknown",code="405"}`,
+		`simple_rest_filestore_operation_duration_seconds_count{op="write"}`,
+		"# TYPE simple_rest_sites gauge",
+		"# TYPE simple_rest_access_points gauge",
+		"# TYPE simple_rest_http_requests_in_flight gauge",
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(body), line) {
+			t.Error("Metrics output is missing: ", line)
+		}
+	}
+}
+
+// Test:
+//	that the liveness, readiness and diagnostics endpoints respond
+//	that snapshots are refused unless the store is a database
+func TestHealth(t *testing.T) {
+	fmt.Println("RUNNING: Test Health")
+	for _, path := range []string{"/healthz", "/readyz"} {
+		var health entities.HealthResponse
+		getTestJson(t, path, 200, &health)
+		if health.Status != "ok" {
+			t.Error("Unexpected status for ", path, ": ", health.Status)
+		}
+		if path == "/readyz" && health.Checks["journal"] != "ok" {
+			t.Error("Unexpected readiness checks: ", health.Checks)
+		}
+	}
+
+	var info entities.DebugInfo
+	getTestJson(t, "/debug/info", 200, &info)
+	if info.Version == "" || info.Config["data_directory"] == "" {
+		t.Error("Incomplete debug info: ", info)
+	}
+
+	// Only a database can be snapshot.
+	expected := 400
+	if info.Storage.Layout == fileStore.Database {
+		expected = 200
+	}
+	resp, err := http.Get(url + "/debug/storage/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != expected {
+		t.Error("Unexpected snapshot response code: ", resp.StatusCode)
+	}
+}
+
+// Test:
+//	that sending a new unknown API key with each request does not get
+//	around the rate limit
+func TestRateLimitKeys(t *testing.T) {
+	fmt.Println("RUNNING: Test Rate Limit Keys")
+	limited := false
+	for i := 0; i < 30 && !limited; i++ {
+		req, _ := http.NewRequest("GET", url + "/sites", nil)
+		req.Header.Set("X-API-Key", fmt.Sprint("unknown-", i))
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		limited = resp.StatusCode == 429
+	}
+	if !limited {
+		t.Error("Unknown API keys were not limited together")
+	}
+}
+
+// Test:
+//	that site listings can be gzip compressed
+//	that q-values, "*" and already compressed responses are respected
+//	that access point listings can be returned as NDJSON
+func TestListings(t *testing.T) {
+	fmt.Println("RUNNING: Test Listings")
+	defer RemoveTestData(t)
+	access_points := []entities.AccessPoint{{Label: "pet", Url: "http://pets.com"}, {Label: "book", Url: "Harry Potter"}}
+	example_site := entities.Site{Name: test_prefix + "listing", Role: test_prefix + "role1", Uri: test_prefix + "uri1", Access_points: access_points}
+	createTestSite(t, example_site, 200)
+
+	req, _ := http.NewRequest("GET", url + "/sites", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Error("Site listing was not compressed")
+		return
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	var sites []entities.Site
+	err = json.NewDecoder(reader).Decode(&sites)
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	found := false
+	for _, site := range sites {
+		if site.Name == example_site.Name {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Created site missing from listing")
+	}
+
+	// Path, Accept-Encoding and the Content-Encoding expected.
+	encodings := [][3]string{
+		{"/sites", "gzip;q=0.0", ""},
+		{"/sites", "*", "gzip"},
+		{"/sites", "*;q=0, gzip;q=0.5", "gzip"},
+		{"/export?format=tar.gz", "gzip", ""},
+	}
+	for _, encoding := range encodings {
+		req, _ = http.NewRequest("GET", url + encoding[0], nil)
+		req.Header.Set("Accept-Encoding", encoding[1])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("Content-Encoding") != encoding[2] {
+			t.Error("Unexpected Content-Encoding for ", encoding[0], " accepting ", encoding[1], ": ", resp.Header.Get("Content-Encoding"))
+		}
+	}
+
+	req, _ = http.NewRequest("GET", url + "/sites/" + example_site.Name + "/accesspoints", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	var returned_aps []entities.AccessPoint
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var ap entities.AccessPoint
+		err = json.Unmarshal(scanner.Bytes(), &ap)
+		if err != nil {
+			t.Error("Invalid NDJSON line: " + scanner.Text())
+			return
+		}
+		returned_aps = append(returned_aps, ap)
+	}
+	if len(returned_aps) != len(access_points) {
+		t.Error("Returned access points: ", returned_aps, " do not match expected: ", access_points)
+	}
+}
+
+// Test:
+//	that a site can be created from a YAML body
+//	that sites and access points can be fetched as YAML, XML and CSV
+func TestRepresentations(t *testing.T) {
+	fmt.Println("RUNNING: Test Representations")
+	defer RemoveTestData(t)
+	site_yaml := "Name: " + test_prefix + "yaml\nRole: edge\nUri: \"80\"\nAccess_points:\n- Label: pet\n  Url: http://pets.com\n"
+	req, _ := http.NewRequest("POST", url + "/sites", strings.NewReader(site_yaml))
+	req.Header.Set("Content-Type", "application/yaml")
+	req.Header.Set("X-API-Key", userKeys["tester"])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Error("Creating site from YAML returned: ", resp.StatusCode)
+		return
+	}
+	access_points := []entities.AccessPoint{{Label: "pet", Url: "http://pets.com"}}
+	getTestSite(t, test_prefix + "yaml", 200, entities.Site{Name: test_prefix + "yaml", Role: "edge", Uri: "80", Access_points: access_points})
+
+	// Everything was created at the same time, by the same user.
+	var site entities.Site
+	getTestJson(t, "/sites/" + test_prefix + "yaml", 200, &site)
+	if site.CreatedAt == nil {
+		t.Error("Site was not stamped")
+		return
+	}
+	at := site.CreatedAt.Format(time.RFC3339Nano)
+	audit_yaml := "CreatedAt: " + at + "\nCreatedBy: tester\nUpdatedAt: " + at + "\nUpdatedBy: tester\n"
+	audit_xml := "<CreatedAt>" + at + "</CreatedAt><CreatedBy>tester</CreatedBy><UpdatedAt>" + at + "</UpdatedAt><UpdatedBy>tester</UpdatedBy>"
+	audit_csv := at + ",tester," + at + ",tester"
+
+	expected := map[string]string{
+		"application/yaml": "Name: " + test_prefix + "yaml\nRole: edge\nUri: \"80\"\nAccess_points:\n  - Label: pet\n    Url: http://pets.com\n    Priority: 1\n" +
+			"    " + strings.Replace(audit_yaml, "\n", "\n    ", 3) + audit_yaml,
+		"application/xml": "<Site><Name>" + test_prefix + "yaml</Name><Role>edge</Role><Uri>80</Uri><Access_points><Label>pet</Label><Url>http://pets.com</Url><Priority>1</Priority>" + audit_xml + "</Access_points>" + audit_xml + "</Site>\n",
+		"text/csv": "Name,Role,Uri,Access_points.Label,Access_points.Url,Access_points.OriginalUrl,Access_points.Clicks,Access_points.Weight,Access_points.Priority,Access_points.Enabled,Access_points.Tags,Access_points.Labels,Access_points.ExpiresAt,Access_points.CreatedAt,Access_points.CreatedBy,Access_points.UpdatedAt,Access_points.UpdatedBy,Tags,Labels,Parent,ExpiresAt,Maintenance,CreatedAt,CreatedBy,UpdatedAt,UpdatedBy\n" +
+			test_prefix + "yaml,edge,80,pet,http://pets.com,,,,1,,,,," + audit_csv + ",,,,,," + audit_csv + "\n",
+	}
+	for accept, body := range expected {
+		req, _ := http.NewRequest("GET", url + "/sites/" + test_prefix + "yaml", nil)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error("Error running test: " + err.Error())
+			return
+		}
+		returned, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(returned) != body {
+			t.Error("Returned ", accept, ":\n", string(returned), " does not match expected:\n", body)
+		}
+	}
+}
+
+// Test:
+//	that an import with an invalid site changes nothing
+//	that sites can be imported and are reported as created
+//	that an exported archive imports back without changes
+func TestImportExport(t *testing.T) {
+	fmt.Println("RUNNING: Test Import Export")
+	defer RemoveTestData(t)
+	var emptyAP = []entities.AccessPoint{}
+	site_one := entities.Site{Name: test_prefix + "importone", Role: "role1", Uri: "uri1", Access_points: emptyAP}
+	site_two := entities.Site{Name: test_prefix + "importtwo", Role: "role2", Uri: "uri2", Access_points: emptyAP}
+	invalid_site := entities.Site{Name: test_prefix + "Invalid", Role: "role3", Uri: "uri3", Access_points: emptyAP}
+
+	sites_json, _ := json.Marshal([]entities.Site{site_one, invalid_site})
+	importTestSites(t, "create-only", "application/json", sites_json, 400)
+	getTestSite(t, site_one.Name, 400, site_one)
+
+	sites_json, _ = json.Marshal([]entities.Site{site_one, site_two})
+	plan := importTestSites(t, "create-only", "application/json", sites_json, 200)
+	if len(plan.Created) != 2 {
+		t.Error("Expected two created sites, got: ", plan)
+	}
+	getTestSite(t, site_two.Name, 200, site_two)
+	importTestSites(t, "create-only", "application/json", sites_json, 400)
+
+	resp, err := http.Get(url + "/export?format=tar.gz")
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	archive, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	plan = importTestSites(t, "upsert&dry_run=true", "application/gzip", archive, 200)
+	if !plan.DryRun || len(plan.Created) != 0 || len(plan.Updated) != 0 || len(plan.Unchanged) < 2 {
+		t.Error("Expected re-import of export to change nothing, got: ", plan)
+	}
+}
+
+// Test:
+//	that a batch with a failing operation changes nothing
+//	that a batch creating a site and changing access points is applied
+func TestBatch(t *testing.T) {
+	fmt.Println("RUNNING: Test Batch")
+	defer RemoveTestData(t)
+	var emptyAP = []entities.AccessPoint{}
+	site := entities.Site{Name: test_prefix + "batch", Role: "role1", Uri: "uri1", Access_points: emptyAP}
+	ap := entities.AccessPoint{Label: "pet", Url: "http://pets.com"}
+	ap_update := entities.AccessPoint{Label: "pet", Url: "http://cats.com"}
+	book := entities.AccessPoint{Label: "book", Url: "Harry Potter"}
+
+	operations := []batch.Operation{
+		{Op: batch.CreateSite, Site: &site},
+		{Op: batch.CreateAP, Name: site.Name, AccessPoint: &ap},
+		{Op: batch.CreateAP, Name: site.Name, AccessPoint: &ap},
+	}
+	response := batchTest(t, operations, 400)
+	if response.Committed || response.Results[2].Status != batch.Failed || response.Results[0].Status != batch.RolledBack {
+		t.Error("Unexpected batch response: ", response)
+	}
+	getTestSite(t, site.Name, 400, site)
+
+	operations = []batch.Operation{
+		{Op: batch.CreateSite, Site: &site},
+		{Op: batch.CreateAP, Name: site.Name, AccessPoint: &ap},
+		{Op: batch.CreateAP, Name: site.Name, AccessPoint: &book},
+		{Op: batch.UpdateAP, Name: site.Name, AccessPoint: &ap_update},
+		{Op: batch.DeleteAP, Name: site.Name, Label: "book"},
+	}
+	response = batchTest(t, operations, 200)
+	if !response.Committed || len(response.Results) != len(operations) {
+		t.Error("Unexpected batch response: ", response)
+	}
+	getTestAccessPoint(t, site.Name, "pet", 200, ap_update)
+	getTestAccessPoint(t, site.Name, "book", 400, book)
+}
+
+// Test:
+//	that a site can be renamed and keeps its access points
+//	that the old name redirects to the new one
+//	that renaming onto an existing site is rejected
+func TestRenameSite(t *testing.T) {
+	fmt.Println("RUNNING: Test Rename Site")
+	defer RemoveTestData(t)
+	access_points := []entities.AccessPoint{{Label: "pet", Url: "http://pets.com"}}
+	example_site := entities.Site{Name: test_prefix + "renameold", Role: "role1", Uri: "uri1", Access_points: access_points}
+	other_site := entities.Site{Name: test_prefix + "renameother", Role: "role2", Uri: "uri2", Access_points: access_points}
+	createTestSite(t, example_site, 200)
+	createTestSite(t, other_site, 200)
+
+	renameTestSite(t, example_site.Name, entities.RenameRequest{NewName: other_site.Name, Redirect: true}, 400)
+	renameTestSite(t, example_site.Name, entities.RenameRequest{NewName: test_prefix + "renamenew", Redirect: true}, 200)
+
+	// The HTTP client follows the redirect from the old name.
+	getTestAccessPoint(t, example_site.Name, "pet", 200, access_points[0])
+	getTestAccessPoint(t, test_prefix + "renamenew", "pet", 200, access_points[0])
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(url + "/sites/" + example_site.Name)
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 301 || resp.Header.Get("Location") != "/sites/" + test_prefix + "renamenew" {
+		t.Error("Expected redirect to new name, got: ", resp.StatusCode, " ", resp.Header.Get("Location"))
+	}
+}
+
+// Test:
+//	that an access point can be copied and moved between sites
+//	that a transfer onto an existing label is rejected
+func TestTransferAccessPoint(t *testing.T) {
+	fmt.Println("RUNNING: Test Transfer Access Point")
+	defer RemoveTestData(t)
+	ap := entities.AccessPoint{Label: "pet", Url: "http://pets.com"}
+	source := entities.Site{Name: test_prefix + "source", Role: "role1", Uri: "uri1", Access_points: []entities.AccessPoint{ap}}
+	target := entities.Site{Name: test_prefix + "target", Role: "role2", Uri: "uri2", Access_points: []entities.AccessPoint{}}
+	createTestSite(t, source, 200)
+	createTestSite(t, target, 200)
+
+	transferTestAccessPoint(t, source.Name, "pet", "copy", entities.TransferRequest{Site: target.Name}, 200)
+	getTestAccessPoint(t, source.Name, "pet", 200, ap)
+	getTestAccessPoint(t, target.Name, "pet", 200, ap)
+
+	transferTestAccessPoint(t, source.Name, "pet", "move", entities.TransferRequest{Site: target.Name}, 400)
+	transferTestAccessPoint(t, source.Name, "pet", "move", entities.TransferRequest{Site: target.Name, Label: "cat"}, 200)
+	getTestAccessPoint(t, source.Name, "pet", 400, ap)
+	getTestAccessPoint(t, target.Name, "cat", 200, entities.AccessPoint{Label: "cat", Url: ap.Url})
+}
+
+// Test:
+//	that a site can be cloned under a new name
+//	that a template can be instantiated into a site
+//	that instantiating without every variable fails
+func TestCloneAndTemplates(t *testing.T) {
+	fmt.Println("RUNNING: Test Clone And Templates")
+	defer RemoveTestData(t)
+	defer deleteTestTemplate(t, test_prefix + "template")
+	access_points := []entities.AccessPoint{{Label: "pet", Url: "http://pets.com"}}
+	example_site := entities.Site{Name: test_prefix + "original", Role: "role1", Uri: "uri1", Access_points: access_points}
+	createTestSite(t, example_site, 200)
+
+	clone_json, _ := json.Marshal(entities.CloneRequest{Name: test_prefix + "clone"})
+	postTestJson(t, "/sites/" + example_site.Name + "/clone", clone_json, 200)
+	getTestSite(t, test_prefix + "clone", 200, entities.Site{Name: test_prefix + "clone", Role: "role1", Uri: "uri1", Access_points: access_points})
+	getTestAccessPoint(t, test_prefix + "clone", "pet", 200, access_points[0])
+	postTestJson(t, "/sites/" + example_site.Name + "/clone", clone_json, 400)
+
+	template := entities.Template{Name: test_prefix + "template", Role: "{{role}}", Uri: "{{ host }}/x", Access_points: []entities.AccessPoint{{Label: "web", Url: "http://{{host}}:{{port}}"}}}
+	template_json, _ := template.ToJson()
+	postTestJson(t, "/templates", template_json, 200)
+
+	instantiate_json, _ := json.Marshal(entities.InstantiateRequest{Name: test_prefix + "instance", Variables: map[string]string{"role": "edge", "host": "example.com"}})
+	postTestJson(t, "/templates/" + template.Name + "/instantiate", instantiate_json, 400)
+
+	instantiate_json, _ = json.Marshal(entities.InstantiateRequest{Name: test_prefix + "instance", Variables: map[string]string{"role": "edge", "host": "example.com", "port": "8080"}})
+	postTestJson(t, "/templates/" + template.Name + "/instantiate", instantiate_json, 200)
+	getTestSite(t, test_prefix + "instance", 200, entities.Site{Name: test_prefix + "instance", Role: "edge", Uri: "example.com/x", Access_points: nil})
+	getTestAccessPoint(t, test_prefix + "instance", "web", 200, entities.AccessPoint{Label: "web", Url: "http://example.com:8080"})
+}
+
+// Test:
+//	that tags and labels are kept and invalid label keys refused
+//	that sites and access points can be filtered by selector and tag
+func TestTagsAndLabels(t *testing.T) {
+	fmt.Println("RUNNING: Test Tags And Labels")
+	defer RemoveTestData(t)
+	access_points := []entities.AccessPoint{
+		{Label: "pet", Url: "http://pets.com", Labels: map[string]string{"tier": "edge"}},
+		{Label: "book", Url: "Harry Potter", Tags: []string{"fiction"}},
+	}
+	example_site := entities.Site{Name: test_prefix + "labeled", Role: "role1", Uri: "uri1", Access_points: access_points,
+		Tags: []string{"critical"}, Labels: map[string]string{"env": "prod", "example.com/team": "web"}}
+	createTestSite(t, example_site, 200)
+	getTestSite(t, example_site.Name, 200, example_site)
+
+	bad_site := entities.Site{Name: test_prefix + "badlabel", Role: "role1", Uri: "uri1", Labels: map[string]string{"bad key": "x"}}
+	createTestSite(t, bad_site, 400)
+
+	listed := func(path string) []string {
+		var sites []entities.Site
+		getTestJson(t, path, 200, &sites)
+		var names []string
+		for _, site := range sites {
+			if strings.HasPrefix(site.Name, test_prefix) {
+				names = append(names, site.Name)
+			}
+		}
+		return names
+	}
+	if names := listed("/sites?selector=env=prod,example.com/team%20in%20(web,api)&tag=critical"); len(names) != 1 {
+		t.Error("Selector did not match labeled site:", names)
+	}
+	if names := listed("/sites?selector=env!=prod"); len(names) != 0 {
+		t.Error("Selector matched labeled site:", names)
+	}
+	var error_response entities.ErrorResponse
+	getTestJson(t, "/sites?selector=in%20(", 400, &error_response)
+
+	var aps []entities.AccessPoint
+	getTestJson(t, "/sites/" + example_site.Name + "/accesspoints?selector=!tier", 200, &aps)
+	if len(aps) != 1 || aps[0].Label != "book" {
+		t.Error("Access point selector returned:", aps)
+	}
+}
+
+// Test:
+//	that audit fields sent by clients are ignored
+//	that changes are made as the user of the API key, not a header
+//	that created fields are kept and updated fields follow changes
+//	that listings can be filtered by update time
+func TestAudit(t *testing.T) {
+	fmt.Println("RUNNING: Test Audit")
+	defer RemoveTestData(t)
+	forged := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	site := entities.Site{Name: test_prefix + "audited", Role: "role1", Uri: "uri1",
+		Access_points: []entities.AccessPoint{{Label: "pet", Url: "http://pets.com"}, {Label: "book", Url: "Harry Potter"}}}
+	site.CreatedAt = &forged
+	site.CreatedBy = "mallory"
+	sendAs := func(method string, path string, v interface{}, user string) {
+		body, _ := json.Marshal(v)
+		req, _ := http.NewRequest(method, url + path, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", userKeys[user])
+		req.Header.Set("X-User", "mallory")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error("Error running test: " + err.Error())
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Error(method, path, "returned", resp.StatusCode)
+		}
+	}
+	sendAs("POST", "/sites", site, "alice")
+
+	var created entities.Site
+	getTestJson(t, "/sites/" + site.Name, 200, &created)
+	if created.CreatedBy != "alice" || created.UpdatedBy != "alice" || created.CreatedAt == nil || created.CreatedAt.Equal(forged) {
+		t.Error("Site was not stamped by the server:", created.Audit)
+		return
+	}
+	if created.Access_points[0].CreatedBy != "alice" {
+		t.Error("Access point was not stamped:", created.Access_points[0].Audit)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	before_update := time.Now().UTC()
+	sendAs("PUT", "/sites/" + site.Name + "/accesspoints", entities.AccessPoint{Label: "pet", Url: "http://dogs.com"}, "bob")
+
+	var updated entities.Site
+	getTestJson(t, "/sites/" + site.Name, 200, &updated)
+	if !updated.CreatedAt.Equal(*created.CreatedAt) || updated.CreatedBy != "alice" || updated.UpdatedBy != "bob" || !updated.UpdatedAt.After(*created.UpdatedAt) {
+		t.Error("Site audit fields not updated:", updated.Audit)
+	}
+	if updated.Access_points[0].UpdatedBy != "bob" || updated.Access_points[1].UpdatedBy != "alice" {
+		t.Error("Access point audit fields not updated:", updated.Access_points)
+	}
+
+	var aps []entities.AccessPoint
+	getTestJson(t, "/sites/" + site.Name + "/accesspoints?updated_since=" + before_update.Format(time.RFC3339Nano), 200, &aps)
+	if len(aps) != 1 || aps[0].Label != "pet" {
+		t.Error("updated_since returned:", aps)
+	}
+	var sites []entities.Site
+	getTestJson(t, "/sites?updated_since=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339), 200, &sites)
+	if len(sites) != 0 {
+		t.Error("updated_since in the future returned sites")
+	}
+	var error_response entities.ErrorResponse
+	getTestJson(t, "/sites?updated_since=yesterday", 400, &error_response)
+}
+
+// Test:
+//	that every validation failure of a site is reported together
+func TestValidationViolations(t *testing.T) {
+	fmt.Println("RUNNING: Test Validation Violations")
+	defer RemoveTestData(t)
+	site := entities.Site{Name: test_prefix + "Invalid", Role: "role1", Uri: "uri1",
+		Access_points: []entities.AccessPoint{{Label: "pet", Url: "http://pets.com"}, {Label: "pet", Url: "http://dogs.com"}, {Url: "http://cats.com"}}}
+	site_json, _ := site.ToJson()
+	resp, err := http.Post(url + "/sites", "application/json", bytes.NewBuffer(site_json))
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Error("Returned repsonse code:", resp.StatusCode, " does not match expected: ", 400)
+		return
+	}
+	var error_response entities.ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&error_response)
+	var fields []string
+	for _, violation := range error_response.Violations {
+		fields = append(fields, violation.Field)
+	}
+	expected := []string{"Name", "Access_points[1].Label", "Access_points[2].Label"}
+	if strings.Join(fields, " ") != strings.Join(expected, " ") {
+		t.Error("Violations for fields ", fields, " do not match expected ", expected)
+	}
+
+	createTestSite(t, entities.Site{Name: test_prefix + "valid", Role: "role1", Uri: "uri1"}, 200)
+	createTestAccessPoint(t, test_prefix + "valid", entities.AccessPoint{Url: "http://pets.com"}, 400)
+}
+
+// Test:
+//	that access point Urls are stored in canonical form
+//	that the Url as given is kept, and survives a move
+func TestCanonicalUrls(t *testing.T) {
+	fmt.Println("RUNNING: Test Canonical Urls")
+	defer RemoveTestData(t)
+	createTestSite(t, entities.Site{Name: test_prefix + "canonical", Role: "role1", Uri: "uri1"}, 200)
+	createTestSite(t, entities.Site{Name: test_prefix + "canonicaltwo", Role: "role1", Uri: "uri1"}, 200)
+	postTestJson(t, "/sites/" + test_prefix + "canonical/accesspoints", []byte(`{"Label":"web","Url":"HTTP://Example.com:80/a/../b"}`), 200)
+
+	expected := entities.AccessPoint{Label: "web", Url: "http://example.com/b", OriginalUrl: "HTTP://Example.com:80/a/../b"}
+	getTestAccessPoint(t, test_prefix + "canonical", "web", 200, expected)
+
+	transferTestAccessPoint(t, test_prefix + "canonical", "web", "move", entities.TransferRequest{Site: test_prefix + "canonicaltwo"}, 200)
+	getTestAccessPoint(t, test_prefix + "canonicaltwo", "web", 200, expected)
+}
+
+// Test:
+//	that access points not checked yet have an unknown status
+//	that a site's health lists each of its access points
+func TestAccessPointHealth(t *testing.T) {
+	fmt.Println("RUNNING: Test Access Point Health")
+	defer RemoveTestData(t)
+	access_points := []entities.AccessPoint{{Label: "pet", Url: "http://pets.com"}, {Label: "book", Url: "Harry Potter"}}
+	createTestSite(t, entities.Site{Name: test_prefix + "probed", Role: "role1", Uri: "uri1", Access_points: access_points}, 200)
+
+	var health prober.Health
+	getTestJson(t, "/sites/" + test_prefix + "probed/accesspoints/pet/health", 200, &health)
+	if health.Status != prober.Unknown || health.Url != "http://pets.com" {
+		t.Error("Unexpected access point health: ", health)
+	}
+	var site_health prober.SiteHealth
+	getTestJson(t, "/sites/" + test_prefix + "probed/health", 200, &site_health)
+	if site_health.Status != prober.Unknown || len(site_health.Access_points) != 2 || site_health.Unknown != 2 {
+		t.Error("Unexpected site health: ", site_health)
+	}
+	var error_response entities.ErrorResponse
+	getTestJson(t, "/sites/" + test_prefix + "probed/accesspoints/missing/health", 400, &error_response)
+}
+
+// Test:
+//	that short links redirect to the access point Url, passing the query on
+//	that links to missing access points are not found
+//	that clicks are counted on the access point
+//	that counts are kept on move and rename, and dropped on delete
+func TestShortLinks(t *testing.T) {
+	fmt.Println("RUNNING: Test Short Links")
+	defer RemoveTestData(t)
+	access_points := []entities.AccessPoint{{Label: "pet", Url: "http://pets.com/?kind=dog"}}
+	createTestSite(t, entities.Site{Name: test_prefix + "short", Role: "role1", Uri: "uri1", Access_points: access_points}, 200)
+
+	client := &http.Client{Transport: http.DefaultClient.Transport, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for path, location := range map[string]string{
+		"/go/" + test_prefix + "short/pet": "http://pets.com/?kind=dog",
+		"/go/" + test_prefix + "short/pet?size=small": "http://pets.com/?kind=dog&size=small",
+	} {
+		resp, err := client.Get(url + path)
+		if err != nil {
+			t.Error("Error running test: " + err.Error())
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 302 || resp.Header.Get("Location") != location {
+			t.Error(path, " returned ", resp.StatusCode, " to ", resp.Header.Get("Location"), ", expected 302 to ", location)
+		}
+	}
+	resp, err := client.Get(url + "/go/" + test_prefix + "short/missing")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != 404 {
+			t.Error("Missing access point returned ", resp.StatusCode)
+		}
+	}
+
+	var ap entities.AccessPoint
+	getTestJson(t, "/sites/" + test_prefix + "short/accesspoints/pet", 200, &ap)
+	if ap.Clicks != 2 {
+		t.Error("Access point has ", ap.Clicks, " clicks, expected 2")
+	}
+
+	// Counts follow the access point when it is moved or its site renamed,
+	// and are forgotten once it is deleted.
+	transferTestAccessPoint(t, test_prefix + "short", "pet", "move", entities.TransferRequest{Label: "dog"}, 200)
+	renameTestSite(t, test_prefix + "short", entities.RenameRequest{NewName: test_prefix + "shortrenamed"}, 200)
+	var moved entities.AccessPoint
+	getTestJson(t, "/sites/" + test_prefix + "shortrenamed/accesspoints/dog", 200, &moved)
+	if moved.Clicks != 2 {
+		t.Error("Moved access point has ", moved.Clicks, " clicks, expected 2")
+	}
+	deleteTestAccessPoint(t, test_prefix + "shortrenamed", "dog", 200)
+	createTestAccessPoint(t, test_prefix + "shortrenamed", entities.AccessPoint{Label: "dog", Url: "http://dogs.com"}, 200)
+	var recreated entities.AccessPoint
+	getTestJson(t, "/sites/" + test_prefix + "shortrenamed/accesspoints/dog", 200, &recreated)
+	if recreated.Clicks != 0 {
+		t.Error("Recreated access point has ", recreated.Clicks, " clicks, expected 0")
+	}
+}
+
+// Test:
+//	that round robin resolution cycles through the access points
+//	that resolution honours filters and rejects unknown strategies
+//	that weights above the maximum are refused
+func TestResolve(t *testing.T) {
+	fmt.Println("RUNNING: Test Resolve")
+	defer RemoveTestData(t)
+	access_points := []entities.AccessPoint{
+		{Label: "one", Url: "http://one.example.com", Weight: 2, Tags: []string{"primary"}},
+		{Label: "two", Url: "http://two.example.com"},
+	}
+	createTestSite(t, entities.Site{Name: test_prefix + "resolved", Role: "role1", Uri: "uri1", Access_points: access_points}, 200)
+
+	var first, second entities.AccessPoint
+	getTestJson(t, "/sites/" + test_prefix + "resolved/resolve?strategy=round-robin", 200, &first)
+	getTestJson(t, "/sites/" + test_prefix + "resolved/resolve?strategy=round-robin", 200, &second)
+	if first.Label == second.Label {
+		t.Error("Round robin resolved to ", first.Label, " twice")
+	}
+	for _, strategy := range []string{"random", "weighted", "healthiest"} {
+		var picked entities.AccessPoint
+		getTestJson(t, "/sites/" + test_prefix + "resolved/resolve?tag=primary&strategy=" + strategy, 200, &picked)
+		if picked.Label != "one" {
+			t.Error(strategy, " resolved to ", picked.Label, ", expected one")
+		}
+	}
+	var error_response entities.ErrorResponse
+	getTestJson(t, "/sites/" + test_prefix + "resolved/resolve?strategy=fastest", 400, &error_response)
+	getTestJson(t, "/sites/" + test_prefix + "resolved/resolve?tag=missing", 400, &error_response)
+
+	heavy := entities.AccessPoint{Label: "heavy", Url: "http://heavy.example.com", Weight: entities.MaxWeight + 1}
+	createTestAccessPoint(t, test_prefix + "resolved", heavy, 400)
+}
+
+func TestReorderAccessPoints(t *testing.T) {
+	fmt.Println("RUNNING: Test Reorder Access Points")
+	defer RemoveTestData(t)
+	access_points := []entities.AccessPoint{
+		{Label: "one", Url: "http://one.example.com"},
+		{Label: "two", Url: "http://two.example.com"},
+		{Label: "three", Url: "http://three.example.com"},
+	}
+	createTestSite(t, entities.Site{Name: test_prefix + "ordered", Role: "role1", Uri: "uri1", Access_points: access_points}, 200)
+	labelsOf := func() string {
+		var aps []entities.AccessPoint
+		getTestJson(t, "/sites/" + test_prefix + "ordered/accesspoints", 200, &aps)
+		labels := []string{}
+		for _, ap := range aps {
+			labels = append(labels, ap.Label)
+		}
+		return strings.Join(labels, ",")
+	}
+
+	// Deleting an access point keeps the others in order.
+	deleteTestAccessPoint(t, test_prefix + "ordered", "two", 200)
+	createTestAccessPoint(t, test_prefix + "ordered", entities.AccessPoint{Label: "four", Url: "http://four.example.com"}, 200)
+	if labels := labelsOf(); labels != "one,three,four" {
+		t.Error("Access points ordered ", labels, " after delete")
+	}
+
+	reorder, _ := json.Marshal(entities.ReorderRequest{Labels: []string{"four", "one", "three"}})
+	postTestJson(t, "/sites/" + test_prefix + "ordered/accesspoints/reorder", reorder, 200)
+	if labels := labelsOf(); labels != "four,one,three" {
+		t.Error("Access points ordered ", labels, " after reorder")
+	}
+
+	// The order must name every access point exactly once.
+	for _, labels := range [][]string{{"four", "one"}, {"four", "one", "one"}, {"four", "one", "two"}} {
+		reorder, _ = json.Marshal(entities.ReorderRequest{Labels: labels})
+		postTestJson(t, "/sites/" + test_prefix + "ordered/accesspoints/reorder", reorder, 400)
+	}
+	if labels := labelsOf(); labels != "four,one,three" {
+		t.Error("Access points ordered ", labels, " after failed reorder")
+	}
+}
+
+func TestExpiryAndSchedule(t *testing.T) {
+	fmt.Println("RUNNING: Test Expiry And Schedule")
+	defer RemoveTestData(t)
+	past := time.Now().UTC().Add(-time.Minute)
+	future := time.Now().UTC().Add(time.Hour)
+	access_points := []entities.AccessPoint{
+		{Label: "temp", Url: "http://temp.example.com", ExpiresAt: &past},
+		{Label: "keep", Url: "http://keep.example.com", ExpiresAt: &future},
+	}
+	// Expired items can be removed as soon as they are written, so they are
+	// not read back.
+	expiring_json, _ := json.Marshal(entities.Site{Name: test_prefix + "expiring", Role: "role1", Uri: "uri1", Access_points: access_points})
+	postTestJson(t, "/sites", expiring_json, 200)
+	expired_json, _ := json.Marshal(entities.Site{Name: test_prefix + "expired", Role: "role1", Uri: "uri1", ExpiresAt: &past})
+	postTestJson(t, "/sites", expired_json, 200)
+
+	switched := entities.AccessPoint{Label: "keep", Url: "http://switched.example.com"}
+	change := schedule.Change{At: time.Now().UTC().Add(time.Second), Operations: []batch.Operation{{Op: batch.UpdateAP, Name: test_prefix + "expiring", AccessPoint: &switched}}}
+	change_json, _ := json.Marshal(change)
+	postTestJson(t, "/schedule", change_json, 200)
+	failing := schedule.Change{At: past, Operations: []batch.Operation{{Op: batch.DeleteAP, Name: test_prefix + "expiring", Label: "missing"}}}
+	failing_json, _ := json.Marshal(failing)
+	postTestJson(t, "/schedule", failing_json, 200)
+	postTestJson(t, "/schedule", []byte(`{"Operations": []}`), 400)
+
+	// Wait for the expired items to be removed and the change to be made,
+	// which happens as they fall due rather than at the next interval.
+	var aps []entities.AccessPoint
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		aps = nil
+		getTestJson(t, "/sites/" + test_prefix + "expiring/accesspoints", 200, &aps)
+		if len(aps) == 1 && aps[0].Url == switched.Url {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(aps) != 1 || aps[0].Label != "keep" || aps[0].Url != switched.Url || aps[0].UpdatedBy == ExpiryActor {
+		t.Error("Unexpected access points after expiry: ", aps)
+	}
+	getTestSite(t, test_prefix + "expired", 400, entities.Site{})
+
+	// The failed change is kept with its error until it is cancelled.
+	var changes []schedule.Change
+	getTestJson(t, "/schedule", 200, &changes)
+	for _, change := range changes {
+		if change.Operations[0].Name != test_prefix + "expiring" {
+			continue
+		}
+		if change.Error == "" {
+			t.Error("Scheduled change was not applied: ", change)
+		}
+		req, _ := http.NewRequest("DELETE", url + "/schedule/" + change.Id, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != 200 {
+			t.Error("Error cancelling scheduled change: ", change.Id)
+		} else {
+			resp.Body.Close()
+		}
+		var error_response entities.ErrorResponse
+		getTestJson(t, "/schedule/" + change.Id, 404, &error_response)
+	}
+}
+
+// Test:
+//	that disabled access points are left out of listings, resolution and
+//	short links
+//	that a site in maintenance is not resolved or redirected to
+//	that sites are not created in maintenance
+func TestDisabledAndMaintenance(t *testing.T) {
+	fmt.Println("RUNNING: Test Disabled And Maintenance")
+	defer RemoveTestData(t)
+	access_points := []entities.AccessPoint{{Label: "one", Url: "http://one.example.com"}, {Label: "two", Url: "http://two.example.com"}}
+	createTestSite(t, entities.Site{Name: test_prefix + "rotation", Role: "role1", Uri: "uri1", Access_points: access_points}, 200)
+	site_path := "/sites/" + test_prefix + "rotation"
+
+	postTestJson(t, site_path + "/accesspoints/one/disable", nil, 200)
+	// Replacing the access point without Enabled keeps it disabled.
+	ap_json, _ := json.Marshal(entities.AccessPoint{Label: "one", Url: "http://uno.example.com"})
+	sendTestJson(t, "PUT", site_path + "/accesspoints", ap_json, 200)
+	var aps []entities.AccessPoint
+	getTestJson(t, site_path + "/accesspoints", 200, &aps)
+	if len(aps) != 1 || aps[0].Label != "two" {
+		t.Error("Unexpected access points with one disabled: ", aps)
+	}
+	aps = nil
+	getTestJson(t, site_path + "/accesspoints?include_disabled=true", 200, &aps)
+	if len(aps) != 2 || aps[0].IsEnabled() || aps[0].UpdatedBy == "" {
+		t.Error("Unexpected access points including disabled: ", aps)
+	}
+	for i := 0; i < 3; i++ {
+		var picked entities.AccessPoint
+		getTestJson(t, site_path + "/resolve", 200, &picked)
+		if picked.Label != "two" {
+			t.Error("Resolved to disabled access point ", picked.Label)
+		}
+	}
+	client := &http.Client{Transport: http.DefaultClient.Transport, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	expectRedirect := func(label string, expected_response_code int) {
+		resp, err := client.Get(url + "/go/" + test_prefix + "rotation/" + label)
+		if err != nil {
+			t.Error("Error running test: " + err.Error())
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected_response_code {
+			t.Error("Short link to ", label, " returned ", resp.StatusCode, ", expected ", expected_response_code)
+		}
+	}
+	expectRedirect("one", 404)
+	expectRedirect("two", 302)
+	postTestJson(t, site_path + "/accesspoints/one/enable", nil, 200)
+	postTestJson(t, site_path + "/accesspoints/three/enable", nil, 400)
+
+	maintenance_json, _ := json.Marshal(entities.Maintenance{})
+	sendTestJson(t, "PUT", site_path + "/maintenance", maintenance_json, 400)
+	until := time.Now().UTC().Add(time.Hour)
+	maintenance_json, _ = json.Marshal(entities.Maintenance{Reason: "upgrade", Until: &until})
+	sendTestJson(t, "PUT", site_path + "/maintenance", maintenance_json, 200)
+	var error_response entities.ErrorResponse
+	getTestJson(t, site_path + "/resolve", 503, &error_response)
+	expectRedirect("two", 503)
+
+	// Sites are created out of maintenance, whatever the client sends or
+	// the site is cloned from.
+	forged := entities.Site{Name: test_prefix + "forged", Role: "role1", Uri: "uri1",
+		Maintenance: &entities.Maintenance{Reason: "forged", StartedBy: "someone else"}}
+	forged_json, _ := forged.ToJson()
+	postTestJson(t, "/sites", forged_json, 200)
+	clone_json, _ := json.Marshal(entities.CloneRequest{Name: test_prefix + "rotationclone"})
+	postTestJson(t, site_path + "/clone", clone_json, 200)
+	for _, site_name := range []string{forged.Name, test_prefix + "rotationclone"} {
+		var created entities.Site
+		getTestJson(t, "/sites/" + site_name, 200, &created)
+		if created.Maintenance != nil {
+			t.Error("Site was created in maintenance: ", created.Maintenance)
+		}
+	}
+	var picked entities.AccessPoint
+	getTestJson(t, site_path + "/resolve?include_disabled=true", 200, &picked)
+	var sites []entities.Site
+	getTestJson(t, "/sites?include_disabled=true", 200, &sites)
+	listed := false
+	for _, site := range sites {
+		if site.Name == test_prefix + "rotation" {
+			listed = site.Maintenance != nil && site.Maintenance.Reason == "upgrade" && site.Maintenance.StartedBy != ""
+		}
+	}
+	if !listed {
+		t.Error("Site in maintenance was not listed including disabled")
+	}
+	sites = nil
+	getTestJson(t, "/sites", 200, &sites)
+	for _, site := range sites {
+		if site.Name == test_prefix + "rotation" {
+			t.Error("Site in maintenance was listed")
+		}
+	}
+
+	// Editing the site leaves maintenance alone.
+	edit := entities.Site{Name: test_prefix + "rotation", Role: "role2", Uri: "uri1"}
+	edit_json, _ := edit.ToJson()
+	sendTestJson(t, "PUT", "/sites", edit_json, 200)
+	getTestJson(t, site_path + "/resolve", 503, &error_response)
+	sendTestJson(t, "DELETE", site_path + "/maintenance", nil, 200)
+	sendTestJson(t, "DELETE", site_path + "/maintenance", nil, 400)
+	getTestJson(t, site_path + "/resolve", 200, &picked)
+}
+
+func TestHierarchy(t *testing.T) {
+	fmt.Println("RUNNING: Test Hierarchy")
+	defer RemoveTestData(t)
+	region := entities.Site{Name: test_prefix + "region", Role: "region", Uri: "uri1", Labels: map[string]string{"geo": "eu", "tier": "core"}}
+	datacenter := entities.Site{Name: test_prefix + "datacenter", Uri: "uri2", Labels: map[string]string{"tier": "dc"}, Parent: region.Name}
+	rack := entities.Site{Name: test_prefix + "rack", Role: "rack", Uri: "uri3", Parent: datacenter.Name}
+	createTestSite(t, datacenter, 400)
+	// Parents can be created in the same batch as their children.
+	batchTest(t, []batch.Operation{{Op: batch.CreateSite, Site: &datacenter}, {Op: batch.CreateSite, Site: &region}}, 200)
+	createTestSite(t, rack, 200)
+
+	// A site can not be below itself.
+	region.Parent = rack.Name
+	region_json, _ := region.ToJson()
+	sendTestJson(t, "PUT", "/sites", region_json, 400)
+
+	names := func(path string) string {
+		var sites []entities.Site
+		getTestJson(t, path, 200, &sites)
+		var site_names []string
+		for _, site := range sites {
+			site_names = append(site_names, site.Name)
+		}
+		return strings.Join(site_names, ",")
+	}
+	if children := names("/sites/" + region.Name + "/children"); children != datacenter.Name {
+		t.Error("Unexpected children: ", children)
+	}
+	if descendants := names("/sites/" + region.Name + "/children?recursive=true"); descendants != datacenter.Name + "," + rack.Name {
+		t.Error("Unexpected descendants: ", descendants)
+	}
+	if ancestors := names("/sites/" + rack.Name + "/ancestors"); ancestors != datacenter.Name + "," + region.Name {
+		t.Error("Unexpected ancestors: ", ancestors)
+	}
+
+	var inherited entities.Site
+	getTestJson(t, "/sites/" + datacenter.Name + "?inherit=true", 200, &inherited)
+	if inherited.Role != "region" || inherited.Labels["geo"] != "eu" || inherited.Labels["tier"] != "dc" {
+		t.Error("Unexpected inherited site: ", inherited)
+	}
+	if selected := names("/sites?inherit=true&selector=geo%3Deu"); !strings.Contains(selected, rack.Name) {
+		t.Error("Inherited labels were not selected on: ", selected)
+	}
+
+	// Renaming a site keeps its children.
+	renameTestSite(t, datacenter.Name, entities.RenameRequest{NewName: test_prefix + "dc"}, 200)
+	if ancestors := names("/sites/" + rack.Name + "/ancestors"); ancestors != test_prefix + "dc," + region.Name {
+		t.Error("Unexpected ancestors after rename: ", ancestors)
+	}
+
+	deleteTestSite(t, region.Name, 400)
+	sendTestJson(t, "DELETE", "/sites/" + region.Name + "?children=adopt", nil, 400)
+	sendTestJson(t, "DELETE", "/sites/" + test_prefix + "dc?children=orphan", nil, 200)
+	var orphan entities.Site
+	getTestJson(t, "/sites/" + rack.Name, 200, &orphan)
+	if orphan.Parent != "" {
+		t.Error("Child was not orphaned: ", orphan)
+	}
+	createTestSite(t, entities.Site{Name: test_prefix + "dc", Role: "dc", Uri: "uri2", Parent: region.Name}, 200)
+	sendTestJson(t, "DELETE", "/sites/" + region.Name + "?children=cascade", nil, 200)
+	getTestSite(t, test_prefix + "dc", 400, entities.Site{})
+}
+
+func TestGroups(t *testing.T) {
+	fmt.Println("RUNNING: Test Groups")
+	defer RemoveTestData(t)
+	region := entities.Site{Name: test_prefix + "groupregion", Role: "region", Uri: "uri1", Labels: map[string]string{"facing": "customer"}}
+	shop := entities.Site{Name: test_prefix + "groupshop", Role: "shop", Uri: "uri2", Parent: region.Name,
+		Access_points: []entities.AccessPoint{{Label: "web", Url: "http://shop.example.com"}, {Label: "admin", Url: "http://admin.example.com", Tags: []string{"internal"}}}}
+	office := entities.Site{Name: test_prefix + "groupoffice", Role: "office", Uri: "uri3",
+		Access_points: []entities.AccessPoint{{Label: "vpn", Url: "http://vpn.example.com"}}}
+	createTestSite(t, region, 200)
+	createTestSite(t, shop, 200)
+	createTestSite(t, office, 200)
+
+	group := entities.Group{Name: test_prefix + "group", Sites: []string{office.Name}, Selector: "facing=customer", Roles: []string{"shop"}}
+	group_json, _ := json.Marshal(group)
+	defer sendTestJson(t, "DELETE", "/groups/" + group.Name, nil, 200)
+	postTestJson(t, "/groups", group_json, 200)
+	postTestJson(t, "/groups", group_json, 400)
+	postTestJson(t, "/groups", []byte(`{"Name": "testbad", "Selector": "facing in customer"}`), 400)
+
+	var groups []entities.Group
+	getTestJson(t, "/groups", 200, &groups)
+	found := false
+	for _, listed := range groups {
+		found = found || listed.Name == group.Name
+	}
+	if !found {
+		t.Error("Group was not listed: ", groups)
+	}
+
+	// The shop inherits the label of its region, which has the wrong role.
+	var members []entities.Site
+	getTestJson(t, "/groups/" + group.Name + "/sites", 200, &members)
+	if len(members) != 2 || members[0].Name != office.Name || members[1].Name != shop.Name {
+		t.Error("Unexpected group members: ", members)
+	}
+	var aps []entities.SiteAccessPoint
+	getTestJson(t, "/groups/" + group.Name + "/accesspoints?selector=", 200, &aps)
+	if len(aps) != 3 || aps[0].Site != office.Name || aps[0].Label != "vpn" || aps[2].Site != shop.Name {
+		t.Error("Unexpected group access points: ", aps)
+	}
+	aps = nil
+	getTestJson(t, "/groups/" + group.Name + "/accesspoints?tag=internal", 200, &aps)
+	if len(aps) != 1 || aps[0].Label != "admin" {
+		t.Error("Unexpected group access points with tag: ", aps)
+	}
+
+	// Renaming a site keeps it in the groups that list it.
+	renameTestSite(t, office.Name, entities.RenameRequest{NewName: test_prefix + "groupbranch"}, 200)
+	var renamed entities.Group
+	getTestJson(t, "/groups/" + group.Name, 200, &renamed)
+	if len(renamed.Sites) != 1 || renamed.Sites[0] != test_prefix + "groupbranch" {
+		t.Error("Group members were not renamed: ", renamed)
+	}
+	deleteTestSite(t, test_prefix + "groupbranch", 200)
+	var removed entities.Group
+	getTestJson(t, "/groups/" + group.Name, 200, &removed)
+	if len(removed.Sites) != 0 {
+		t.Error("Deleted site is still a group member: ", removed)
+	}
+
+	// Sites deleted in a batch leave their groups too.
+	listed := entities.Group{Name: test_prefix + "listed", Sites: []string{region.Name, shop.Name}}
+	listed_json, _ := json.Marshal(listed)
+	defer sendTestJson(t, "DELETE", "/groups/" + listed.Name, nil, 200)
+	postTestJson(t, "/groups", listed_json, 200)
+	batchTest(t, []batch.Operation{{Op: batch.DeleteSite, Name: shop.Name}, {Op: batch.DeleteSite, Name: region.Name}}, 200)
+	var emptied entities.Group
+	getTestJson(t, "/groups/" + listed.Name, 200, &emptied)
+	if emptied.Name != listed.Name || len(emptied.Sites) != 0 {
+		t.Error("Sites deleted in a batch are still group members: ", emptied)
+	}
+	var error_response entities.ErrorResponse
+	getTestJson(t, "/groups/" + test_prefix + "missing/accesspoints", 400, &error_response)
+}
+
 // =============== Helper functions ================= //
 func createTestSite(t *testing.T, site entities.Site, expected_response_code int) {
 	site_json, _ := site.ToJson()
@@ -124,7 +1228,7 @@ func createTestSite(t *testing.T, site entities.Site, expected_response_code int
 		}
 
 		// Ensure we were returned the data we sent
-		if !returned_site.EqualTo(&site, false) {
+		if !returned_site.EqualTo(withPriorities(site, returned_site), false) {
 			t.Error("Error creating site")
 			return
 		}
@@ -137,6 +1241,30 @@ func createTestSite(t *testing.T, site entities.Site, expected_response_code int
 	}
 }
 
+// Access points sent without a priority are given one by the server.
+func defaultPriority(expected, returned int) int {
+	if expected == 0 {
+		return returned
+	}
+	return expected
+}
+
+func withPriorities(expected entities.Site, returned entities.Site) *entities.Site {
+	returned_priorities := map[string]int{}
+	for _, ap := range returned.Access_points {
+		returned_priorities[ap.Label] = ap.Priority
+	}
+	aps := make([]entities.AccessPoint, len(expected.Access_points))
+	for i, ap := range expected.Access_points {
+		ap.Priority = defaultPriority(ap.Priority, returned_priorities[ap.Label])
+		aps[i] = ap
+	}
+	if expected.Access_points != nil {
+		expected.Access_points = aps
+	}
+	return &expected
+}
+
 func createTestAccessPoint(t *testing.T, site_name string, access_point entities.AccessPoint, expected_response_code int) {
 	ap_json, _ := access_point.ToJson()
 	resp, err := http.Post(url + "/sites/" + site_name + "/accesspoints", "application/json", bytes.NewBuffer(ap_json))
@@ -161,6 +1289,7 @@ func createTestAccessPoint(t *testing.T, site_name string, access_point entities
 		}
 
 		// Ensure we were returned the data we sent
+		access_point.Priority = defaultPriority(access_point.Priority, returned_ap.Priority)
 		if !returned_ap.EqualTo(&access_point) {
 			t.Error("Error creating access point")
 			return
@@ -274,6 +1403,7 @@ func getTestAccessPoint(t *testing.T, site_name string, access_point_label strin
 		}
 
 		// Ensure the correct ap was returned.
+		expected_response_ap.Priority = defaultPriority(expected_response_ap.Priority, returned_ap.Priority)
 		if !returned_ap.EqualTo(&expected_response_ap) {
 			t.Error("Returned Access Point: ", returned_ap, " does not match expected: ", expected_response_ap)
 			return
@@ -344,3 +1474,123 @@ func RemoveTestData(t *testing.T) {
 		t.Error(err.Error())
 	}
 }
+
+func getTestJson(t *testing.T, path string, expected_response_code int, v interface{}) {
+	resp, err := http.Get(url + path)
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected_response_code {
+		t.Error("Returned repsonse code:", resp.StatusCode, " does not match expected: ", expected_response_code)
+		return
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+	}
+}
+
+func importTestSites(t *testing.T, mode string, content_type string, body []byte, expected_response_code int) inventory.Plan {
+	var plan inventory.Plan
+	resp, err := http.Post(url + "/import?mode=" + mode, content_type, bytes.NewBuffer(body))
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return plan
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected_response_code {
+		t.Error("Returned repsonse code:", resp.StatusCode, " does not match expected: ", expected_response_code)
+		return plan
+	}
+	if expected_response_code == 200 {
+		json.NewDecoder(resp.Body).Decode(&plan)
+	}
+	return plan
+}
+
+func batchTest(t *testing.T, operations []batch.Operation, expected_response_code int) batch.Response {
+	var response batch.Response
+	operations_json, _ := json.Marshal(operations)
+	resp, err := http.Post(url + "/batch", "application/json", bytes.NewBuffer(operations_json))
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return response
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected_response_code {
+		t.Error("Returned repsonse code:", resp.StatusCode, " does not match expected: ", expected_response_code)
+	}
+	json.NewDecoder(resp.Body).Decode(&response)
+	return response
+}
+
+func renameTestSite(t *testing.T, site_name string, rename entities.RenameRequest, expected_response_code int) {
+	rename_json, _ := json.Marshal(rename)
+	resp, err := http.Post(url + "/sites/" + site_name + "/rename", "application/json", bytes.NewBuffer(rename_json))
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected_response_code {
+		t.Error("Returned repsonse code:", resp.StatusCode, " does not match expected: ", expected_response_code)
+	}
+}
+
+func transferTestAccessPoint(t *testing.T, site_name string, access_point_label string, op string, transfer entities.TransferRequest, expected_response_code int) {
+	transfer_json, _ := json.Marshal(transfer)
+	resp, err := http.Post(url + "/sites/" + site_name + "/accesspoints/" + access_point_label + "/" + op, "application/json", bytes.NewBuffer(transfer_json))
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected_response_code {
+		t.Error("Returned repsonse code:", resp.StatusCode, " does not match expected: ", expected_response_code)
+	}
+}
+
+func postTestJson(t *testing.T, path string, body []byte, expected_response_code int) {
+	resp, err := http.Post(url + path, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected_response_code {
+		t.Error(path, " returned repsonse code:", resp.StatusCode, " does not match expected: ", expected_response_code)
+	}
+}
+
+func sendTestJson(t *testing.T, method string, path string, body []byte, expected_response_code int) {
+	req, _ := http.NewRequest(method, url + path, bytes.NewBuffer(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected_response_code {
+		t.Error(method, " ", path, " returned repsonse code:", resp.StatusCode, " does not match expected: ", expected_response_code)
+	}
+}
+
+func deleteTestTemplate(t *testing.T, template_name string) {
+	req, _ := http.NewRequest("DELETE", url + "/templates/" + template_name, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error("Error running test: " + err.Error())
+		return
+	}
+	resp.Body.Close()
+}
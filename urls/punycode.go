@@ -0,0 +1,103 @@
+package urls
+
+import (
+	"errors"
+	"strings"
+)
+
+// Punycode parameters from RFC 3492.
+const (
+	base = 36
+	tMin = 1
+	tMax = 26
+	skew = 38
+	damp = 700
+	initialBias = 72
+	initialN = 128
+)
+
+// Encode a label as punycode, without the "xn--" prefix.
+func punycode(label string) (string, error) {
+	runes := []rune(label)
+	var output strings.Builder
+	for _, r := range runes {
+		if r < 0x80 {
+			output.WriteRune(r)
+		}
+	}
+	basic := output.Len()
+	handled := basic
+	if basic > 0 {
+		output.WriteByte('-')
+	}
+
+	n := rune(initialN)
+	delta := 0
+	bias := initialBias
+	for handled < len(runes) {
+		// The smallest code point not handled yet.
+		m := rune(0x7fffffff)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m - n) > (1 << 30) / (handled + 1) {
+			return "", errors.New("Host name label is too long")
+		}
+		delta += int(m - n) * (handled + 1)
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := base; ; k += base {
+				t := k - bias
+				if t < tMin {
+					t = tMin
+				} else if t > tMax {
+					t = tMax
+				}
+				if q < t {
+					break
+				}
+				output.WriteByte(digit(t + (q - t) % (base - t)))
+				q = (q - t) / (base - t)
+			}
+			output.WriteByte(digit(q))
+			bias = adapt(delta, handled + 1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return output.String(), nil
+}
+
+func digit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func adapt(delta int, points int, first bool) int {
+	if first {
+		delta /= damp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((base - tMin) * tMax) / 2 {
+		delta /= base - tMin
+		k += base
+	}
+	return k + (base - tMin + 1) * delta / (delta + skew)
+}
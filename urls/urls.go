@@ -0,0 +1,133 @@
+/*
+ * The purpose of this package is to put access point URLs in a canonical
+ * form, so that URLs that point to the same place compare equal.
+ */
+
+package urls
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+var defaultPorts = map[string]string{
+	"http": "80",
+	"https": "443",
+	"ws": "80",
+	"wss": "443",
+	"ftp": "21",
+}
+
+// The canonical form of raw: lowercase scheme and host, internationalised
+// host names in punycode, no default port, and dot segments removed from
+// the path. Strings that are not absolute URLs with a host are returned
+// unchanged, access point Urls are not required to be URLs.
+func Canonical(raw string) string {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" || parsed.Opaque != "" {
+		return raw
+	}
+
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	host, err := toASCII(parsed.Hostname())
+	if err != nil {
+		return raw
+	}
+	port := parsed.Port()
+	if port == defaultPorts[parsed.Scheme] {
+		port = ""
+	}
+	if port != "" || strings.Contains(host, ":") {
+		host = net.JoinHostPort(host, port)
+		host = strings.TrimSuffix(host, ":")
+	}
+	parsed.Host = host
+
+	parsed.Path = removeDotSegments(parsed.Path)
+	if parsed.RawPath != "" {
+		parsed.RawPath = removeDotSegments(parsed.RawPath)
+	}
+	return parsed.String()
+}
+
+// Remove "." and ".." segments as described in RFC 3986 section 5.2.4,
+// keeping a trailing slash.
+func removeDotSegments(path string) string {
+	if path == "" {
+		return path
+	}
+	var output []string
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		last := i == len(segments) - 1
+		switch segment {
+		case ".":
+			if last {
+				output = append(output, "")
+			}
+		case "..":
+			if len(output) > 1 {
+				output = output[:len(output) - 1]
+			}
+			if last {
+				output = append(output, "")
+			}
+		default:
+			output = append(output, segment)
+		}
+	}
+	cleaned := strings.Join(output, "/")
+	if strings.HasPrefix(path, "/") && !strings.HasPrefix(cleaned, "/") {
+		cleaned = "/" + cleaned
+	}
+	return cleaned
+}
+
+// Lowercase host and convert each label that is not ASCII to punycode.
+func toASCII(host string) (string, error) {
+	if strings.HasPrefix(host, "[") || net.ParseIP(host) != nil {
+		return strings.ToLower(host), nil
+	}
+	labels := strings.Split(strings.ToLower(host), ".")
+	for i, label := range labels {
+		ascii := true
+		for _, c := range label {
+			if c >= 0x80 {
+				ascii = false
+				break
+			}
+		}
+		if ascii {
+			continue
+		}
+		encoded, err := punycode(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = "xn--" + encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// Add query to the query string of raw, after any it already has.
+func AddQuery(raw string, query string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || query == "" {
+		return raw
+	}
+	if parsed.RawQuery != "" {
+		parsed.RawQuery += "&"
+	}
+	parsed.RawQuery += query
+	return parsed.String()
+}
+
+// Replace each {name} in template with the path escaped value of name.
+func Expand(template string, values map[string]string) string {
+	var replacements []string
+	for name, value := range values {
+		replacements = append(replacements, "{" + name + "}", url.PathEscape(value))
+	}
+	return strings.NewReplacer(replacements...).Replace(template)
+}
@@ -0,0 +1,57 @@
+package urls
+
+import (
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	cases := map[string]string{
+		"HTTP://Example.com:80/a/../b": "http://example.com/b",
+		"http://example.com/b": "http://example.com/b",
+		"https://example.com:443": "https://example.com",
+		"https://example.com:8443/./x/": "https://example.com:8443/x/",
+		"http://example.com/a/b/..": "http://example.com/a/",
+		"http://bücher.example/": "http://xn--bcher-kva.example/",
+		"http://München.DE/": "http://xn--mnchen-3ya.de/",
+		"http://[::1]:80/": "http://[::1]/",
+		"http://example.com/?q=1#Top": "http://example.com/?q=1#Top",
+		"Harry Potter": "Harry Potter",
+		"cat": "cat",
+		"mailto:someone@example.com": "mailto:someone@example.com",
+	}
+	for raw, expected := range cases {
+		if canonical := Canonical(raw); canonical != expected {
+			t.Error(raw, ": got ", canonical, ", expected ", expected)
+		}
+	}
+}
+
+func TestPunycode(t *testing.T) {
+	// Examples from RFC 3492 section 7.1.
+	cases := map[string]string{
+		"他们为什么不说中文": "ihqwcrb4cv8a8dqg056pqjye",
+		"3年b組金八先生": "3b-ww4c5e180e575a65lsy2b",
+	}
+	for label, expected := range cases {
+		encoded, err := punycode(label)
+		if err != nil || encoded != expected {
+			t.Error(label, ": got ", encoded, ", expected ", expected, err)
+		}
+	}
+}
+
+func TestAddQuery(t *testing.T) {
+	if added := AddQuery("http://example.com/a?x=1#top", "y=2"); added != "http://example.com/a?x=1&y=2#top" {
+		t.Error("Unexpected Url: ", added)
+	}
+	if added := AddQuery("http://example.com/a", ""); added != "http://example.com/a" {
+		t.Error("Unexpected Url: ", added)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	expanded := Expand("https://example.com/missing/{site}/{label}", map[string]string{"site": "foo", "label": "a b"})
+	if expanded != "https://example.com/missing/foo/a%20b" {
+		t.Error("Unexpected expansion: ", expanded)
+	}
+}
@@ -0,0 +1,311 @@
+/*
+ * The purpose of this package is to check sites against validation rules
+ * read from a configuration file, on top of the built in checks.
+ */
+
+package validation
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"../entities"
+	"../urls"
+)
+
+// Rules for one string field. Zero values are not enforced.
+type FieldRule struct {
+	Required bool
+	Pattern string
+	MinLength int
+	MaxLength int
+	// If set, the field must hold one of these values.
+	Allowed []string
+
+	pattern *regexp.Regexp
+}
+
+// Rules for access point Urls. Hosts may start with "*." to allow every
+// subdomain.
+type URLRule struct {
+	Schemes []string
+	Hosts []string
+}
+
+type Rules struct {
+	// By field name: Name, Role and Uri.
+	Site map[string]*FieldRule
+	// By field name: Label and Url.
+	AccessPoint map[string]*FieldRule
+	Url URLRule
+	MaxAccessPoints int
+	// Where canonical access point Urls must be unique: "site" for within
+	// each site, "global" for across every stored site.
+	UniqueUrls string
+}
+
+// UniqueUrls settings.
+const (
+	UniquePerSite = "site"
+	UniqueGlobal = "global"
+)
+
+var siteFields = map[string]func(*entities.Site) string{
+	"Name": func(s *entities.Site) string { return s.Name },
+	"Role": func(s *entities.Site) string { return s.Role },
+	"Uri": func(s *entities.Site) string { return s.Uri },
+}
+
+var accessPointFields = map[string]func(*entities.AccessPoint) string{
+	"Label": func(ap *entities.AccessPoint) string { return ap.Label },
+	"Url": func(ap *entities.AccessPoint) string { return ap.Url },
+}
+
+// Used when no rules file is configured: access points must have a label,
+// since they are addressed by it.
+func DefaultRules() *Rules {
+	return &Rules{AccessPoint: map[string]*FieldRule{"Label": {Required: true}}}
+}
+
+// Read rules from a JSON file, checking that they can be applied.
+func Load(path string) (*Rules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := &Rules{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(rules)
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	err = rules.compile()
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return rules, nil
+}
+
+func (rules *Rules) compile() error {
+	if rules.UniqueUrls != "" && rules.UniqueUrls != UniquePerSite && rules.UniqueUrls != UniqueGlobal {
+		return errors.New("UniqueUrls must be \"" + UniquePerSite + "\" or \"" + UniqueGlobal + "\"")
+	}
+	for field, rule := range rules.Site {
+		if _, ok := siteFields[field]; !ok {
+			return errors.New("Unknown site field: " + field)
+		}
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	for field, rule := range rules.AccessPoint {
+		if _, ok := accessPointFields[field]; !ok {
+			return errors.New("Unknown access point field: " + field)
+		}
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rule *FieldRule) compile() error {
+	if rule.Pattern == "" {
+		return nil
+	}
+	pattern, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return err
+	}
+	rule.pattern = pattern
+	return nil
+}
+
+// Every way in which site breaks the rules.
+func (rules *Rules) Check(site *entities.Site) []entities.Violation {
+	var violations []entities.Violation
+	add := func(field string, message string) {
+		violations = append(violations, entities.Violation{Field: field, Message: message})
+	}
+
+	for _, field := range sortedKeys(rules.Site) {
+		for _, message := range rules.Site[field].check(field, siteFields[field](site)) {
+			add(field, message)
+		}
+	}
+
+	if rules.MaxAccessPoints > 0 && len(site.Access_points) > rules.MaxAccessPoints {
+		add("Access_points", "A site can have at most " + strconv.Itoa(rules.MaxAccessPoints) + " access points")
+	}
+	for i := range site.Access_points {
+		ap := &site.Access_points[i]
+		for _, field := range sortedKeys(rules.AccessPoint) {
+			for _, message := range rules.AccessPoint[field].check("Access Point " + field, accessPointFields[field](ap)) {
+				add(entities.APField(i, field), message)
+			}
+		}
+		if message := rules.Url.check(ap.Url); message != "" {
+			add(entities.APField(i, "Url"), "Access Point Url " + message)
+		}
+	}
+
+	if rules.UniqueUrls != "" {
+		for _, violation := range checkUnique(site) {
+			add(violation.Field, violation.Message)
+		}
+	}
+	return violations
+}
+
+// A check of a site against the Urls of every other site in sites, for
+// global uniqueness, or nil if Urls need not be unique across sites. sites
+// are indexed once, and should be every site as the store will be once
+// the checked sites are written.
+func (rules *Rules) AgainstSites(sites []entities.Site) func(site *entities.Site) []entities.Violation {
+	if rules.UniqueUrls != UniqueGlobal {
+		return nil
+	}
+	// Owners of each canonical Url, by site name.
+	owners := make(map[string]map[string]string)
+	for _, site := range sites {
+		for _, ap := range site.Access_points {
+			if ap.Url == "" {
+				continue
+			}
+			canonical := urls.Canonical(ap.Url)
+			if owners[canonical] == nil {
+				owners[canonical] = make(map[string]string)
+			}
+			owners[canonical][site.Name] = site.Name + "/" + ap.Label
+		}
+	}
+	return func(site *entities.Site) []entities.Violation {
+		var violations []entities.Violation
+		for i, ap := range site.Access_points {
+			if ap.Url == "" {
+				continue
+			}
+			canonical := urls.Canonical(ap.Url)
+			for _, site_name := range sortedNames(owners[canonical]) {
+				if site_name != site.Name {
+					violations = append(violations, entities.Violation{Field: entities.APField(i, "Url"),
+						Message: "Access Point Url " + canonical + " is already used by " + owners[canonical][site_name]})
+					break
+				}
+			}
+		}
+		return violations
+	}
+}
+
+// Access points whose canonical Url is already used by an earlier access
+// point of the site.
+func checkUnique(site *entities.Site) []entities.Violation {
+	used := make(map[string]string)
+	var violations []entities.Violation
+	for i, ap := range site.Access_points {
+		if ap.Url == "" {
+			continue
+		}
+		canonical := urls.Canonical(ap.Url)
+		if owner, ok := used[canonical]; ok {
+			violations = append(violations, entities.Violation{Field: entities.APField(i, "Url"),
+				Message: "Access Point Url " + canonical + " is already used by " + owner})
+			continue
+		}
+		used[canonical] = site.Name + "/" + ap.Label
+	}
+	return violations
+}
+
+func (rule *FieldRule) check(name string, value string) []string {
+	var messages []string
+	if value == "" {
+		if rule.Required {
+			messages = append(messages, name + " is required")
+		}
+		return messages
+	}
+	length := utf8.RuneCountInString(value)
+	if rule.MinLength > 0 && length < rule.MinLength {
+		messages = append(messages, name + " must be at least " + strconv.Itoa(rule.MinLength) + " characters")
+	}
+	if rule.MaxLength > 0 && length > rule.MaxLength {
+		messages = append(messages, name + " must be at most " + strconv.Itoa(rule.MaxLength) + " characters")
+	}
+	if rule.pattern != nil && !rule.pattern.MatchString(value) {
+		messages = append(messages, name + " must match " + rule.Pattern)
+	}
+	if len(rule.Allowed) > 0 && !contains(rule.Allowed, value) {
+		messages = append(messages, name + " must be one of: " + strings.Join(rule.Allowed, ", "))
+	}
+	return messages
+}
+
+// Empty if raw is allowed, otherwise why not.
+func (rule *URLRule) check(raw string) string {
+	if len(rule.Schemes) == 0 && len(rule.Hosts) == 0 || raw == "" {
+		return ""
+	}
+	parsed, err := url.Parse(urls.Canonical(raw))
+	if err != nil || parsed.Scheme == "" {
+		return "must be an absolute URL"
+	}
+	if len(rule.Schemes) > 0 && !contains(rule.Schemes, strings.ToLower(parsed.Scheme)) {
+		return "scheme must be one of: " + strings.Join(rule.Schemes, ", ")
+	}
+	if len(rule.Hosts) > 0 && !matchHost(rule.Hosts, strings.ToLower(parsed.Hostname())) {
+		return "host must be one of: " + strings.Join(rule.Hosts, ", ")
+	}
+	return ""
+}
+
+func matchHost(hosts []string, host string) bool {
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedNames(owners map[string]string) []string {
+	var names []string
+	for name := range owners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Field names in a fixed order, so violations are reported consistently.
+func sortedKeys(fields map[string]*FieldRule) []string {
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
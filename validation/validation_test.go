@@ -0,0 +1,83 @@
+package validation
+
+import (
+	"reflect"
+	"testing"
+	"../entities"
+)
+
+// Test:
+//	that a site following the rules has no violations
+//	that every broken rule is reported, not just the first
+func TestCheck(t *testing.T) {
+	rules, err := Load("../rules.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	site := entities.Site{Name: "foo", Role: "edge", Uri: "foo.example.com",
+		Access_points: []entities.AccessPoint{{Label: "web", Url: "https://www.example.com/"}}}
+	if violations := rules.Check(&site); len(violations) != 0 {
+		t.Error("Unexpected violations: ", violations)
+	}
+
+	site = entities.Site{Name: "foo", Role: "printer",
+		Access_points: []entities.AccessPoint{{Label: "Web", Url: "ftp://example.com"}, {Label: "db", Url: "http://example.org"}, {Url: "http://example.com"}}}
+	var fields []string
+	for _, violation := range rules.Check(&site) {
+		fields = append(fields, violation.Field)
+	}
+	expected := []string{"Role", "Uri", "Access_points[0].Label", "Access_points[0].Url", "Access_points[1].Url", "Access_points[2].Label"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Error("Violations for fields ", fields, " do not match expected ", expected)
+	}
+}
+
+func TestMaxAccessPoints(t *testing.T) {
+	rules := &Rules{MaxAccessPoints: 1}
+	site := entities.Site{Name: "foo", Access_points: []entities.AccessPoint{{Label: "a"}, {Label: "b"}}}
+	if violations := rules.Check(&site); len(violations) != 1 || violations[0].Field != "Access_points" {
+		t.Error("Expected one violation for too many access points, got ", violations)
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	rules := &Rules{Site: map[string]*FieldRule{"Colour": {Required: true}}}
+	if err := rules.compile(); err == nil {
+		t.Error("Expected an error for an unknown field")
+	}
+	rules = &Rules{AccessPoint: map[string]*FieldRule{"Url": {Pattern: "("}}}
+	if err := rules.compile(); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+// Test:
+//	that Urls are compared in canonical form, within a site and across sites
+//	that a site is not checked against its own access points
+func TestUniqueUrls(t *testing.T) {
+	site := entities.Site{Name: "foo", Access_points: []entities.AccessPoint{
+		{Label: "a", Url: "HTTP://Example.com:80/a/../b"}, {Label: "b", Url: "http://example.com/c"}, {Label: "c", Url: "http://EXAMPLE.com/c"}}}
+	sites := []entities.Site{site, {Name: "bar", Access_points: []entities.AccessPoint{{Label: "web", Url: "http://example.com/b"}}}}
+
+	rules := &Rules{UniqueUrls: UniquePerSite}
+	if violations := rules.Check(&site); len(violations) != 1 || violations[0].Field != "Access_points[2].Url" {
+		t.Error("Per site uniqueness violations: ", violations)
+	}
+	if rules.AgainstSites(sites) != nil {
+		t.Error("Per site uniqueness checks other sites")
+	}
+
+	rules.UniqueUrls = UniqueGlobal
+	check := rules.AgainstSites(sites)
+	if violations := check(&site); len(violations) != 1 || violations[0].Field != "Access_points[0].Url" {
+		t.Error("Global uniqueness violations: ", violations)
+	}
+	if violations := check(&sites[1]); len(violations) != 1 || violations[0].Message != "Access Point Url http://example.com/b is already used by foo/a" {
+		t.Error("Global uniqueness violations: ", violations)
+	}
+	// With the Url moved from bar to foo.
+	if violations := rules.AgainstSites(sites[:1])(&site); len(violations) != 0 {
+		t.Error("Moved Url was rejected: ", violations)
+	}
+}